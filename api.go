@@ -5,6 +5,7 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"github.com/coocood/jas"
 	"github.com/dchest/captcha"
 	"html"
@@ -12,8 +13,10 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"path"
 	"regexp"
+	"strconv"
 	"time"
 )
 
@@ -59,7 +62,39 @@ func RegisterAPI(prefix string) {
 	rand.Seed(time.Now().Unix())
 
 	// Handle "<prefix>/api/". Note that it must begin and end with /.
-	http.Handle(path.Join("/", prefix, "api")+"/", router)
+	// Dumps of nodes can be retrieved conditionally, so that they are
+	// not sent again if they have not changed, and responses which
+	// are used by parent maps, including those that nothing has
+	// changed, are signed, so that they can verify where they came
+	// from. Every response is compressed if the client accepts it.
+	http.Handle(path.Join("/", prefix, "api")+"/", gzipHandler{
+		signedHandler{
+			Handler: conditionalHandler{
+				Handler: router,
+				paths: map[string]bool{
+					path.Join("/", prefix, "api", "all"): true,
+				},
+			},
+			paths: map[string]bool{
+				path.Join("/", prefix, "api", "all"):    true,
+				path.Join("/", prefix, "api", "status"): true,
+			},
+		},
+	})
+
+	// Resources nested below "<prefix>/api/" are handled by a separate
+	// router, whose paths are relative to it. Each path is handled
+	// exactly, so that "<prefix>/api/child_maps" is left to the main
+	// router.
+	nestedRouter := jas.NewRouter(new(ChildMaps))
+	nestedRouter.BasePath = path.Join("/", prefix, "api")
+	nestedRouter.InternalErrorLogger = nil
+	l.Debug("Nested API paths:\n", nestedRouter.HandledPaths(true))
+	for _, name := range []string{"health", "add", "disable", "enable",
+		"rename", "remove"} {
+		http.Handle(path.Join("/", prefix, "api", "child_maps", name),
+			nestedRouter)
+	}
 }
 
 // Get responds on the root API handler ("/api/") with 303 SeeOther
@@ -89,11 +124,30 @@ func (*Api) GetEcho(ctx *jas.Context) {
 // (Not yet implemented.)
 func (*Api) GetStatus(ctx *jas.Context) {
 	localNodes := Db.LenNodes(false)
+
+	// Count the child maps by their health.
+	health, err := ChildMapsHealth()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		l.Errf("Error dumping child maps: %s", err)
+		return
+	}
+	healthCounts := map[string]int{
+		HealthUp:       0,
+		HealthDegraded: 0,
+		HealthDown:     0,
+	}
+	for _, h := range health {
+		healthCounts[h.Health]++
+	}
+
 	ctx.Data = map[string]interface{}{
-		"Name":        Conf.Name,
-		"LocalNodes":  localNodes,
-		"CachedNodes": Db.LenNodes(true) - localNodes,
-		"CachedMaps":  len(Conf.ChildMaps),
+		"Name":           Conf.Name,
+		"LocalNodes":     localNodes,
+		"CachedNodes":    Db.LenNodes(true) - localNodes,
+		"CachedMaps":     len(health),
+		"ChildMapHealth": healthCounts,
+		"PublicKey":      EncodePublicKey(IdentityPublic),
 	}
 }
 
@@ -160,7 +214,7 @@ func (*Api) GetNode(ctx *jas.Context) {
 // PostNode creates a *Node from the submitted form and queues it for
 // addition with a positive 64 bit integer as an ID.
 func (*Api) PostNode(ctx *jas.Context) {
-	if Db.ReadOnly {
+	if Db.IsReadOnly() {
 		// If the database is readonly, set that as the error and
 		// return.
 		ctx.Error = ReadOnlyError
@@ -218,7 +272,7 @@ func (*Api) PostNode(ctx *jas.Context) {
 	node.Status = uint32(status)
 
 	// Ensure that the node is correct and usable.
-	if err = Db.VerifyRegistrant(node); err != nil {
+	if err = VerifyRegistrant(node); err != nil {
 		ctx.Error = jas.NewRequestError(err.Error())
 		return
 	}
@@ -281,7 +335,10 @@ func (*Api) PostNode(ctx *jas.Context) {
 			return
 		}
 
-		// Add the new node to the RSS feed.
+		// Record the addition in the node's history, push it to
+		// parent maps, and add the new node to the RSS feed.
+		recordChange(ActionAdd, ctx.RemoteAddr, node)
+		queuePush(ActionAdd, node)
 		AddNodeToRSS(node, time.Now())
 
 		ctx.Data = "node registered"
@@ -296,7 +353,7 @@ func (*Api) PostNode(ctx *jas.Context) {
 // verification email, and requires that the request be sent by the
 // Node that is being update.
 func (*Api) PostUpdateNode(ctx *jas.Context) {
-	if Db.ReadOnly {
+	if Db.IsReadOnly() {
 		// If the database is readonly, set that as the error and
 		// return.
 		ctx.Error = ReadOnlyError
@@ -316,13 +373,13 @@ func (*Api) PostUpdateNode(ctx *jas.Context) {
 		return
 	}
 
-	node, err := Db.GetNode(ip)
+	node, err := Db.GetLocalNode(ip)
 	if err != nil {
 		ctx.Error = jas.NewInternalError(err.Error())
 		return
 	}
 
-	if node == nil || len(node.OwnerEmail) == 0 {
+	if node == nil {
 		ctx.Error = jas.NewRequestError("no matching local node")
 		return
 	}
@@ -382,6 +439,8 @@ func (*Api) PostUpdateNode(ctx *jas.Context) {
 		l.Errf("Error updating %q: %s", node.Addr, err)
 		return
 	}
+	recordChange(ActionUpdate, ctx.RemoteAddr, node)
+	queuePush(ActionUpdate, node)
 
 	// If we reach this point, all was successful.
 	ctx.Data = "successful"
@@ -391,7 +450,7 @@ func (*Api) PostUpdateNode(ctx *jas.Context) {
 // database. This must be done from that node's address, or an admin
 // address.
 func (*Api) PostDeleteNode(ctx *jas.Context) {
-	if Db.ReadOnly {
+	if Db.IsReadOnly() {
 		// If the database is readonly, set that as the error and
 		// return.
 		ctx.Error = ReadOnlyError
@@ -420,18 +479,29 @@ func (*Api) PostDeleteNode(ctx *jas.Context) {
 		return
 	}
 
+	// Retrieve the node before deleting it, so that its last state
+	// can be recorded in its history.
+	node, err := Db.GetLocalNode(ip)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		l.Errf("Error deleting node: %s\n", err)
+		return
+	}
+
 	// If all is well, then delete it.
 	err = Db.DeleteNode(ip)
 	if err == sql.ErrNoRows {
-		// If there are no rows with that IP, explain that in the
-		// error.
-		//
-		// I'm not actually sure this can happen. (DuoNoxSol)
+		// If there are no local rows with that IP, explain that in
+		// the error.
 		ctx.Error = jas.NewRequestError("no matching node")
 	} else if err != nil {
 		ctx.Error = jas.NewInternalError(err)
-		l.Errf("Error deleting node: %s\n")
+		l.Errf("Error deleting node: %s\n", err)
 	} else {
+		if node != nil {
+			recordChange(ActionDelete, ctx.RemoteAddr, node)
+		}
+		queuePush(ActionDelete, &Node{Addr: ip})
 		l.Infof("Node %q deleted\n", ip)
 		ctx.Data = "deleted"
 	}
@@ -441,7 +511,7 @@ func (*Api) PostDeleteNode(ctx *jas.Context) {
 // database, as identified by its long random ID.
 func (*Api) GetVerify(ctx *jas.Context) {
 	id := ctx.RequireInt("id")
-	ip, verifyerr, err := Db.VerifyQueuedNode(id, ctx.Request)
+	ip, verifyerr, err := VerifyQueuedNode(id, ctx.Request)
 	if verifyerr != nil {
 		// If there was an error inverification, there was no internal
 		// error, but the circumstances of the verification were
@@ -470,8 +540,16 @@ func (*Api) GetVerify(ctx *jas.Context) {
 // GetAll dumps the entire database of nodes, including cached
 // ones. If the form value `since` is supplied with a valid RFC3339
 // timestamp, only nodes updated or cached more recently than that
-// will be dumped. If 'geojson' is present, then the "data" field
-// contains the dump in GeoJSON compliant form.
+// will be dumped, and the "data" field will contain the nodes under
+// "nodes" and tombstones for nodes deleted since then under
+// "deleted". If `asof` is supplied instead, the local nodes are
+// reconstructed from their history as they were at that time. The
+// nodes can be filtered by the form values read by formNodeQuery. If
+// 'sort', 'cursor', or 'limit' are supplied, as read by
+// formPagination, the nodes are sorted, and if they are paginated,
+// the "data" field contains the page under "nodes" and the cursor for
+// the next page under "next". If 'geojson' is present, then the nodes
+// are given in GeoJSON compliant form.
 func (*Api) GetAll(ctx *jas.Context) {
 	// We must invoke ParseForm() so that we can access ctx.Form.
 	ctx.ParseForm()
@@ -479,11 +557,31 @@ func (*Api) GetAll(ctx *jas.Context) {
 	// In order to access this at the end, we need to declare nodes
 	// here, so the results from the dump don't go out of scope.
 	var nodes []*Node
+	var deleted []*Tombstone
 	var err error
 
+	// Restrict the dump to the nodes matching the form values, if
+	// any were given, and find out whether to sort and paginate it.
+	query := formNodeQuery(ctx)
+	if query == nil || !formPagination(ctx, query) {
+		return
+	}
+	paginated := query.Limit > 0 || query.After != nil
+	var next *NodeCursor
+
 	// If the form value "since" was supplied, we will be doing a dump
 	// based on update/retrieve time.
-	if tstring := ctx.FormValue("since"); len(tstring) > 0 {
+	since, asof := ctx.FormValue("since"), ctx.FormValue("asof")
+	if len(query.Sort) > 0 || paginated {
+		if len(since) > 0 || len(asof) > 0 {
+			ctx.Data = "sort, cursor, and limit cannot be combined " +
+				"with since or asof"
+			ctx.Error = jas.NewRequestError("invalidQuery")
+			return
+		}
+	}
+
+	if tstring := since; len(tstring) > 0 {
 		var t time.Time
 		t, err = time.Parse(time.RFC3339, tstring)
 		if err != nil {
@@ -492,13 +590,36 @@ func (*Api) GetAll(ctx *jas.Context) {
 			return
 		}
 
-		// Now, perform the time-based dump. Errors will be handled
-		// outside the if block.
+		// Now, perform the time-based dump, and find which nodes
+		// have been deleted. Errors will be handled outside the if
+		// block.
 		nodes, err = Db.DumpChanges(t)
+		if err == nil {
+			nodes = query.FilterNodes(nodes)
+			deleted, err = Db.DumpDeleted(t)
+		}
+		if err == nil {
+			err = CacheFormatTombstones(Db, deleted)
+		}
+	} else if tstring := asof; len(tstring) > 0 {
+		var t time.Time
+		t, err = time.Parse(time.RFC3339, tstring)
+		if err != nil {
+			ctx.Data = err.Error()
+			ctx.Error = jas.NewRequestError("invalidTime")
+			return
+		}
+
+		// Only local nodes have a history, so cached nodes are not
+		// included in this dump.
+		nodes, err = Db.DumpLocalAsOf(t)
+		if err == nil {
+			nodes = query.FilterNodes(nodes)
+		}
 	} else {
 		// If there was no "since," provide a simple full-database
-		// dump.
-		nodes, err = Db.DumpNodes()
+		// dump, restricted by the query if there is one.
+		nodes, next, err = Db.QueryNodes(query)
 	}
 
 	// Handle any database errors here.
@@ -510,21 +631,249 @@ func (*Api) GetAll(ctx *jas.Context) {
 
 	// If the form value 'geojson' is included, dump in GeoJSON
 	// form. Otherwise, just dump with normal marhshalling.
+	var data interface{}
 	if _, ok := ctx.Form["geojson"]; ok {
-		ctx.Data = FeatureCollectionNodes(nodes)
+		data = FeatureCollectionNodes(nodes)
 	} else {
-		mappedNodes, err := Db.CacheFormatNodes(nodes)
+		mappedNodes, err := CacheFormatNodes(Db, nodes)
 		if err != nil {
 			ctx.Error = jas.NewInternalError(err)
 			l.Err(err)
 			return
 		}
-		ctx.Data = mappedNodes
+		data = mappedNodes
+	}
+
+	// If this was a dump of changes, then the tombstones need to be
+	// included alongside the nodes.
+	if deleted != nil {
+		ctx.Data = map[string]interface{}{
+			"nodes":   data,
+			"deleted": deleted,
+		}
+	} else if paginated {
+		// If this was a page of nodes, then the cursor for the next
+		// page needs to be included, or null if this was the last.
+		var cursor interface{}
+		if next != nil {
+			cursor = next.String()
+		}
+		ctx.Data = map[string]interface{}{
+			"nodes": data,
+			"next":  cursor,
+		}
+	} else {
+		ctx.Data = data
+	}
+}
+
+// formPagination sets the Sort, After, and Limit fields of the given
+// query from the form values 'sort', 'cursor', and 'limit'. If any
+// are invalid, it sets ctx.Error and returns false.
+func formPagination(ctx *jas.Context, query *NodeQuery) bool {
+	query.Sort = ctx.FormValue("sort")
+
+	var err error
+	if cursor := ctx.FormValue("cursor"); len(cursor) > 0 {
+		query.After, err = ParseNodeCursor(cursor)
+	}
+	if limit := ctx.FormValue("limit"); err == nil && len(limit) > 0 {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit <= 0 {
+			err = InvalidLimitError
+		}
+	}
+	if err == nil {
+		err = query.Validate()
+	}
+
+	if err != nil {
+		ctx.Data = err.Error()
+		ctx.Error = jas.NewRequestError("invalidQuery")
+		return false
+	}
+	return true
+}
+
+// formArea returns the Area given by the form values 'bbox', or
+// 'near' and 'radius', or nil if neither was supplied.
+func formArea(ctx *jas.Context) (area *Area, err error) {
+	bbox := ctx.FormValue("bbox")
+	near := ctx.FormValue("near")
+	switch {
+	case len(bbox) > 0 && len(near) > 0:
+		return nil, AreaConflictError
+	case len(bbox) > 0:
+		return ParseBBox(bbox)
+	case len(near) > 0:
+		return ParseCircle(near, ctx.FormValue("radius"))
+	}
+	return nil, nil
+}
+
+// GetSearch responds with the nodes, both local and cached, which
+// match the form value 'q', ranked by relevance, as described by
+// SearchNodes. The results can be restricted in the same way as those
+// of GetAll, using 'status_all', 'status_any', 'source', 'bbox', and
+// 'near' with 'radius'.
+func (*Api) GetSearch(ctx *jas.Context) {
+	q := ctx.RequireStringLen(1, 255, "q")
+
+	query := formNodeQuery(ctx)
+	if query == nil {
+		return
+	}
+
+	nodes, _, err := Db.QueryNodes(query)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		l.Errf("Error searching for %q: %s", q, err)
+		return
+	}
+
+	idSources, err := Db.GetMapIDToSource()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		l.Errf("Error searching for %q: %s", q, err)
+		return
+	}
+
+	ctx.Data = SearchNodes(nodes, q, idSources)
+}
+
+// formNodeQuery builds a NodeQuery from the form values of the
+// request. 'status_all' and 'status_any' are status bit masks, in
+// decimal or hexadecimal with a leading "0x". 'source' may be given
+// more than once, and is either "local" or the hostname of a child
+// map. 'bbox', or 'near' and 'radius', give an Area, as in
+// formArea. If any value is invalid, it sets ctx.Error and returns
+// nil.
+func formNodeQuery(ctx *jas.Context) (query *NodeQuery) {
+	ctx.ParseForm()
+	query = new(NodeQuery)
+
+	var err error
+	query.Area, err = formArea(ctx)
+	if err != nil {
+		ctx.Data = err.Error()
+		ctx.Error = jas.NewRequestError("invalidArea")
+		return nil
+	}
+
+	masks := []struct {
+		name string
+		mask *uint32
+	}{
+		{"status_all", &query.StatusAll},
+		{"status_any", &query.StatusAny},
+	}
+	for _, m := range masks {
+		value := ctx.FormValue(m.name)
+		if len(value) == 0 {
+			continue
+		}
+		status, err := strconv.ParseUint(value, 0, 32)
+		if err != nil {
+			ctx.Data = m.name
+			ctx.Error = jas.NewRequestError("invalidStatus")
+			return nil
+		}
+		*m.mask = uint32(status)
 	}
+
+	if sources := ctx.Form["source"]; len(sources) > 0 {
+		sourceToID, err := Db.GetMapSourceToID()
+		if err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			l.Errf("Error listing child maps: %s", err)
+			return nil
+		}
+
+		query.SourceIDs = make([]int, len(sources))
+		for i, source := range sources {
+			id, ok := sourceToID[source]
+			if !ok {
+				ctx.Data = source
+				ctx.Error = jas.NewRequestError("unknownSource")
+				return nil
+			}
+			query.SourceIDs[i] = id
+		}
+	}
+	return
 }
 
+// GetHistory responds with every recorded change to the local node
+// with the given address, oldest first. The address from which each
+// change was made is only included for admins.
+func (*Api) GetHistory(ctx *jas.Context) {
+	ip := IP(net.ParseIP(ctx.RequireStringLen(0, 40, "address")))
+	if ip == nil {
+		// If this is encountered, the address was incorrectly
+		// formatted.
+		ctx.Error = jas.NewRequestError("addressInvalid")
+		return
+	}
+
+	changes, err := Db.NodeHistory(ip)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		l.Errf("Error retrieving history of %q: %s", ip, err)
+		return
+	}
+
+	if !IsAdmin(ctx.Request) {
+		for _, change := range changes {
+			change.Actor = ""
+		}
+	}
+	ctx.Data = changes
+}
+
+// GetAllPeers responds with every link between nodes which is
+// currently present. If the form value `since` is supplied with a
+// valid RFC3339 timestamp, it instead responds with every link which
+// was first seen or dropped since then.
 func (*Api) GetAllPeers(ctx *jas.Context) {
-	ctx.Data = KnownPeers
+	var pairs []*Pair
+	var err error
+	if since := ctx.FormValue("since"); len(since) > 0 {
+		var t time.Time
+		if t, err = time.Parse(time.RFC3339, since); err != nil {
+			ctx.Data = err.Error()
+			ctx.Error = jas.NewRequestError("invalidTime")
+			return
+		}
+		pairs, err = Db.DumpPeerChanges(t)
+	} else {
+		pairs, err = Db.DumpPeers()
+	}
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		l.Errf("Error dumping peers: %s", err)
+		return
+	}
+	ctx.Data = pairs
+}
+
+// GetPeers responds with every link to or from the node with the given
+// address, including those which have dropped.
+func (*Api) GetPeers(ctx *jas.Context) {
+	ip := IP(net.ParseIP(ctx.RequireStringLen(0, 40, "address")))
+	if ip == nil {
+		// If this is encountered, the address was incorrectly
+		// formatted.
+		ctx.Error = jas.NewRequestError("addressInvalid")
+		return
+	}
+
+	pairs, err := Db.GetPeersOf(ip)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		l.Errf("Error retrieving peers of %q: %s", ip, err)
+		return
+	}
+	ctx.Data = pairs
 }
 
 // PostMessage emails the given message to the email address owned by
@@ -559,8 +908,14 @@ func (*Api) PostMessage(ctx *jas.Context) {
 	replyto := ctx.RequireStringMatch(EmailRegexp, "from")
 	message := ctx.RequireStringLen(0, 1000, "message")
 
-	// Retrieve the appropriate node from the database.
-	node, err := Db.GetNode(ip)
+	// Retrieve the appropriate node from the database. Only local
+	// nodes can be messaged, even if a cached copy takes precedence.
+	node, err := Db.GetLocalNode(ip)
+	if err == nil && node == nil {
+		// If there is no local node, check for a cached one, so that
+		// the error can explain why it can't be messaged.
+		node, err = Db.GetNode(ip)
+	}
 	if err != nil {
 		// If we encounter an error here, it was a database error.
 		ctx.Error = jas.NewInternalError(err)
@@ -621,6 +976,324 @@ func (*Api) GetChildMaps(ctx *jas.Context) {
 	return
 }
 
+// GetFederation responds with the tree of maps whose nodes are
+// cached, as given by BuildFederation.
+func (*Api) GetFederation(ctx *jas.Context) {
+	var err error
+	ctx.Data, err = BuildFederation()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		l.Errf("Error building federation tree: %s", err)
+	}
+	return
+}
+
+// GetConflicts responds with every address which is known from more
+// than one source, with the copy which is shown and those which it
+// shadows, according to Conf.Conflicts.
+func (*Api) GetConflicts(ctx *jas.Context) {
+	var err error
+	ctx.Data, err = FindConflicts(Db)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		l.Errf("Error finding conflicts: %s", err)
+	}
+	return
+}
+
+// PostPush applies changes to nodes pushed by a child map, as
+// described by ApplyPush. The form value "events" is a JSON array of
+// PushEvents, and "time" is the Unix time at which they were sent.
+// The form value "mac" is the HMAC-SHA256 of those, made with the
+// PushKey of one of the child maps, which identifies it.
+func (*Api) PostPush(ctx *jas.Context) {
+	if Db.IsReadOnly() {
+		ctx.Error = ReadOnlyError
+		return
+	}
+
+	events := ctx.RequireString("events")
+	t := ctx.RequireString("time")
+	mac := ctx.RequireString("mac")
+
+	config, sent, err := AuthenticatePush(t, []byte(events), mac)
+	if err != nil && err != PushUnauthorizedError && err != PushExpiredError {
+		ctx.Error = jas.NewInternalError(err)
+		l.Errf("Error authenticating push: %s", err)
+		return
+	} else if err != nil {
+		ctx.Data = err.Error()
+		ctx.Error = jas.NewRequestError("pushUnauthorized")
+		l.Infof("Rejected push from %q: %s", ctx.RemoteAddr, err)
+		return
+	}
+
+	var pushed []*PushEvent
+	if err = json.Unmarshal([]byte(events), &pushed); err != nil {
+		ctx.Data = err.Error()
+		ctx.Error = jas.NewRequestError("eventsInvalid")
+		return
+	}
+
+	err = ApplyPush(config, sent, pushed)
+	if err == PushReplayedError {
+		ctx.Data = err.Error()
+		ctx.Error = jas.NewRequestError("pushUnauthorized")
+		l.Infof("Rejected push from %q: %s", ctx.RemoteAddr, err)
+		return
+	} else if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		l.Errf("Error applying push from %q: %s", config.Address, err)
+		return
+	}
+	ctx.Data = len(pushed)
+}
+
+// ChildMaps is the JAS resource for "<prefix>/api/child_maps/", whose
+// paths cannot be derived from the method names of Api.
+type ChildMaps struct{}
+
+// GetHealth responds with the health of each child map which is
+// synced, along with the information it is derived from.
+func (*ChildMaps) GetHealth(ctx *jas.Context) {
+	var err error
+	ctx.Data, err = ChildMapsHealth()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		l.Errf("Error dumping child maps: %s", err)
+	}
+	return
+}
+
+// PostAdd adds the child map at the form value "address", so that it
+// is synced along with those in Conf.ChildMaps, and syncs it
+// immediately. Its public key and push key, as in ChildMapConfig, can
+// be given as "key" and "push_key", and its name as "name", which
+// otherwise is the one it gives itself. It is only available to
+// admins.
+func (*ChildMaps) PostAdd(ctx *jas.Context) {
+	RequireAdmin(ctx)
+	if Db.IsReadOnly() {
+		ctx.Error = ReadOnlyError
+		return
+	}
+
+	address := requireChildMapAddress(ctx)
+	name, _ := ctx.FindStringLen(0, 255, "name")
+	config := ChildMapConfig{Address: address}
+	config.Key, _ = ctx.FindString("key")
+	config.PushKey, _ = ctx.FindStringLen(0, 255, "push_key")
+	if _, err := config.PublicKey(); err != nil {
+		ctx.Error = jas.NewRequestError("keyInvalid")
+		return
+	}
+
+	childMap, err := FindChildMap(address)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		l.Errf("Error adding child map %q: %s", address, err)
+		return
+	}
+	if IsConfiguredChildMap(address) || (childMap != nil && childMap.Listed) {
+		ctx.Error = jas.NewRequestError("childMapExists")
+		return
+	}
+
+	// The map may already be known as the source of nodes relayed by
+	// another, in which case it keeps its ID.
+	if childMap == nil {
+		id, err := Db.AddNewMapSource(address, name)
+		if err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			l.Errf("Error adding child map %q: %s", address, err)
+			return
+		}
+		childMap = &ChildMap{ID: id, Hostname: address}
+	}
+	childMap.Listed, childMap.Disabled = true, false
+	childMap.Key, childMap.PushKey = config.Key, config.PushKey
+	if len(name) > 0 {
+		childMap.Name, childMap.Renamed = name, true
+	}
+	if err = Db.UpdateChildMap(childMap); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		l.Errf("Error adding child map %q: %s", address, err)
+		return
+	}
+
+	StartSyncChildMap(childMap, config)
+	l.Infof("Child map %q added by %q\n", address, ctx.RemoteAddr)
+	ctx.Data = childMap
+}
+
+// PostDisable stops the child map at the form value "address" from
+// being synced, even if it is in Conf.ChildMaps, and removes the nodes
+// cached through it. It is only available to admins.
+func (*ChildMaps) PostDisable(ctx *jas.Context) {
+	setChildMapDisabled(ctx, true)
+}
+
+// PostEnable allows the child map at the form value "address" to be
+// synced again after PostDisable, and syncs it immediately. It is
+// only available to admins.
+func (*ChildMaps) PostEnable(ctx *jas.Context) {
+	setChildMapDisabled(ctx, false)
+}
+
+// setChildMapDisabled is the underlying function of PostDisable and
+// PostEnable.
+func setChildMapDisabled(ctx *jas.Context, disabled bool) {
+	RequireAdmin(ctx)
+	if Db.IsReadOnly() {
+		ctx.Error = ReadOnlyError
+		return
+	}
+
+	childMap := requireChildMap(ctx)
+	if childMap == nil {
+		return
+	}
+
+	// Wait for any sync of the map to finish, so that it cannot
+	// cache nodes again after they are cleared.
+	unlock := lockChildMap(childMap.ID)
+	childMap.Disabled = disabled
+	err := Db.UpdateChildMap(childMap)
+	if err == nil && disabled {
+		err = Db.ClearMapCache(childMap.ID)
+	}
+	unlock()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		l.Errf("Error changing child map %q: %s", childMap.Hostname, err)
+		return
+	}
+
+	// If the map is enabled and should be synced, sync it now.
+	if !disabled {
+		configs, err := ChildMapConfigs()
+		if err != nil {
+			ctx.Error = jas.NewInternalError(err)
+			l.Errf("Error changing child map %q: %s",
+				childMap.Hostname, err)
+			return
+		}
+		for _, config := range configs {
+			if config.Address == childMap.Hostname {
+				StartSyncChildMap(childMap, config)
+			}
+		}
+	}
+	ctx.Data = childMap
+}
+
+// PostRename sets the name of the child map at the form value
+// "address" to the form value "name", so that it is not replaced by
+// the name which the map gives itself. If the name is empty, the map's
+// own name is used again from its next sync. It is only available to
+// admins.
+func (*ChildMaps) PostRename(ctx *jas.Context) {
+	RequireAdmin(ctx)
+	if Db.IsReadOnly() {
+		ctx.Error = ReadOnlyError
+		return
+	}
+
+	name := ctx.RequireStringLen(0, 255, "name")
+	childMap := requireChildMap(ctx)
+	if childMap == nil {
+		return
+	}
+	childMap.Renamed = len(name) > 0
+	if childMap.Renamed {
+		childMap.Name = name
+	}
+	if err := Db.UpdateChildMap(childMap); err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		l.Errf("Error renaming child map %q: %s", childMap.Hostname, err)
+		return
+	}
+	ctx.Data = childMap
+}
+
+// PostRemove removes the child map at the form value "address", which
+// must have been added by PostAdd, and the nodes cached through it.
+// Maps in Conf.ChildMaps can only be disabled. It is only available to
+// admins.
+func (*ChildMaps) PostRemove(ctx *jas.Context) {
+	RequireAdmin(ctx)
+	if Db.IsReadOnly() {
+		ctx.Error = ReadOnlyError
+		return
+	}
+
+	childMap := requireChildMap(ctx)
+	if childMap == nil {
+		return
+	} else if IsConfiguredChildMap(childMap.Hostname) {
+		ctx.Error = jas.NewRequestError("childMapInConfig")
+		return
+	} else if !childMap.Listed {
+		ctx.Error = jas.NewRequestError("childMapUnknown")
+		return
+	}
+
+	// The map is kept in the database, because it may still be the
+	// source of nodes relayed by other maps.
+	unlock := lockChildMap(childMap.ID)
+	childMap.Listed = false
+	childMap.Key, childMap.PushKey = "", ""
+	err := Db.UpdateChildMap(childMap)
+	if err == nil {
+		err = Db.ClearMapCache(childMap.ID)
+	}
+	unlock()
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		l.Errf("Error removing child map %q: %s", childMap.Hostname, err)
+		return
+	}
+	l.Infof("Child map %q removed by %q\n", childMap.Hostname,
+		ctx.RemoteAddr)
+	ctx.Data = childMap
+}
+
+// requireChildMapAddress uses the finder to retrieve the value named
+// "address", and panics with "addressInvalid" if it is not an HTTP or
+// HTTPS URL.
+func requireChildMapAddress(ctx *jas.Context) string {
+	address := ctx.RequireStringLen(1, 255, "address")
+	u, err := url.Parse(address)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		len(u.Host) == 0 {
+		panic(jas.NewRequestError("addressInvalid"))
+	}
+	return address
+}
+
+// requireChildMap retrieves the known child map at the address given
+// by requireChildMapAddress. If there is none, or it can't be
+// retrieved, it sets ctx.Error and returns nil.
+func requireChildMap(ctx *jas.Context) *ChildMap {
+	address := requireChildMapAddress(ctx)
+	childMap, err := FindChildMap(address)
+	if err != nil {
+		ctx.Error = jas.NewInternalError(err)
+		l.Errf("Error retrieving child map %q: %s", address, err)
+	} else if childMap == nil {
+		ctx.Error = jas.NewRequestError("childMapUnknown")
+	}
+	return childMap
+}
+
+// RequireAdmin panics with "notAdmin" if the request does not come
+// from one of Conf.AdminAddresses.
+func RequireAdmin(ctx *jas.Context) {
+	if !IsAdmin(ctx.Request) {
+		panic(jas.NewRequestError("notAdmin"))
+	}
+}
+
 // RequireToken uses the finder to retrieve a value named "token", and
 // panics with "tokenInvalid" if there is either no such value, or it
 // is invalid or expired.
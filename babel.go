@@ -0,0 +1,252 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultBabelSocket is the local socket babeld listens on when it
+	// is started with "-G 33123".
+	defaultBabelSocket = "tcp://[::1]:33123"
+
+	// babelTimeout is the time allowed for a dump from babeld,
+	// including connecting.
+	babelTimeout = 10 * time.Second
+
+	// babelCostScale is the cost of a perfect wireless link, which is
+	// the ETX multiplied by 256. babelInfinity is the cost of a link
+	// which is unusable.
+	babelCostScale = 256
+	babelInfinity  = 0xFFFF
+)
+
+var (
+	BabelSocketInvalidError = errors.New(
+		"babel network admin \"socket\" must be unix:// or tcp://")
+	BabelSelfInvalidError = errors.New(
+		"babel network admin \"self\" must be an IP")
+)
+
+func init() {
+	RegisterNetwork("babel", func() Network { return &BabelNetwork{} })
+}
+
+// BabelNetwork is a Network whose links are read from the local
+// monitoring interface of babeld, given by the "socket" credential as
+// "unix:///path" or "tcp://host:port", which is defaultBabelSocket if
+// it is not given. Babel does not distribute the topology of the mesh,
+// so the links are only those of the node to its neighbours. The
+// addresses of the node are those of the host routes which it
+// originates, or else the "self" credential, and those of each
+// neighbour are those of the host routes which it originates.
+type BabelNetwork struct {
+	linkTable
+}
+
+// babelDump is the state of babeld, as given by "dump".
+type babelDump struct {
+	// self holds the addresses of the host routes originated by the
+	// node itself.
+	self []net.IP
+
+	// neighbours maps the link-local address of each neighbour to the
+	// cost of the link to it.
+	neighbours map[string]int
+
+	// originated maps the router ID of each node to the addresses of
+	// the host routes it originates, and announcers maps the
+	// link-local address of each neighbour to the router IDs of the
+	// nodes whose routes it originates.
+	originated map[string][]net.IP
+	announcers map[string][]string
+}
+
+func (n *BabelNetwork) Connect(conf *NetworkAdminConfig) (err error) {
+	network, address, self, err := babelCredentials(conf)
+	if err != nil {
+		return
+	}
+	dump, err := requestBabelDump(network, address)
+	if err != nil {
+		return
+	}
+	if self != nil {
+		dump.self = []net.IP{self}
+	}
+
+	n.reset()
+	for neighbour, cost := range dump.neighbours {
+		if cost >= babelInfinity {
+			continue
+		}
+		quality := 1.0
+		if cost > babelCostScale {
+			quality = float64(babelCostScale) / float64(cost)
+		}
+		for _, id := range dump.announcers[neighbour] {
+			for _, ip := range dump.originated[id] {
+				for _, selfIP := range dump.self {
+					n.link(selfIP, ip, quality)
+				}
+			}
+		}
+	}
+	return
+}
+
+// Validate checks that the "socket" and "self" credentials, if given,
+// are valid.
+func (n *BabelNetwork) Validate(conf *NetworkAdminConfig) (err error) {
+	_, _, _, err = babelCredentials(conf)
+	return
+}
+
+// babelCredentials returns the network and address of the socket of
+// babeld given by the "socket" credential, or those of
+// defaultBabelSocket if it is not given, and the "self" credential,
+// which is nil if it is not given.
+func babelCredentials(conf *NetworkAdminConfig) (network, address string, self net.IP, err error) {
+	socket, _ := conf.Credentials["socket"].(string)
+	if len(socket) == 0 {
+		socket = defaultBabelSocket
+	}
+	network, address, ok := socketAddress(socket)
+	if !ok {
+		return "", "", nil, BabelSocketInvalidError
+	}
+
+	if s, ok := conf.Credentials["self"].(string); ok {
+		if self = net.ParseIP(s); self == nil {
+			return "", "", nil, BabelSelfInvalidError
+		}
+	} else if _, ok := conf.Credentials["self"]; ok {
+		return "", "", nil, BabelSelfInvalidError
+	}
+	return
+}
+
+// requestBabelDump connects to the local interface of babeld, waits
+// for its greeting, and requests a dump of its state.
+func requestBabelDump(network, address string) (dump *babelDump, err error) {
+	conn, err := net.DialTimeout(network, address, babelTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(babelTimeout))
+
+	// babeld greets each client with a few lines, ending with "ok",
+	// and ends its response to each request in the same way.
+	lines := bufio.NewScanner(conn)
+	if _, err = readBabelResponse(lines); err != nil {
+		return
+	}
+	if _, err = conn.Write([]byte("dump\n")); err != nil {
+		return
+	}
+	response, err := readBabelResponse(lines)
+	if err != nil {
+		return
+	}
+	return parseBabelDump(response), nil
+}
+
+// readBabelResponse reads lines from babeld up to the end of a
+// response, which is "ok" if it succeeded, or "no" or "bad" if it did
+// not.
+func readBabelResponse(lines *bufio.Scanner) (response []string, err error) {
+	for lines.Scan() {
+		line := strings.TrimSpace(lines.Text())
+		switch {
+		case line == "ok":
+			return response, nil
+		case line == "no" || line == "bad" ||
+			strings.HasPrefix(line, "no ") || strings.HasPrefix(line, "bad "):
+			return nil, fmt.Errorf("babeld responded %q", line)
+		}
+		response = append(response, line)
+	}
+	if err = lines.Err(); err == nil {
+		err = errors.New("babeld closed the connection")
+	}
+	return nil, err
+}
+
+// parseBabelDump parses the lines of a dump from babeld, such as
+//
+//	add neighbour 1e4b2a0 address fe80::1 if wlan0 reach ffff rxcost 256 txcost 256 cost 256
+//	add route 1dc2b40 prefix 10.0.0.2/32 from 0.0.0.0/0 installed yes id 02:11:22:ff:fe:33:44:55 metric 256 refmetric 0 via fe80::1 if wlan0
+//	add xroute prefix 10.0.0.1/32 from 0.0.0.0/0 metric 0
+//
+// Lines which are not understood are skipped.
+func parseBabelDump(lines []string) (dump *babelDump) {
+	dump = &babelDump{
+		neighbours: make(map[string]int),
+		originated: make(map[string][]net.IP),
+		announcers: make(map[string][]string),
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "add" {
+			continue
+		}
+		kind, rest := fields[1], fields[2:]
+		if len(rest)%2 == 1 {
+			// The keys and values are preceded by an ID, which
+			// older versions of babeld do not give for xroutes.
+			rest = rest[1:]
+		}
+		values := make(map[string]string, len(rest)/2)
+		for i := 0; i+1 < len(rest); i += 2 {
+			values[rest[i]] = rest[i+1]
+		}
+
+		switch kind {
+		case "neighbour":
+			cost, err := strconv.Atoi(values["cost"])
+			if err == nil && len(values["address"]) > 0 {
+				dump.neighbours[values["address"]] = cost
+			}
+		case "xroute":
+			if ip := babelHostRoute(values["prefix"]); ip != nil {
+				dump.self = append(dump.self, ip)
+			}
+		case "route":
+			ip := babelHostRoute(values["prefix"])
+			id := values["id"]
+			if ip == nil || len(id) == 0 {
+				continue
+			}
+			dump.originated[id] = append(dump.originated[id], ip)
+			// A route with a reference metric of zero is originated
+			// by the neighbour it is learned through.
+			if values["refmetric"] == "0" {
+				via := values["via"]
+				dump.announcers[via] = append(dump.announcers[via], id)
+			}
+		}
+	}
+	return
+}
+
+// babelHostRoute returns the address of the given prefix if it is a
+// route to a single host, or nil otherwise.
+func babelHostRoute(prefix string) net.IP {
+	ip, network, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil
+	}
+	if ones, bits := network.Mask.Size(); ones != bits {
+		return nil
+	}
+	return ip
+}
@@ -0,0 +1,79 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// babelGreeting is the greeting of babeld on its local interface, and
+// babelDumpResponse its response to "dump", as captured from a node
+// with three neighbours, one of them unreachable. The node originates
+// host routes to 10.0.0.1 and fd00::1, and a route to a subnet.
+const (
+	babelGreeting = `BABEL 1.0
+version babeld-1.8.4
+host node1
+my-id 02:11:22:ff:fe:33:44:11
+ok
+`
+
+	babelDumpResponse = `add interface wlan0 up true ipv6 fe80::1 ipv4 10.0.0.1
+add neighbour 1e4b2a0 address fe80::2 if wlan0 reach ffff ureach 0000 rxcost 256 txcost 256 rtt 0.000 rttcost 0 cost 256
+add neighbour 1e4b2b0 address fe80::3 if wlan0 reach 00ff ureach 0000 rxcost 512 txcost 256 rtt 0.000 rttcost 0 cost 512
+add neighbour 1e4b2c0 address fe80::9 if wlan0 reach 0000 ureach 0000 rxcost 65535 txcost 256 rtt 0.000 rttcost 0 cost 65535
+add xroute 10.0.0.1/32-::/0 prefix 10.0.0.1/32 from ::/0 metric 0
+add xroute fd00::1/128-::/0 prefix fd00::1/128 from ::/0 metric 0
+add xroute 10.1.0.0/24-::/0 prefix 10.1.0.0/24 from ::/0 metric 0
+add route 1dc2b40 prefix 10.0.0.2/32 from 0.0.0.0/0 installed yes id 02:11:22:ff:fe:33:44:55 metric 256 refmetric 0 via fe80::2 if wlan0
+add route 1dc2b41 prefix 10.0.0.3/32 from 0.0.0.0/0 installed yes id 02:11:22:ff:fe:33:44:66 metric 512 refmetric 0 via fe80::3 if wlan0
+add route 1dc2b42 prefix 10.0.0.3/32 from 0.0.0.0/0 installed no id 02:11:22:ff:fe:33:44:66 metric 768 refmetric 512 via fe80::2 if wlan0
+add route 1dc2b43 prefix 10.0.0.4/32 from 0.0.0.0/0 installed yes id 02:11:22:ff:fe:33:44:77 metric 768 refmetric 512 via fe80::3 if wlan0
+add route 1dc2b44 prefix 10.0.0.9/32 from 0.0.0.0/0 installed yes id 02:11:22:ff:fe:33:44:99 metric 65535 refmetric 0 via fe80::9 if wlan0
+ok
+`
+)
+
+func TestBabelPeersOf(t *testing.T) {
+	address, stop := serveTCP(t, func(conn net.Conn) {
+		conn.Write([]byte(babelGreeting))
+		request, _ := bufio.NewReader(conn).ReadString('\n')
+		if request != "dump\n" {
+			t.Errorf("babeld was sent %q", request)
+			conn.Write([]byte("bad\n"))
+			return
+		}
+		conn.Write([]byte(babelDumpResponse))
+	})
+	defer stop()
+
+	n := &BabelNetwork{}
+	err := n.Connect(&NetworkAdminConfig{
+		Type:        "babel",
+		Credentials: map[string]interface{}{"socket": "tcp://" + address},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the neighbours which originate host routes are linked to
+	// the host routes of the node, and the unreachable neighbour and
+	// the node which is two hops away are not.
+	peers := map[string]map[string]float64{
+		"10.0.0.1": {"10.0.0.2": 1, "10.0.0.3": 0.5},
+		"fd00::1":  {"10.0.0.2": 1, "10.0.0.3": 0.5},
+		"10.0.0.2": {"10.0.0.1": 1, "fd00::1": 1},
+		"10.0.0.3": {"10.0.0.1": 0.5, "fd00::1": 0.5},
+		"10.0.0.4": {},
+		"10.0.0.9": {},
+	}
+	for addr, want := range peers {
+		if got := peerQualities(t, n, addr); !reflect.DeepEqual(got, want) {
+			t.Errorf("peers of %s are %v, not %v", addr, got, want)
+		}
+	}
+}
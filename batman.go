@@ -0,0 +1,332 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultAlfredSocket is the default socket of alfred.
+	defaultAlfredSocket = "/var/run/alfred.sock"
+
+	// alfredTimeout is the time allowed for a request to alfred,
+	// including connecting.
+	alfredTimeout = 10 * time.Second
+)
+
+// Types and versions of alfred packets and of the data which
+// batadv-vis distributes through it.
+const (
+	alfredPushData    = 0
+	alfredRequest     = 2
+	alfredStatusError = 4
+	alfredVersion     = 0
+
+	visPacketType    = 1
+	visPacketVersion = 1
+
+	// visClientIndex is the interface index of the entries of vis
+	// data which are clients, rather than neighbours.
+	visClientIndex = 255
+)
+
+var (
+	BatmanAddressesMissingError = errors.New(
+		"batman-adv network admin requires an \"addresses\" credential")
+	BatmanAddressesInvalidError = errors.New(
+		"batman-adv network admin \"addresses\" must map MAC addresses to IPs")
+	AlfredError = errors.New("alfred reported an error")
+)
+
+func init() {
+	RegisterNetwork("batman-adv", func() Network { return &BatmanNetwork{} })
+}
+
+// BatmanNetwork is a Network whose links are read from the originator
+// and neighbour tables of batman-adv, as distributed by alfred. They
+// are read from the output of "batadv-vis -f jsondoc", if its file is
+// given by the "vis" credential, or else from the alfred socket given
+// by "socket", which is defaultAlfredSocket if it is not given. As
+// batman-adv identifies nodes by the MAC addresses of their
+// interfaces, the "addresses" credential maps the MAC address of each
+// node, which may be of any of its interfaces, to the IP with which it
+// is registered. Nodes which are not mapped are skipped.
+type BatmanNetwork struct {
+	linkTable
+}
+
+// batmanVis is the originator and neighbour tables of batman-adv.
+type batmanVis struct {
+	// primaries maps the MAC address of each interface of each
+	// originator to that of its primary interface.
+	primaries map[string]string
+
+	links []batmanLink
+}
+
+// batmanLink is a link from a router to a neighbour, by the MAC
+// addresses of their interfaces, and its quality from 0 to 1.
+type batmanLink struct {
+	router, neighbor string
+	quality          float64
+}
+
+func (n *BatmanNetwork) Connect(conf *NetworkAdminConfig) (err error) {
+	addresses, err := batmanAddresses(conf)
+	if err != nil {
+		return
+	}
+
+	var vis *batmanVis
+	if path, _ := conf.Credentials["vis"].(string); len(path) > 0 {
+		vis, err = readBatmanVisDoc(path)
+	} else {
+		socket, _ := conf.Credentials["socket"].(string)
+		if len(socket) == 0 {
+			socket = defaultAlfredSocket
+		}
+		vis, err = requestAlfredVis(socket)
+	}
+	if err != nil {
+		return
+	}
+
+	// Resolve the MAC address of each interface to the IP of its
+	// node, by the primary interface if it is mapped, or else by the
+	// interface itself.
+	resolve := func(mac string) net.IP {
+		if ip, ok := addresses[vis.primaries[mac]]; ok {
+			return ip
+		}
+		return addresses[mac]
+	}
+
+	n.reset()
+	for _, link := range vis.links {
+		n.link(resolve(link.router), resolve(link.neighbor), link.quality)
+	}
+	return
+}
+
+// Validate checks that the "addresses" credential maps valid MAC
+// addresses to valid IPs.
+func (n *BatmanNetwork) Validate(conf *NetworkAdminConfig) (err error) {
+	_, err = batmanAddresses(conf)
+	return
+}
+
+// batmanAddresses returns the "addresses" credential of the given
+// configuration, keyed by normalized MAC addresses.
+func batmanAddresses(conf *NetworkAdminConfig) (addresses map[string]net.IP, err error) {
+	raw, ok := conf.Credentials["addresses"]
+	if !ok {
+		return nil, BatmanAddressesMissingError
+	}
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, BatmanAddressesInvalidError
+	}
+
+	addresses = make(map[string]net.IP, len(m))
+	for mac, v := range m {
+		hw, err := net.ParseMAC(mac)
+		s, ok := v.(string)
+		if err != nil || !ok || net.ParseIP(s) == nil {
+			return nil, BatmanAddressesInvalidError
+		}
+		addresses[hw.String()] = net.ParseIP(s)
+	}
+	return
+}
+
+// normalizeMAC returns the given MAC address in the form given by
+// net.HardwareAddr.String, or the empty string if it is invalid.
+func normalizeMAC(mac string) string {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return ""
+	}
+	return hw.String()
+}
+
+// batmanVisDoc is the output of "batadv-vis -f jsondoc". The metric of
+// each link is the expected transmission count, which is 1 for a
+// perfect link, given as a string.
+type batmanVisDoc struct {
+	Vis []struct {
+		Primary   string   `json:"primary"`
+		Secondary []string `json:"secondary"`
+		Neighbors []struct {
+			Router   string `json:"router"`
+			Neighbor string `json:"neighbor"`
+			Metric   string `json:"metric"`
+		} `json:"neighbors"`
+	} `json:"vis"`
+}
+
+// readBatmanVisDoc reads the output of "batadv-vis -f jsondoc" from
+// the file at the given path.
+func readBatmanVisDoc(path string) (vis *batmanVis, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var doc batmanVisDoc
+	if err = json.Unmarshal(b, &doc); err != nil {
+		return
+	}
+
+	vis = &batmanVis{primaries: make(map[string]string)}
+	for _, originator := range doc.Vis {
+		primary := normalizeMAC(originator.Primary)
+		vis.primaries[primary] = primary
+		for _, secondary := range originator.Secondary {
+			vis.primaries[normalizeMAC(secondary)] = primary
+		}
+		for _, neighbor := range originator.Neighbors {
+			link := batmanLink{
+				router:   normalizeMAC(neighbor.Router),
+				neighbor: normalizeMAC(neighbor.Neighbor),
+			}
+			metric, err := strconv.ParseFloat(neighbor.Metric, 64)
+			if err == nil && metric >= 1 {
+				link.quality = 1 / metric
+			}
+			// Routers are interfaces of the originator, even if it
+			// did not list them as secondary.
+			if _, ok := vis.primaries[link.router]; !ok {
+				vis.primaries[link.router] = primary
+			}
+			vis.links = append(vis.links, link)
+		}
+	}
+	return
+}
+
+// requestAlfredVis requests the vis data of every originator from the
+// alfred socket at the given path.
+func requestAlfredVis(path string) (vis *batmanVis, err error) {
+	conn, err := net.DialTimeout("unix", path, alfredTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(alfredTimeout))
+
+	// The request is a TLV header followed by the requested data
+	// type and a transaction ID, all in network byte order.
+	request := []byte{alfredRequest, alfredVersion, 0, 3,
+		visPacketType, 0, 1}
+	if _, err = conn.Write(request); err != nil {
+		return
+	}
+	// alfred closes the connection once it has sent every packet.
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return
+	}
+	return parseAlfredVis(b)
+}
+
+// parseAlfredVis parses the packets sent by alfred in response to a
+// request for vis data. Each packet is a TLV header and a transaction
+// header, followed by data from any number of originators, each of
+// which is its MAC address and a TLV header, followed by the data.
+func parseAlfredVis(b []byte) (vis *batmanVis, err error) {
+	vis = &batmanVis{primaries: make(map[string]string)}
+	r := bytes.NewReader(b)
+	for r.Len() > 0 {
+		var header struct {
+			Type, Version uint8
+			Length        uint16
+		}
+		if err = binary.Read(r, binary.BigEndian, &header); err != nil {
+			return nil, err
+		}
+		if header.Type == alfredStatusError {
+			return nil, AlfredError
+		}
+		packet := make([]byte, header.Length)
+		if _, err = io.ReadFull(r, packet); err != nil {
+			return nil, err
+		}
+		if header.Type != alfredPushData || len(packet) < 4 {
+			continue
+		}
+
+		// Skip the transaction header.
+		data := bytes.NewReader(packet[4:])
+		for data.Len() > 0 {
+			var source [6]byte
+			var dataHeader struct {
+				Type, Version uint8
+				Length        uint16
+			}
+			if err = binary.Read(data, binary.BigEndian, &source); err != nil {
+				return nil, err
+			}
+			if err = binary.Read(data, binary.BigEndian, &dataHeader); err != nil {
+				return nil, err
+			}
+			payload := make([]byte, dataHeader.Length)
+			if _, err = io.ReadFull(data, payload); err != nil {
+				return nil, err
+			}
+			if dataHeader.Type == visPacketType &&
+				dataHeader.Version == visPacketVersion {
+				if err = vis.addAlfredVis(payload); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return
+}
+
+// addAlfredVis adds the vis data of a single originator, which is its
+// MAC address, the number of its interfaces and of its entries, the
+// MAC address of each interface, and each entry. Each entry is the
+// MAC address of a neighbour, the index of the interface through which
+// it is reached, and the transmit quality of the link, from 0 to 255.
+func (vis *batmanVis) addAlfredVis(b []byte) error {
+	if len(b) < 8 {
+		return fmt.Errorf("vis data too short: %d bytes", len(b))
+	}
+	primary := net.HardwareAddr(b[:6]).String()
+	ifaces, entries := int(b[6]), int(b[7])
+	if len(b) < 8+6*ifaces+8*entries {
+		return fmt.Errorf("vis data too short: %d bytes", len(b))
+	}
+
+	vis.primaries[primary] = primary
+	routers := make([]string, ifaces)
+	for i := range routers {
+		offset := 8 + 6*i
+		routers[i] = net.HardwareAddr(b[offset : offset+6]).String()
+		vis.primaries[routers[i]] = primary
+	}
+	for i := 0; i < entries; i++ {
+		entry := b[8+6*ifaces+8*i:]
+		index := int(entry[6])
+		if index == visClientIndex || index >= ifaces {
+			continue
+		}
+		vis.links = append(vis.links, batmanLink{
+			router:   routers[index],
+			neighbor: net.HardwareAddr(entry[:6]).String(),
+			quality:  float64(entry[7]) / 255,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// The MAC addresses of the interfaces in the test mesh. Originators A
+// and C each have a secondary interface, B and D have only their
+// primaries, and the client is reached through A.
+var (
+	macA      = []byte{0x02, 0, 0, 0, 0, 0x01}
+	macASec   = []byte{0x02, 0, 0, 0, 0x01, 0x01}
+	macB      = []byte{0x02, 0, 0, 0, 0, 0x02}
+	macC      = []byte{0x02, 0, 0, 0, 0, 0x03}
+	macCSec   = []byte{0x02, 0, 0, 0, 0x01, 0x03}
+	macD      = []byte{0x02, 0, 0, 0, 0, 0x04}
+	macClient = []byte{0x02, 0, 0, 0, 0xff, 0x01}
+)
+
+// batmanAddressesCredential maps A and B by their primary interfaces,
+// C only by its secondary, and the client as well, which must not be
+// given any peers. D is not mapped, so its links are skipped.
+var batmanAddressesCredential = map[string]interface{}{
+	"02:00:00:00:00:01": "10.0.0.1",
+	"02:00:00:00:00:02": "10.0.0.2",
+	"02:00:00:00:01:03": "10.0.0.3",
+	"02:00:00:00:ff:01": "10.0.0.9",
+}
+
+// alfredVisPackets is the response of alfred to a request for vis
+// data, as captured from the test mesh. The first push data packet
+// holds the data of A and B, and the second that of C.
+var alfredVisPackets = concatBytes(
+	// Push data, version 0, 98 bytes; transaction 1, sequence 0.
+	[]byte{alfredPushData, alfredVersion, 0, 98, 0, 1, 0, 0},
+
+	// A: two interfaces and three entries. B is reached through the
+	// primary interface, C through the secondary, and the client
+	// through neither.
+	macA, []byte{visPacketType, visPacketVersion, 0, 44},
+	macA, []byte{2, 3}, macA, macASec,
+	macB, []byte{0, 255},
+	macCSec, []byte{1, 128},
+	macClient, []byte{visClientIndex, 0},
+
+	// B: one interface and two entries.
+	macB, []byte{visPacketType, visPacketVersion, 0, 30},
+	macB, []byte{1, 2}, macB,
+	macA, []byte{0, 255},
+	macD, []byte{0, 255},
+
+	// Push data, version 0, 42 bytes; transaction 1, sequence 1.
+	[]byte{alfredPushData, alfredVersion, 0, 42, 0, 1, 0, 1},
+
+	// C: two interfaces and one entry, which reaches A through both
+	// of their secondary interfaces.
+	macC, []byte{visPacketType, visPacketVersion, 0, 28},
+	macC, []byte{2, 1}, macC, macCSec,
+	macASec, []byte{1, 64},
+)
+
+// batmanVisJSONDoc is the output of "batadv-vis -f jsondoc" for the
+// test mesh. Some MAC addresses are separated by hyphens, to check
+// that they are normalized.
+const batmanVisJSONDoc = `{
+  "source_version" : "2014.1.0",
+  "algorithm" : 4,
+  "vis" : [
+    { "primary" : "02:00:00:00:00:01",
+      "secondary" : [ "02:00:00:00:01:01" ],
+      "neighbors" : [
+        { "router" : "02:00:00:00:00:01",
+          "neighbor" : "02:00:00:00:00:02",
+          "metric" : "1.000" },
+        { "router" : "02:00:00:00:01:01",
+          "neighbor" : "02:00:00:00:01:03",
+          "metric" : "2.000" }
+      ],
+      "clients" : [ "02:00:00:00:ff:01" ]
+    },
+    { "primary" : "02:00:00:00:00:02",
+      "neighbors" : [
+        { "router" : "02:00:00:00:00:02",
+          "neighbor" : "02:00:00:00:00:01",
+          "metric" : "1.000" },
+        { "router" : "02-00-00-00-00-02",
+          "neighbor" : "02-00-00-00-00-04",
+          "metric" : "1.000" }
+      ]
+    },
+    { "primary" : "02:00:00:00:00:03",
+      "secondary" : [ "02-00-00-00-01-03" ],
+      "neighbors" : [
+        { "router" : "02:00:00:00:01:03",
+          "neighbor" : "02:00:00:00:01:01",
+          "metric" : "4.000" }
+      ]
+    }
+  ]
+}
+`
+
+// concatBytes returns the concatenation of the given byte slices.
+func concatBytes(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// serveAlfred stands in for alfred on a new UNIX socket, answering a
+// request for vis data with the given packets and then closing the
+// connection. It returns the path of the socket, and a function which
+// stops it.
+func serveAlfred(t *testing.T, packets []byte) (path string, stop func()) {
+	dir, err := ioutil.TempDir("", "nodeatlas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(dir, "alfred.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			request := make([]byte, 7)
+			if _, err := io.ReadFull(conn, request); err != nil {
+				t.Errorf("alfred could not read request: %s", err)
+			} else if want := []byte{alfredRequest, alfredVersion, 0, 3,
+				visPacketType, 0, 1}; !bytes.Equal(request, want) {
+				t.Errorf("alfred was sent %v, not %v", request, want)
+			} else {
+				conn.Write(packets)
+			}
+			conn.Close()
+		}
+	}()
+	return path, func() {
+		ln.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// checkBatmanPeers connects a BatmanNetwork with the given
+// credentials, as well as batmanAddressesCredential, and checks the
+// peers of each node in the test mesh against the given ones.
+func checkBatmanPeers(t *testing.T, credentials map[string]interface{}, peers map[string]map[string]float64) {
+	credentials["addresses"] = batmanAddressesCredential
+	n := &BatmanNetwork{}
+	err := n.Connect(&NetworkAdminConfig{
+		Type:        "batman-adv",
+		Credentials: credentials,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range peers {
+		if got := peerQualities(t, n, addr); !reflect.DeepEqual(got, want) {
+			t.Errorf("peers of %s are %v, not %v", addr, got, want)
+		}
+	}
+}
+
+func TestBatmanPeersOfAlfred(t *testing.T) {
+	path, stop := serveAlfred(t, alfredVisPackets)
+	defer stop()
+
+	// The link between A and C is known in both directions, through
+	// their secondary interfaces, and the better quality is kept.
+	checkBatmanPeers(t, map[string]interface{}{"socket": path},
+		map[string]map[string]float64{
+			"10.0.0.1": {"10.0.0.2": 1, "10.0.0.3": 128.0 / 255},
+			"10.0.0.2": {"10.0.0.1": 1},
+			"10.0.0.3": {"10.0.0.1": 128.0 / 255},
+			"10.0.0.9": {},
+		})
+}
+
+func TestBatmanPeersOfVisDoc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nodeatlas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "vis.json")
+	err = ioutil.WriteFile(path, []byte(batmanVisJSONDoc), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The quality of each link is the inverse of its metric.
+	checkBatmanPeers(t, map[string]interface{}{"vis": path},
+		map[string]map[string]float64{
+			"10.0.0.1": {"10.0.0.2": 1, "10.0.0.3": 0.5},
+			"10.0.0.2": {"10.0.0.1": 1},
+			"10.0.0.3": {"10.0.0.1": 0.5},
+			"10.0.0.9": {},
+		})
+}
+
+func TestParseAlfredVis(t *testing.T) {
+	vis, err := parseAlfredVis(alfredVisPackets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every interface of each originator maps to its primary, but
+	// clients and unknown neighbours, such as D, do not.
+	primaries := map[string]string{
+		"02:00:00:00:00:01": "02:00:00:00:00:01",
+		"02:00:00:00:01:01": "02:00:00:00:00:01",
+		"02:00:00:00:00:02": "02:00:00:00:00:02",
+		"02:00:00:00:00:03": "02:00:00:00:00:03",
+		"02:00:00:00:01:03": "02:00:00:00:00:03",
+	}
+	if !reflect.DeepEqual(vis.primaries, primaries) {
+		t.Errorf("primaries are %v, not %v", vis.primaries, primaries)
+	}
+
+	links := []batmanLink{
+		{"02:00:00:00:00:01", "02:00:00:00:00:02", 1},
+		{"02:00:00:00:01:01", "02:00:00:00:01:03", 128.0 / 255},
+		{"02:00:00:00:00:02", "02:00:00:00:00:01", 1},
+		{"02:00:00:00:00:02", "02:00:00:00:00:04", 1},
+		{"02:00:00:00:01:03", "02:00:00:00:01:01", 64.0 / 255},
+	}
+	if !reflect.DeepEqual(vis.links, links) {
+		t.Errorf("links are %v, not %v", vis.links, links)
+	}
+
+	// Truncated vis data, and errors reported by alfred, are not
+	// silently ignored.
+	tests := []struct {
+		name    string
+		packets []byte
+	}{
+		{"truncated", alfredVisPackets[:len(alfredVisPackets)-1]},
+		{"error", []byte{alfredStatusError, alfredVersion, 0, 6,
+			0, 1, 0, 0, 0, 0}},
+	}
+	for _, test := range tests {
+		if _, err := parseAlfredVis(test.packets); err == nil {
+			t.Errorf("%s: packets were parsed without error", test.name)
+		}
+	}
+
+	var short batmanVis
+	short.primaries = make(map[string]string)
+	if err := short.addAlfredVis(concatBytes(macA, []byte{1, 1}, macA)); err == nil {
+		t.Errorf("vis data missing its entry was added without error")
+	}
+}
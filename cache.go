@@ -6,96 +6,596 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
-	"net/http"
+	"errors"
+	"fmt"
+	"github.com/agl/ed25519"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
 )
 
+// ChildMapNotSyncedError is returned when the changes from a sync of
+// a child map are applied after it has been disabled or removed, so
+// that its nodes are not cached again.
+var ChildMapNotSyncedError = errors.New("child map is disabled or removed")
+
 // ChildMap represents a single child map, which is regularly cached.
 type ChildMap struct {
 	ID             int
 	Name, Hostname string
+
+	// ParentID is the ID of the map through which this one's nodes
+	// are relayed, and Parent is its address. They are zero and
+	// empty if the map is synced directly, or has only been relayed
+	// through maps which are.
+	ParentID int    `json:"-"`
+	Parent   string `json:",omitempty"`
+
+	// LastSync is the time at which the last successful sync of the
+	// child map began, and LastFullSync that of the last one which
+	// retrieved every node rather than only changes. Both are zero
+	// if the map has never been synced directly, such as if its
+	// nodes are only relayed by another child map.
+	LastSync, LastFullSync time.Time
+
+	// LastFailure is the time at which the last failed sync of the
+	// child map ended, or zero if none has. If it is after LastSync,
+	// the nodes cached from the map are stale.
+	LastFailure time.Time
+
+	// LastAttempt is the time at which the last sync of the child
+	// map began, whether or not it succeeded. If it failed,
+	// LastError describes why.
+	LastAttempt time.Time
+	LastError   string
+
+	// Latency is the time which the child map took to respond to the
+	// last successful sync, and NodeCount is the number of nodes
+	// cached through it as a result.
+	Latency   Duration
+	NodeCount int
+
+	// Filtered is the number of nodes from each source, by address,
+	// which were retrieved by the last full sync of the child map,
+	// but not cached because of its ImportFilter.
+	Filtered map[string]int `json:",omitempty"`
+
+	// Listed is true if the child map was added through the admin
+	// API, so that it is synced along with those in Conf.ChildMaps,
+	// using its Key and PushKey as in ChildMapConfig. Disabled is
+	// true if it is not synced, even if it is in Conf.ChildMaps.
+	Listed   bool   `json:",omitempty"`
+	Disabled bool   `json:",omitempty"`
+	Key      string `json:",omitempty"`
+	PushKey  string `json:"-"`
+
+	// Renamed is true if Name was set through the admin API, so that
+	// it is not replaced by the name which the map gives itself.
+	Renamed bool `json:",omitempty"`
+
+	// Validators are those of the map's response to its last
+	// successful sync, with which the next one is made conditional.
+	Validators Validators `json:"-"`
+
+	// LastPush is the time, as given by the child map, at which the
+	// last push from it which was applied was sent, or zero if none
+	// has been. Each push must be sent later, so that none can be
+	// replayed.
+	LastPush time.Time `json:"-"`
 }
 
-// UpdateMapCache updates the node cache intelligently using
-// Conf.ChildMaps. Any unknown map addresses are added to the database
-// automatically, and errors are logged.
-func UpdateMapCache() {
-	// If there are no addresses to retrieve from, do nothing.
-	if len(Conf.ChildMaps) == 0 {
+// Config returns the ChildMapConfig with which a child map which was
+// added through the admin API is synced.
+func (c *ChildMap) Config() ChildMapConfig {
+	return ChildMapConfig{
+		Address: c.Hostname,
+		Key:     c.Key,
+		PushKey: c.PushKey,
+	}
+}
+
+// Health classifications of child maps, as returned by
+// ChildMap.Health.
+const (
+	HealthUp       = "up"
+	HealthDegraded = "degraded"
+	HealthDown     = "down"
+)
+
+// Health classifies the child map as of the given time. It is up if
+// its last sync succeeded, degraded if the last sync failed but one
+// has succeeded within Conf.CacheExpiration, so that its nodes are
+// stale but still kept, and down otherwise.
+func (c *ChildMap) Health(now time.Time) string {
+	if c.LastSync.IsZero() ||
+		now.Sub(c.LastSync) >= time.Duration(Conf.CacheExpiration) {
+		return HealthDown
+	} else if c.LastFailure.After(c.LastSync) {
+		return HealthDegraded
+	}
+	return HealthUp
+}
+
+// ChildMapHealth is a child map along with its health classification.
+type ChildMapHealth struct {
+	*ChildMap
+	Health string
+}
+
+// ChildMapsHealth returns the health of each of the child maps given
+// by ChildMapConfigs which is known to the database.
+func ChildMapsHealth() (health []*ChildMapHealth, err error) {
+	childMaps, err := Db.DumpChildMaps()
+	if err != nil {
+		return
+	}
+	configs, err := childMapConfigs(childMaps)
+	if err != nil {
 		return
 	}
 
-	// Because we are refreshing the entire cache, delete all cached
-	// nodes.
-	err := Db.ClearCache()
+	configured := make(map[string]bool, len(configs))
+	for _, config := range configs {
+		configured[config.Address] = true
+	}
+
+	now := time.Now()
+	health = make([]*ChildMapHealth, 0, len(configs))
+	for _, childMap := range childMaps {
+		if configured[childMap.Hostname] {
+			health = append(health,
+				&ChildMapHealth{childMap, childMap.Health(now)})
+		}
+	}
+	return
+}
+
+// ChildMapConfigs returns the child maps which should be synced, which
+// are those in Conf.ChildMaps, followed by those added through the
+// admin API, except for any which are disabled.
+func ChildMapConfigs() (configs []ChildMapConfig, err error) {
+	childMaps, err := Db.DumpChildMaps()
+	if err != nil {
+		return
+	}
+	return childMapConfigs(childMaps)
+}
+
+// childMapConfigs is the underlying function of ChildMapConfigs, which
+// uses the given child maps rather than retrieving them.
+func childMapConfigs(childMaps []*ChildMap) (configs []ChildMapConfig, err error) {
+	disabled := make(map[string]bool)
+	for _, childMap := range childMaps {
+		if childMap.Disabled {
+			disabled[childMap.Hostname] = true
+		}
+	}
+
+	configs = make([]ChildMapConfig, 0, len(Conf.ChildMaps))
+	configured := make(map[string]bool, len(Conf.ChildMaps))
+	for _, config := range Conf.ChildMaps {
+		configured[config.Address] = true
+		if !disabled[config.Address] {
+			configs = append(configs, config)
+		}
+	}
+	for _, childMap := range childMaps {
+		if childMap.Listed && !childMap.Disabled &&
+			!configured[childMap.Hostname] {
+			configs = append(configs, childMap.Config())
+		}
+	}
+	return
+}
+
+// IsConfiguredChildMap reports whether the child map with the given
+// address is in Conf.ChildMaps.
+func IsConfiguredChildMap(address string) bool {
+	for _, config := range Conf.ChildMaps {
+		if config.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// FindChildMap returns the known child map with the given address, or
+// nil if there is none.
+func FindChildMap(address string) (childMap *ChildMap, err error) {
+	childMaps, err := Db.DumpChildMaps()
 	if err != nil {
-		l.Errf("Error clearing cache: %s", err)
 		return
 	}
+	for _, c := range childMaps {
+		if c.Hostname == address {
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+// CacheUpdate is the set of changes to the cache produced by a
+// single sync of a child map, which are applied together by
+// UpdateCache.
+type CacheUpdate struct {
+	// MapID is the ID of the child map which was synced. Nodes which
+	// it relays from its own child maps are cached through it, though
+	// their SourceIDs differ.
+	MapID int
+
+	// Listed is whether the child map was listed, as in ChildMap, when
+	// the sync began. If it was, but has since been removed, or if it
+	// has since been disabled, the update is not applied.
+	Listed bool
 
-	// Get a full database dump from all child maps and cache it.
-	err = GetAllFromChildMaps(Conf.ChildMaps)
+	// Full is true if Nodes contains every node offered by the child
+	// map, so that any others previously cached through it should be
+	// removed. Otherwise, Nodes contains only those which have
+	// changed.
+	Full bool
+
+	Nodes []*Node
+
+	// Deleted contains tombstones for the nodes which the child map
+	// reports as having been deleted, with their local SourceIDs.
+	Deleted []*Tombstone
+
+	// Time is the time at which the sync began, and is recorded as
+	// the LastSync and LastAttempt of the child map, as well as its
+	// LastFullSync if Full is true. If it is zero, none of them are
+	// changed, and neither are Latency and NodeCount. Maps which are
+	// synced are no longer relayed through any other, so their
+	// parent is cleared as well.
+	Time time.Time
+
+	// Latency is the time which the child map took to respond.
+	Latency time.Duration
+
+	// Validators are those of the child map's response, and are
+	// recorded along with Time.
+	Validators Validators
+
+	// Filtered, if not nil, is the number of nodes from each source
+	// which were not cached because of the map's ImportFilter, and is
+	// recorded along with Time.
+	Filtered map[string]int
+
+	// PushTime, if not zero, is the time at which the changes were
+	// pushed by the child map, as given by it, and is recorded as its
+	// LastPush. If it is not after the LastPush of the map, nothing
+	// is changed, and PushReplayedError is returned.
+	PushTime time.Time
+}
+
+// syncOverlap is subtracted from the time of the last sync when
+// requesting changes from a child map, so that none are missed if
+// its clock is somewhat behind ours. Nodes which are retrieved twice
+// as a result are simply replaced.
+const syncOverlap = 5 * time.Minute
+
+// UpdateMapCache updates the node cache intelligently using the child
+// maps given by ChildMapConfigs. Any unknown map addresses are added
+// to the database automatically, and errors are logged.
+func UpdateMapCache() {
+	configs, err := ChildMapConfigs()
+	if err == nil {
+		err = SyncChildMaps(configs)
+	}
 	if err != nil {
 		l.Errf("Error updating map cache: %s", err)
 	}
 }
 
-func (db DB) CacheNode(node *Node) (err error) {
-	stmt, err := db.Prepare(`INSERT INTO nodes_cached
-(address, owner, details, lat, lon, status, expiration, updated)
-VALUES(?, ?, ?, ?, ?, ?, ?, ?)`)
+// UpdateCache applies the changes from a sync of a child map to the
+// 'nodes_cached' table in a single transaction, so that a failed
+// sync leaves the cache as it was, and records the time of the sync
+// in 'cached_maps'. Each cached node which is removed leaves a
+// tombstone, unless another copy of it remains, so that parent maps
+// learn of its deletion in turn. If the map has been disabled or
+// removed since the sync began, nothing is changed, and it returns
+// ChildMapNotSyncedError.
+func (db DB) UpdateCache(u *CacheUpdate) (err error) {
+	tx, err := db.Begin()
 	if err != nil {
 		return
 	}
 
-	if node.RetrieveTime == 0 {
-		node.RetrieveTime = time.Now().Unix()
+	if err = updateCache(tx, u); err != nil {
+		tx.Rollback()
+		return
 	}
+	return tx.Commit()
+}
 
-	_, err = stmt.Exec(node.Addr, node.OwnerName, node.Details,
-		node.Latitude, node.Longitude, node.SourceID, node.Status,
-		node.RetrieveTime)
-	stmt.Close()
+func updateCache(tx *Tx, u *CacheUpdate) (err error) {
+	// Check that the map is still synced within the transaction, so
+	// that a sync which was running when it was disabled or removed
+	// cannot cache its nodes again after they were cleared.
+	var listed, disabled bool
+	err = tx.QueryRow(`SELECT listed, disabled
+FROM cached_maps WHERE id = ?;`, u.MapID).Scan(&listed, &disabled)
+	if err == sql.ErrNoRows {
+		return ChildMapNotSyncedError
+	} else if err != nil {
+		return
+	}
+	if disabled || (u.Listed && !listed) {
+		return ChildMapNotSyncedError
+	}
+
+	// Record the time of a push in the same transaction, so that a
+	// push which is replayed while the original is applied is still
+	// rejected.
+	if !u.PushTime.IsZero() {
+		var res sql.Result
+		res, err = tx.Exec(`UPDATE cached_maps
+SET lastpush = ? WHERE id = ? AND lastpush < ?;`,
+			u.PushTime.Unix(), u.MapID, u.PushTime.Unix())
+		if err != nil {
+			return
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return PushReplayedError
+		}
+	}
+
+	// Find the copies which the child map reports as deleted. If
+	// every node was retrieved, then any which were cached through it
+	// before, but are no longer present, have been deleted as well.
+	var deleted []cachedCopy
+	for _, tombstone := range u.Deleted {
+		var copies []cachedCopy
+		if tombstone.SourceID == anySource {
+			copies, err = selectCachedCopies(tx,
+				"address = ? AND via = ?",
+				[]byte(tombstone.Addr), u.MapID)
+		} else {
+			copies, err = selectCachedCopies(tx,
+				"address = ? AND source = ? AND via = ?",
+				[]byte(tombstone.Addr), tombstone.SourceID, u.MapID)
+		}
+		if err != nil {
+			return
+		}
+		deleted = append(deleted, copies...)
+	}
+	if u.Full {
+		present := make(map[string]bool, len(u.Nodes))
+		for _, node := range u.Nodes {
+			present[copyKey(node.Addr, node.SourceID)] = true
+		}
+
+		var copies []cachedCopy
+		copies, err = selectCachedCopies(tx, "via = ?", u.MapID)
+		if err != nil {
+			return
+		}
+		for _, c := range copies {
+			if !present[copyKey(c.addr, c.source)] {
+				deleted = append(deleted, c)
+			}
+		}
+	}
+
+	for _, c := range deleted {
+		err = uncacheNode(tx, c)
+		if err != nil && err != sql.ErrNoRows {
+			return
+		}
+	}
+	for _, node := range u.Nodes {
+		if err = cacheNode(tx, node, u.MapID); err != nil {
+			return
+		}
+	}
+
+	if u.Time.IsZero() {
+		return nil
+	}
+	if u.Full {
+		_, err = tx.Exec(`UPDATE cached_maps
+SET lastfullsync = ? WHERE id = ?;`, u.Time.Unix(), u.MapID)
+		if err != nil {
+			return
+		}
+	}
+	if u.Filtered != nil {
+		var filtered []byte
+		if filtered, err = json.Marshal(u.Filtered); err != nil {
+			return
+		}
+		_, err = tx.Exec(`UPDATE cached_maps
+SET filtered = ? WHERE id = ?;`, string(filtered), u.MapID)
+		if err != nil {
+			return
+		}
+	}
+	_, err = tx.Exec(`UPDATE cached_maps
+SET lastsync = ?, lastattempt = ?, lasterror = '', latency = ?,
+nodecount = (SELECT COUNT(*) FROM nodes_cached WHERE via = ?),
+etag = ?, lastmodified = ?, parent = 0
+WHERE id = ?;`, u.Time.Unix(), u.Time.Unix(),
+		int64(u.Latency/time.Millisecond), u.MapID,
+		u.Validators.ETag, u.Validators.LastModified, u.MapID)
+	return
+}
+
+// RecordSyncFailure records that a sync of the child map with the
+// given ID, which began at the given time, has just failed with the
+// given message, so that the nodes cached from it are marked stale
+// until it is next synced successfully.
+func (db DB) RecordSyncFailure(mapID int, attempt time.Time, message string) (err error) {
+	// The message must fit in the lasterror column.
+	if len(message) > 255 {
+		message = message[:255]
+	}
+	_, err = db.Exec(`UPDATE cached_maps
+SET lastattempt = ?, lastfailure = ?, lasterror = ? WHERE id = ?;`,
+		attempt.Unix(), time.Now().Unix(), message, mapID)
 	return
 }
 
-func (db DB) CacheNodes(nodes []*Node) (err error) {
-	stmt, err := db.Prepare(`INSERT INTO nodes_cached
-(address, owner, details, lat, lon, status, source, retrieved)
-VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+// DeleteExpiredCache removes cached nodes which were retrieved more
+// than Conf.CacheExpiration ago, unless the child map they were
+// retrieved through has been synced successfully since then. Stale
+// nodes are thus kept until they expire. Each removed node leaves a
+// tombstone, as in UpdateCache.
+func (db DB) DeleteExpiredCache() (err error) {
+	expiry := time.Now().Add(-time.Duration(Conf.CacheExpiration)).Unix()
+
+	tx, err := db.Begin()
 	if err != nil {
 		return
 	}
 
-	for _, node := range nodes {
-		if node.RetrieveTime == 0 {
-			node.RetrieveTime = time.Now().Unix()
+	copies, err := selectCachedCopies(tx, `retrieved < ? AND via NOT IN
+(SELECT id FROM cached_maps WHERE lastsync >= ?)`, expiry, expiry)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	for _, c := range copies {
+		if err = uncacheNode(tx, c); err != nil {
+			tx.Rollback()
+			return
 		}
+	}
+	return tx.Commit()
+}
 
-		_, err = stmt.Exec([]byte(node.Addr), node.OwnerName,
-			node.Details,
-			node.Latitude, node.Longitude,
-			node.Status, node.SourceID, node.RetrieveTime)
-		if err != nil {
+// ClearMapCache removes every node cached through the child map with
+// the given ID, and forgets when it was last synced, so that if it is
+// synced again, every node is retrieved.
+func (db DB) ClearMapCache(mapID int) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+
+	copies, err := selectCachedCopies(tx, "via = ?", mapID)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	for _, c := range copies {
+		if err = uncacheNode(tx, c); err != nil {
+			tx.Rollback()
 			return
 		}
 	}
-	stmt.Close()
-	return
+
+	_, err = tx.Exec(`UPDATE cached_maps
+SET lastsync=0, lastfullsync=0, nodecount=0, etag='', lastmodified='',
+filtered=NULL
+WHERE id=?`, mapID)
+	if err == nil {
+		err = recordRemoval(tx)
+	}
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	return tx.Commit()
 }
 
-func (db DB) ClearCache() (err error) {
-	_, err = db.Exec(`DELETE FROM nodes_cached;`)
-	return err
+// cacheNode inserts the given node into the 'nodes_cached' table as
+// having been retrieved through the given child map, replacing any
+// cached copy from the same source, and clears any tombstone for it.
+func cacheNode(tx *Tx, node *Node, via int) (err error) {
+	if node.RetrieveTime == 0 {
+		node.RetrieveTime = time.Now().Unix()
+	}
+
+	_, err = tx.Exec(`DELETE FROM nodes_cached
+WHERE address = ? AND source = ?;`, []byte(node.Addr), node.SourceID)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(`INSERT INTO nodes_cached
+(address, owner, details, lat, lon, status, source, retrieved, via)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`, []byte(node.Addr),
+		node.OwnerName, node.Details,
+		node.Latitude, node.Longitude, node.Status, node.SourceID,
+		node.RetrieveTime, via)
+	if err != nil {
+		return
+	}
+	return clearTombstone(tx, node.Addr)
+}
+
+// cachedCopy identifies a row of the 'nodes_cached' table.
+type cachedCopy struct {
+	addr        IP
+	source, via int
+}
+
+// selectCachedCopies returns the rows of the 'nodes_cached' table
+// which match the given WHERE clause.
+func selectCachedCopies(tx *Tx, where string, args ...interface{}) (copies []cachedCopy, err error) {
+	rows, err := tx.Query(`SELECT address, source, via
+FROM nodes_cached WHERE `+where+`;`, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c cachedCopy
+		if err = rows.Scan(&c.addr, &c.source, &c.via); err != nil {
+			return
+		}
+		copies = append(copies, c)
+	}
+	return copies, rows.Err()
+}
+
+// uncacheNode removes the given copy of a node from the
+// 'nodes_cached' table. If no other copy of it remains, either local
+// or cached, it leaves a tombstone in its place. If there is no such
+// copy, it returns sql.ErrNoRows.
+func uncacheNode(tx *Tx, c cachedCopy) (err error) {
+	res, err := tx.Exec(`DELETE FROM nodes_cached
+WHERE address = ? AND source = ? AND via = ?;`,
+		[]byte(c.addr), c.source, c.via)
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	if err = recordRemoval(tx); err != nil {
+		return
+	}
+
+	var remaining int
+	err = tx.QueryRow(`SELECT COUNT(*)
+FROM (SELECT address FROM nodes WHERE address = ?
+UNION ALL SELECT address FROM nodes_cached WHERE address = ?) AS a;`,
+		[]byte(c.addr), []byte(c.addr)).Scan(&remaining)
+	if err != nil || remaining > 0 {
+		return
+	}
+	return addTombstone(tx, c.addr, c.source)
 }
 
 // AddNewMapSource inserts a new map address into the cached_maps
-// table.
-func (db DB) AddNewMapSource(address, name string) (err error) {
+// table, and returns the ID it was given.
+func (db DB) AddNewMapSource(address, name string) (id int, err error) {
 	_, err = db.Exec(`INSERT INTO cached_maps
 (hostname,name) VALUES(?, ?)`, address, name)
+	if err != nil {
+		return
+	}
+
+	// Not every driver supports LastInsertId, so look the ID up
+	// instead.
+	err = db.QueryRow(`SELECT id FROM cached_maps
+WHERE hostname = ? ORDER BY id DESC;`, address).Scan(&id)
 	return
 }
 
@@ -107,12 +607,34 @@ SET name=? WHERE hostname=?`, name, address)
 	return
 }
 
+// UpdateChildMap sets the fields of the child map with the same ID as
+// the given one which can be changed through the admin API, which are
+// Name, Listed, Disabled, Key, PushKey, and Renamed.
+func (db DB) UpdateChildMap(childMap *ChildMap) (err error) {
+	res, err := db.Exec(`UPDATE cached_maps
+SET name=?, listed=?, disabled=?, renamed=?, pubkey=?, pushkey=?
+WHERE id=?`, childMap.Name, childMap.Listed, childMap.Disabled,
+		childMap.Renamed, childMap.Key, childMap.PushKey, childMap.ID)
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return
+}
+
 // DumpChildMaps returns a slice containing all known child maps.
 func (db DB) DumpChildMaps() (childMaps []*ChildMap, err error) {
 	childMaps = make([]*ChildMap, 0)
 
 	// Retrieve all child maps from the database.
-	rows, err := db.Query(`SELECT name, hostname, id
+	rows, err := db.Query(`SELECT name, hostname, id,
+lastsync, lastfullsync, lastfailure, lastattempt, lasterror,
+latency, nodecount, listed, disabled, renamed, pubkey, pushkey,
+etag, lastmodified, filtered, parent, lastpush
 FROM cached_maps;`)
 	if err == sql.ErrNoRows {
 		return childMaps, nil
@@ -123,16 +645,53 @@ FROM cached_maps;`)
 	// Scan in all of the values.
 	for rows.Next() {
 		childMap := &ChildMap{}
+		var lastSync, lastFullSync, lastFailure, lastAttempt, lastPush int64
+		var latency int64
+		var filtered sql.NullString
 		if err = rows.Scan(&childMap.Name, &childMap.Hostname,
-			&childMap.ID); err != nil {
+			&childMap.ID, &lastSync, &lastFullSync,
+			&lastFailure, &lastAttempt, &childMap.LastError,
+			&latency, &childMap.NodeCount, &childMap.Listed,
+			&childMap.Disabled, &childMap.Renamed, &childMap.Key,
+			&childMap.PushKey, &childMap.Validators.ETag,
+			&childMap.Validators.LastModified,
+			&filtered, &childMap.ParentID, &lastPush); err != nil {
 			return
 		}
+		if filtered.Valid {
+			err = json.Unmarshal([]byte(filtered.String), &childMap.Filtered)
+			if err != nil {
+				return
+			}
+		}
+		childMap.LastSync = unixOrZero(lastSync)
+		childMap.LastFullSync = unixOrZero(lastFullSync)
+		childMap.LastFailure = unixOrZero(lastFailure)
+		childMap.LastAttempt = unixOrZero(lastAttempt)
+		childMap.LastPush = unixOrZero(lastPush)
+		childMap.Latency = Duration(time.Duration(latency) * time.Millisecond)
 		childMaps = append(childMaps, childMap)
 	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	setChildMapParents(childMaps)
 
 	return
 }
 
+// setChildMapParents sets the Parent of each of the given child maps
+// from its ParentID.
+func setChildMapParents(childMaps []*ChildMap) {
+	hostnames := make(map[int]string, len(childMaps))
+	for _, childMap := range childMaps {
+		hostnames[childMap.ID] = childMap.Hostname
+	}
+	for _, childMap := range childMaps {
+		childMap.Parent = hostnames[childMap.ParentID]
+	}
+}
+
 // GetMapSourceToID returns a mapping of child map hostnames to their
 // local IDs. It also includes a mapping of "local" to id 0.
 func (db DB) GetMapSourceToID() (sourceToID map[string]int, err error) {
@@ -204,7 +763,7 @@ WHERE id=?`, id)
 	return
 }
 
-func (db DB) CacheFormatNodes(nodes []*Node) (sourceMaps map[string][]*Node, err error) {
+func CacheFormatNodes(db Store, nodes []*Node) (sourceMaps map[string][]*Node, err error) {
 	// First, get a mapping of IDs to sources for quick access.
 	idSources, err := db.GetMapIDToSource()
 	if err != nil {
@@ -226,11 +785,41 @@ func (db DB) CacheFormatNodes(nodes []*Node) (sourceMaps map[string][]*Node, err
 	return
 }
 
-// nodeDumpWrapper is a structure which wraps a response from /api/all
-// in which the Data field is a map[string][]*Node.
+// CacheFormatTombstones sets the Source of each of the given
+// tombstones to the hostname of the map with its SourceID, or "local",
+// as CacheFormatNodes keys nodes.
+func CacheFormatTombstones(db Store, tombstones []*Tombstone) (err error) {
+	idSources, err := db.GetMapIDToSource()
+	if err != nil {
+		return
+	}
+	for _, tombstone := range tombstones {
+		tombstone.Source = idSources[tombstone.SourceID]
+	}
+	return
+}
+
+// unixOrZero converts a Unix time to a time.Time, except that 0 is
+// converted to the zero time.
+func unixOrZero(t int64) time.Time {
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(t, 0)
+}
+
+// nodeDumpWrapper is a structure which wraps a response from
+// /api/all. The Data field is a map[string][]*Node, unless "since"
+// was given, in which case it is a nodeChangesDump.
 type nodeDumpWrapper struct {
-	Data  map[string][]*Node `json:"data"`
-	Error interface{}        `json:"error"`
+	Data  json.RawMessage `json:"data"`
+	Error interface{}     `json:"error"`
+}
+
+// nodeChangesDump is the response to /api/all when "since" is given.
+type nodeChangesDump struct {
+	Nodes   map[string][]*Node `json:"nodes"`
+	Deleted []*Tombstone       `json:"deleted"`
 }
 
 type statusDumpWrapper struct {
@@ -238,80 +827,175 @@ type statusDumpWrapper struct {
 	Error interface{}            `json:"error"`
 }
 
-// GetAllFromChildMaps accepts a list of child map addresses to
-// retrieve nodes from. It does this concurrently, and puts any nodes
-// and newly discovered addresses in the local ID table.
-func GetAllFromChildMaps(addresses []string) (err error) {
-	// First off, initialize the slice into which we'll be appending
-	// all the nodes, and the souceToID map and mutex.
-	nodes := make([]*Node, 0)
+// sourceIDs maps the hostnames of maps to their local IDs, adding
+// any unknown ones to the database. It is safe for concurrent use.
+type sourceIDs struct {
+	sync.Mutex
+	ids map[string]int
+}
+
+// ID returns the local ID of the map with the given hostname. If it
+// is not yet known, it is added with the given name.
+func (s *sourceIDs) ID(hostname, name string) (id int, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	id, ok := s.ids[hostname]
+	if ok {
+		return
+	}
+	if id, err = Db.AddNewMapSource(hostname, name); err != nil {
+		return
+	}
+	l.Debugf("Discovered new source map %q, ID %d\n", hostname, id)
+	s.ids[hostname] = id
+	return
+}
+
+// Lookup returns the local ID of the map with the given hostname,
+// and whether it is known, without adding it.
+func (s *sourceIDs) Lookup(hostname string) (id int, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	id, ok = s.ids[hostname]
+	return
+}
 
-	sourceToID, err := Db.GetMapSourceToID()
+// SyncChildMaps accepts a list of child maps to sync. It syncs them
+// concurrently, and puts any newly discovered addresses in the local
+// ID table. Syncs of the same map are serialized by lockChildMap, so
+// that they apply their changes in order. Errors syncing individual
+// maps are logged, and leave their cached nodes as they were. Nodes
+// cached through maps which are no longer in the list are removed.
+func SyncChildMaps(configs []ChildMapConfig) (err error) {
+	childMaps, err := Db.DumpChildMaps()
 	if err != nil {
 		return
 	}
-	sourceMutex := new(sync.RWMutex)
+	ids, err := Db.GetMapSourceToID()
+	if err != nil {
+		return
+	}
+	sources := &sourceIDs{ids: ids}
+
+	unlisted := make(map[string]*ChildMap, len(childMaps))
+	for _, childMap := range childMaps {
+		unlisted[childMap.Hostname] = childMap
+	}
 
-	// Next, we'll need a WaitGroup so we can block until all requests
-	// complete and a mutex to control appending to nodes.
+	// Start a separate goroutine for every address to concurrently
+	// sync it, and use a WaitGroup to block until they are all
+	// finished.
 	waiter := new(sync.WaitGroup)
-	nodesMutex := new(sync.Mutex)
+	for _, config := range configs {
+		address := config.Address
+		childMap := unlisted[address]
+		if childMap == nil {
+			id, err := sources.ID(address, "")
+			if err != nil {
+				l.Errf("Error while caching %q: %s", address, err)
+				continue
+			}
+			childMap = &ChildMap{ID: id, Hostname: address}
+		}
+		delete(unlisted, address)
 
-	// We'll need to wait for len(addresses) goroutines to finish, so
-	// put that number in the WaitGroup.
-	waiter.Add(len(addresses))
+		waiter.Add(1)
+		go func(childMap *ChildMap, config ChildMapConfig) {
+			defer waiter.Done()
+			err := SyncChildMap(childMap, config, sources)
+			if err != nil {
+				l.Errf("Caching %q produced: %s",
+					childMap.Hostname, err)
+			}
+		}(childMap, config)
+	}
+	waiter.Wait()
 
-	// Now, start a separate goroutine for every address to
-	// concurrently retrieve nodes and append them (thread-safely) to
-	// nodes. Whenever appendNodesFromChildMap() finishes, it calls
-	// waiter.Done().
-	for _, address := range addresses {
-		go appendNodesFromChildMap(&nodes, address,
-			&sourceToID, sourceMutex, nodesMutex, waiter)
+	// Remove the nodes cached through maps which were synced before,
+	// but are no longer listed.
+	for _, childMap := range unlisted {
+		if childMap.LastSync.IsZero() {
+			continue
+		}
+		unlock := lockChildMap(childMap.ID)
+		err = Db.ClearMapCache(childMap.ID)
+		unlock()
+		if err != nil {
+			return
+		}
 	}
+	return
+}
 
-	// Block until all goroutines are finished. This is simple to do
-	// with the WaitGroup, which keeps track of the number we're
-	// waiting for.
-	waiter.Wait()
+// childMapLocks holds a lock for each child map, by ID, which is held
+// while it is synced, or while it is disabled or removed.
+var childMapLocks = struct {
+	sync.Mutex
+	locks map[int]*sync.Mutex
+}{locks: make(map[int]*sync.Mutex)}
+
+// lockChildMap locks the child map with the given ID, waiting for any
+// sync of it to finish, and returns the function which unlocks it.
+func lockChildMap(id int) (unlock func()) {
+	childMapLocks.Lock()
+	lock := childMapLocks.locks[id]
+	if lock == nil {
+		lock = new(sync.Mutex)
+		childMapLocks.locks[id] = lock
+	}
+	childMapLocks.Unlock()
 
-	return Db.CacheNodes(nodes)
+	lock.Lock()
+	return lock.Unlock
 }
 
-// appendNodesFromChildMap is a helper function used by
-// GetAllFromChildMaps() which calls GetAllFromChildMap() and
-// thread-safely appends the result to the given slice. At the end of
-// the function, it calls wg.Done().
-func appendNodesFromChildMap(dst *[]*Node, address string,
-	sourceToID *map[string]int, sourceMutex *sync.RWMutex,
-	dstMutex *sync.Mutex, wg *sync.WaitGroup) {
+// StartSyncChildMap syncs a single child map in the background, as
+// SyncChildMaps does, so that it need not wait for the next heartbeat.
+// Errors are logged.
+func StartSyncChildMap(childMap *ChildMap, config ChildMapConfig) {
+	go func() {
+		ids, err := Db.GetMapSourceToID()
+		if err == nil {
+			err = SyncChildMap(childMap, config, &sourceIDs{ids: ids})
+		}
+		if err != nil {
+			l.Errf("Caching %q produced: %s", childMap.Hostname, err)
+		}
+	}()
+}
 
-	// First, retrieve the nodes if possible. If there was an error,
-	// it will be logged, and if there were no nodes, we can stop
-	// here.
-	nodes := GetAllFromChildMap(address, sourceToID, sourceMutex)
-	if nodes == nil {
-		wg.Done()
+// getSigned retrieves the given URL with fetch, conditionally if any
+// validators are given. If key is not nil, the response must be signed
+// by it for the requested path and query, within signatureWindow, or
+// an error is returned. Responses that nothing has changed must be
+// signed as well, with an empty body.
+func getSigned(url string, key *[ed25519.PublicKeySize]byte, validators Validators) (f *fetched, err error) {
+	f, err = fetch(url, validators)
+	if err != nil || key == nil {
 		return
 	}
-
-	// Now that we have the nodes, we need to lock the destination
-	// slice while we append to it.
-	dstMutex.Lock()
-	*dst = append(*dst, nodes...)
-	dstMutex.Unlock()
-	wg.Done()
+	err = VerifySignature(key, f.RequestURI, f.Header, f.Body)
+	if err != nil {
+		return nil, err
+	}
+	return
 }
 
-func GetMapStatus(address string) (data map[string]interface{}) {
-	resp, err := http.Get(strings.TrimRight(address, "/") + "/api/status")
+// GetMapStatus retrieves the status of the map at the given address.
+// If key is not nil, the status must be signed by it. Errors are
+// logged, and cause it to return nil.
+func GetMapStatus(address string, key *[ed25519.PublicKeySize]byte) (data map[string]interface{}) {
+	f, err := getSigned(
+		strings.TrimRight(address, "/")+"/api/status", key, Validators{})
 	if err != nil {
 		l.Errf("Querying status of %q produced: %s", address, err)
 		return nil
 	}
 
 	var jresp statusDumpWrapper
-	err = json.NewDecoder(resp.Body).Decode(&jresp)
+	err = json.Unmarshal(f.Body, &jresp)
 	if err != nil {
 		l.Errf("Querying status of %q produced: %s", address, err)
 		return nil
@@ -324,97 +1008,170 @@ func GetMapStatus(address string) (data map[string]interface{}) {
 	return
 }
 
-// GetAllFromChildMap retrieves a list of nodes from a single remote
-// address, and localizes them. If it encounters a remote address that
-// is not already known, it safely adds it to the sourceToID map. It
-// is safe for concurrent use. If it encounters an error, it will log
-// it and return nil.
-func GetAllFromChildMap(address string, sourceToID *map[string]int,
-	sourceMutex *sync.RWMutex) (nodes []*Node) {
-	// Query the node's status
-	mapStatus := GetMapStatus(address)
+// SyncChildMap retrieves nodes from a single child map, localizes
+// them, and applies them to the cache. If the map was last fully
+// synced within Conf.CacheExpiration, which is as long as it keeps
+// tombstones, only the nodes changed and deleted since its last sync
+// are retrieved. Otherwise, every node is retrieved, and any which
+// are no longer present are removed. If the map's public key is
+// pinned by config, any data which is not signed by it is rejected,
+// and the sync fails. If the sync fails, the failure is recorded with
+// Db.RecordSyncFailure. It is safe for concurrent use.
+func SyncChildMap(childMap *ChildMap, config ChildMapConfig, sources *sourceIDs) (err error) {
+	defer lockChildMap(childMap.ID)()
 
-	// Try to get all nodes via the API.
-	resp, err := http.Get(strings.TrimRight(address, "/") + "/api/all")
-	if err != nil {
-		l.Errf("Caching %q produced: %s", address, err)
+	start := time.Now()
+	err = syncChildMap(childMap, config, sources, start)
+	if err == ChildMapNotSyncedError {
+		// The map was disabled or removed during the sync, which is
+		// not a failure of the map itself.
+		l.Debugf("Discarded sync of %q, which is no longer synced\n",
+			childMap.Hostname)
 		return nil
+	} else if err != nil {
+		rerr := Db.RecordSyncFailure(childMap.ID, start, err.Error())
+		if rerr != nil {
+			l.Errf("Error recording failure of %q: %s",
+				childMap.Hostname, rerr)
+		}
 	}
+	return
+}
 
-	// Read the data into a the nodeDumpWrapper type, so that it
-	// decodes properly.
-	var jresp nodeDumpWrapper
-	err = json.NewDecoder(resp.Body).Decode(&jresp)
+func syncChildMap(childMap *ChildMap, config ChildMapConfig, sources *sourceIDs, start time.Time) (err error) {
+	address := strings.TrimRight(childMap.Hostname, "/")
+	key, err := config.PublicKey()
 	if err != nil {
-		l.Errf("Caching %q produced: %s", address, err)
-		return nil
-	} else if jresp.Error != nil {
-		l.Errf("Caching %q produced remote error: %s",
-			address, jresp.Error)
-		return nil
+		return
 	}
 
-	// Prepare an initial slice so that it can be appended to, then
-	// loop through and convert sources to IDs.
-	//
-	// Additionally, use a boolean to keep track of whether we've
-	// replaced "local" with the actual address already, to save some
-	// needless compares.
-	nodes = make([]*Node, 0)
-	var replacedLocal bool
-	for source, remoteNodes := range jresp.Data {
-		// If we come across "local", then replace it with the address
-		// we're retrieving from.
-		if !replacedLocal && source == "local" {
-			source = address
-		}
-
-		// Get the name of the map from the status info
-		name, ok := mapStatus["name"].(string)
-		if !ok {
-			name = ""
-		}
-
-		// First, check if the source is known. If not, then we need
-		// to add it and refresh our map. Make sure all reads and
-		// writes to sourceToID are threadsafe.
-		sourceMutex.RLock()
-		id, ok := (*sourceToID)[source]
-		sourceMutex.RUnlock()
-		if !ok {
-			// Add the new source to the database, and put it in the
-			// map under the ID len(sourceToID), because that should
-			// be unique.
-			sourceMutex.Lock()
-			err := Db.AddNewMapSource(source, name)
+	// Keep the name of the map up to date from its status, unless it
+	// has been renamed through the admin API.
+	if status := GetMapStatus(address, key); status != nil {
+		name, ok := status["Name"].(string)
+		if ok && name != childMap.Name && !childMap.Renamed {
+			err = Db.UpdateMapSourceData(childMap.Hostname, name)
 			if err != nil {
-				// Uh oh.
-				sourceMutex.Unlock()
-				l.Errf("Error while caching %q: %s", address, err)
 				return
 			}
+			childMap.Name = name
+		}
+	}
 
-			id = len(*sourceToID)
-			(*sourceToID)[source] = id
-			sourceMutex.Unlock()
+	// Incremental syncs are conditional on the validators of the last
+	// response, so that if nothing has changed, nothing is sent.
+	// Full syncs are never conditional, so that they correct any
+	// changes which incremental ones have missed.
+	full := childMap.LastFullSync.IsZero() ||
+		start.Sub(childMap.LastFullSync) >= time.Duration(Conf.CacheExpiration)
+	query := ""
+	var validators Validators
+	if !full {
+		since := childMap.LastSync.Add(-syncOverlap)
+		query = "?since=" + url.QueryEscape(since.Format(time.RFC3339))
+		validators = childMap.Validators
+	}
 
-			l.Debugf("Discovered new source map %q, ID %d\n",
-				source, id)
-		} else {
-			err := Db.UpdateMapSourceData(address, name)
-			if err != nil {
-				l.Errf("Error while updating %q: %s", address, err)
+	f, err := getSigned(address+"/api/all"+query, key, validators)
+	if err != nil {
+		return
+	}
+
+	update := &CacheUpdate{
+		MapID:      childMap.ID,
+		Listed:     childMap.Listed,
+		Full:       full,
+		Time:       start,
+		Latency:    f.Latency,
+		Validators: f.Validators,
+	}
+	if f.NotModified {
+		update.Nodes = make([]*Node, 0)
+		return Db.UpdateCache(update)
+	}
+
+	var jresp nodeDumpWrapper
+	if err = json.Unmarshal(f.Body, &jresp); err != nil {
+		return
+	} else if jresp.Error != nil {
+		return fmt.Errorf("remote error: %v", jresp.Error)
+	}
+
+	// Incremental responses contain nodes and tombstones. Older
+	// versions respond with only the changed nodes, in which case
+	// deleted nodes will be removed by the next full sync.
+	var sourceNodes map[string][]*Node
+	if !full {
+		var changes nodeChangesDump
+		if err = json.Unmarshal(jresp.Data, &changes); err != nil {
+			return
+		}
+		sourceNodes = changes.Nodes
+		for _, tombstone := range changes.Deleted {
+			if tombstone == nil || tombstone.Addr == nil {
+				continue
+			}
+			// Tombstones from older versions do not give their
+			// source. Those whose source has never been cached
+			// have nothing to remove.
+			tombstone.SourceID = anySource
+			if source := tombstone.Source; len(source) > 0 {
+				if source == "local" {
+					source = childMap.Hostname
+				}
+				id, ok := sources.Lookup(source)
+				if !ok {
+					continue
+				}
+				tombstone.SourceID = id
 			}
+			update.Deleted = append(update.Deleted, tombstone)
+		}
+	}
+	if sourceNodes == nil {
+		if err = json.Unmarshal(jresp.Data, &sourceNodes); err != nil {
+			return
+		}
+	}
+
+	// Convert sources to IDs, replacing "local" with the address of
+	// the child map. Nodes which do not pass the map's filter are
+	// counted, rather than cached. If they were cached before, then
+	// they must be removed, which a full sync does anyway.
+	update.Nodes = make([]*Node, 0)
+	filtered := make(map[string]int)
+	relayed := make([]int, 0, len(sourceNodes))
+	for source, remoteNodes := range sourceNodes {
+		name := ""
+		if source == "local" {
+			source, name = childMap.Hostname, childMap.Name
 		}
+		id, err := sources.ID(source, name)
+		if err != nil {
+			return err
+		}
+		relayed = append(relayed, id)
 
-		// Once the ID is set, proceed on to add it in all the
-		// remoteNodes.
 		for _, n := range remoteNodes {
+			if !config.Filter.Allows(n, source) {
+				filtered[source]++
+				if !full {
+					update.Deleted = append(update.Deleted,
+						&Tombstone{Addr: n.Addr, SourceID: id})
+				}
+				continue
+			}
 			n.SourceID = id
+			n.RetrieveTime = start.Unix()
+			update.Nodes = append(update.Nodes, n)
 		}
+	}
+	if full {
+		update.Filtered = filtered
+	}
 
-		// Finally, append remoteNodes to the slice we're returning.
-		nodes = append(nodes, remoteNodes...)
+	if err = Db.UpdateCache(update); err != nil {
+		return
 	}
-	return
+	return recordRelayed(childMap, relayed)
 }
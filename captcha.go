@@ -15,28 +15,21 @@ const (
 	CAPTCHAGracePeriod = time.Minute * 10
 )
 
+// CAPTCHAStore implements captcha.Store using Db.
 type CAPTCHAStore struct{}
 
-// Set inserts a new CAPTCHA ID and solution into the captcha table in
-// the database. It logs errors.
+// Set inserts a new CAPTCHA ID and solution into Db. It logs errors.
 func (CAPTCHAStore) Set(id string, digits []byte) {
-	_, err := Db.Exec(`INSERT INTO captcha
-(id, solution, expiration)
-VALUES(?, ?, ?);`,
-		[]byte(id), digits, time.Now().Add(CAPTCHAGracePeriod))
+	err := Db.SetCAPTCHA(id, digits, time.Now().Add(CAPTCHAGracePeriod))
 	if err != nil {
 		l.Err("Error registering CAPTCHA:", err)
 	}
 }
 
-// Get retrieves a CAPTCHA solution from the database and clears the
-// row if appropriate. It logs errors.
+// Get retrieves a CAPTCHA solution from Db and clears it if
+// appropriate. It logs errors.
 func (CAPTCHAStore) Get(id string, clear bool) (digits []byte) {
-	bid := []byte(id)
-	row := Db.QueryRow(`SELECT solution
-FROM captcha
-WHERE id = ? AND expiration > ?;`, bid, time.Now())
-	err := row.Scan(&digits)
+	digits, err := Db.GetCAPTCHA(id)
 	if err == sql.ErrNoRows {
 		// If there are no rows, then the ID was not found.
 		return nil
@@ -48,9 +41,7 @@ WHERE id = ? AND expiration > ?;`, bid, time.Now())
 	// If we're supposed to remove the CAPTCHA from the database, then
 	// do so.
 	if clear {
-		_, err = Db.Exec(`DELETE FROM captcha
-WHERE id = ?;`, bid)
-		if err != nil {
+		if err = Db.DeleteCAPTCHA(id); err != nil {
 			l.Err("Error deleting CAPTCHA:", err)
 		}
 	}
@@ -60,13 +51,47 @@ WHERE id = ?;`, bid)
 // ClearExpiredCAPTCHA removes any expired CAPTCHA solutions from the
 // database. It logs errors.
 func ClearExpiredCAPTCHA() {
-	_, err := Db.Exec(`DELETE FROM captcha
-WHERE expiration <= ?;`, time.Now())
-	if err != nil {
+	if err := Db.DeleteExpiredCAPTCHAs(); err != nil {
 		l.Err("Error deleting expired CAPTCHAs:", err)
 	}
 }
 
+// SetCAPTCHA inserts a new CAPTCHA ID and solution into the captcha
+// table, to expire at the given time.
+func (db DB) SetCAPTCHA(id string, solution []byte, expiration time.Time) (err error) {
+	_, err = db.Exec(`INSERT INTO captcha
+(id, solution, expiration)
+VALUES(?, ?, ?);`,
+		[]byte(id), solution, expiration.Unix())
+	return
+}
+
+// GetCAPTCHA retrieves the solution of the CAPTCHA with the given ID
+// from the captcha table. If there is no such CAPTCHA, or it has
+// expired, it returns sql.ErrNoRows.
+func (db DB) GetCAPTCHA(id string) (solution []byte, err error) {
+	err = db.QueryRow(`SELECT solution
+FROM captcha
+WHERE id = ? AND expiration > ?;`,
+		[]byte(id), time.Now().Unix()).Scan(&solution)
+	return
+}
+
+// DeleteCAPTCHA removes the CAPTCHA with the given ID from the
+// captcha table.
+func (db DB) DeleteCAPTCHA(id string) (err error) {
+	_, err = db.Exec(`DELETE FROM captcha
+WHERE id = ?;`, []byte(id))
+	return
+}
+
+// DeleteExpiredCAPTCHAs removes any expired CAPTCHA solutions from the
+// captcha table.
+func (db DB) DeleteExpiredCAPTCHAs() (err error) {
+	_, err = db.Exec(`DELETE FROM captcha
+WHERE expiration <= ?;`, time.Now().Unix())
+	return
+}
 
 // VerifyCAPTCHA accepts a *http.Request and verifies that the given
 // 'captcha' form is valid. This is a string of the form
@@ -6,6 +6,7 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"github.com/agl/ed25519"
 	"html/template"
 	"net"
 	"os"
@@ -87,15 +88,81 @@ type Config struct {
 		}
 	}
 
-	// ChildMaps is a list of addresses from which to pull lists of
-	// nodes every heartbeat. Please note that these maps are trusted
-	// fully, and they could easily introduce false nodes to the
-	// database temporarily (until cleared by the CacheExpiration.
-	ChildMaps []string
+	// ChildMaps is a list of maps from which to pull lists of nodes
+	// every heartbeat. Please note that these maps are trusted fully,
+	// and they could easily introduce false nodes to the database
+	// temporarily (until cleared by the CacheExpiration. If a map's
+	// public key is pinned, only data signed by it is accepted.
+	ChildMaps []ChildMapConfig
+
+	// ParentMaps is a list of maps which cache this one as a child
+	// map, and to which changes to local nodes are pushed as they
+	// happen. Changes which cannot be pushed are kept and retried
+	// every heartbeat, for up to CacheExpiration.
+	ParentMaps []ParentMapConfig
+
+	// Aggregator controls whether this map crawls the child maps of
+	// its child maps, so that /api/federation gives every map below
+	// it, and how they relay each other.
+	Aggregator struct {
+		// Enabled causes the child maps to be crawled at every
+		// heartbeat, after they are synced.
+		Enabled bool
+
+		// MaxDepth is the greatest number of levels below the child
+		// maps which are crawled. If it is not given, it is 8.
+		MaxDepth int
+	}
+
+	// Federation controls the HTTP client with which child maps are
+	// synced and changes are pushed to parent maps.
+	Federation struct {
+		// ConnectTimeout is the longest to wait to connect to another
+		// map, and Timeout is the longest to wait for an entire
+		// response, including its body. If they are not given, they
+		// are 10 seconds and 1 minute.
+		ConnectTimeout, Timeout Duration
+
+		// Concurrency is the greatest number of requests to child
+		// maps which are made at once. If it is not given, it is 8.
+		Concurrency int
+
+		// MaxResponseSize is the greatest size, in bytes, of a
+		// response from a child map once it is decompressed. Larger
+		// responses cause the sync to fail. If it is not given, it is
+		// 64 MiB.
+		MaxResponseSize int64
+	}
+
+	// Conflicts determines which copy of a node is shown when the
+	// same address is known from more than one source, such as
+	// locally and from a child map. The others are shadowed, and are
+	// only reported by /api/conflicts.
+	Conflicts struct {
+		// Policy is "local" if local nodes should take precedence
+		// over cached ones, "recent" if the most recently updated or
+		// retrieved copy should, or "priority" if the order of
+		// Priority should. If it is empty, it is "local". Ties are
+		// broken by recency.
+		Policy string
+
+		// Priority is a list of sources, which are "local" or the
+		// addresses of child maps, in order of decreasing precedence.
+		// Sources which are not listed come after those which are.
+		Priority []string
+	}
+
+	// IdentityFile is the path to the file containing the ed25519
+	// key with which this instance signs its /api/all and
+	// /api/status responses. If the file does not exist, a new key
+	// is generated and written to it. If it is not given,
+	// "identity.key" is used.
+	IdentityFile string
 
 	// Database is the structure which contains the database driver
-	// name, such as "sqlite3" or "mysql", and the database resource,
-	// such as a path to .db file, or username, password, and name.
+	// name, such as "sqlite3", "mysql", or "postgres", and the
+	// database resource, such as a path to .db file, or username,
+	// password, and name.
 	Database struct {
 		DriverName string
 		Resource   string
@@ -108,7 +175,9 @@ type Config struct {
 	HeartbeatRate Duration
 
 	// CacheExpiration is the amount of time for which to store cached
-	// nodes before considering them outdated, and removing them.
+	// nodes before considering them outdated, and removing them. It
+	// is also the amount of time for which to remember deleted nodes,
+	// so that they can be reported to consumers of /api/all?since.
 	CacheExpiration Duration
 
 	// VerificationExpiration is the amount of time to allow users to
@@ -208,18 +277,39 @@ type Config struct {
 		FromNode bool
 	}
 
-	// NetworkAdmin is the set of configuration options which allows
-	// NodeAtlas to connect to the administration interface of the
-	// network device, if applicable. If it is not given, the feature
-	// is disabled.
-	NetworkAdmin *struct {
-		// Type is the string which identifies the network
-		// administration type to connect to. Currently, only "cjdns"
-		// is supported. See <https://github.com/cjdelisle/cjdns>.
-		Type string
-
-		Credentials map[string]interface{}
+	// NetworkAdmin is the list of network backends from which the
+	// links between nodes are found, such as the administration
+	// interface of the network device. A single backend may be given
+	// without a list. The links found by every backend are merged. If
+	// it is not given, the feature is disabled.
+	NetworkAdmin NetworkAdminConfigs `json:",omitempty"`
+}
+
+// NetworkAdminConfig is the configuration of a single network
+// backend.
+type NetworkAdminConfig struct {
+	// Type is the name with which the backend is registered by
+	// RegisterNetwork, such as "cjdns" or "static".
+	Type string
+
+	// Credentials are the options of the backend, such as the
+	// address and password of an administration interface.
+	Credentials map[string]interface{}
+}
+
+// NetworkAdminConfigs is a list of network backends, which may be
+// given as a single object rather than a list.
+type NetworkAdminConfigs []NetworkAdminConfig
+
+func (c *NetworkAdminConfigs) UnmarshalJSON(b []byte) (err error) {
+	// Nothing is kept from any previous value, such as Credentials,
+	// which would otherwise be decoded into.
+	*c = nil
+	if len(b) > 0 && b[0] == '{' {
+		*c = make(NetworkAdminConfigs, 1)
+		return json.Unmarshal(b, &(*c)[0])
 	}
+	return json.Unmarshal(b, (*[]NetworkAdminConfig)(c))
 }
 
 // ReadConfig uses os and encoding/json to read a configuration from
@@ -250,6 +340,81 @@ func WriteConfig(conf *Config, path string) (err error) {
 	return
 }
 
+// ChildMapConfig is an entry in Config.ChildMaps. In JSON, it is
+// either the address of the child map as a string, or an object which
+// also gives its Key, PushKey, or Filter.
+type ChildMapConfig struct {
+	// Address is the address of the child map, such as
+	// "http://map.example.com".
+	Address string
+
+	// Key, if not empty, is the base64-encoded ed25519 public key of
+	// the child map, as given by its /api/status. Any data from the
+	// map which is not signed by it is rejected.
+	Key string `json:",omitempty"`
+
+	// PushKey, if not empty, is a secret shared with the child map,
+	// which allows it to push changes to its nodes as they happen.
+	// It must be the same as the PushKey which the child map gives
+	// for this map in its ParentMaps, and differ from that of every
+	// other child map.
+	PushKey string `json:",omitempty"`
+
+	// Filter, if given, restricts which of the nodes retrieved from
+	// the child map are cached.
+	Filter *ImportFilter `json:",omitempty"`
+}
+
+// ParentMapConfig is an entry in Config.ParentMaps.
+type ParentMapConfig struct {
+	// Address is the address of the parent map, such as
+	// "http://map.example.com".
+	Address string
+
+	// PushKey is the secret shared with the parent map, with which
+	// pushes to it are authenticated. It must be the same as the
+	// PushKey which the parent map gives for this map in its
+	// ChildMaps.
+	PushKey string
+}
+
+// childMapConfig has the same fields as ChildMapConfig, but not its
+// methods, so that it can be marshalled as an object.
+type childMapConfig ChildMapConfig
+
+func (c *ChildMapConfig) UnmarshalJSON(b []byte) (err error) {
+	// Nothing is kept from any previous value, such as a Filter,
+	// which would otherwise be decoded into.
+	*c = ChildMapConfig{}
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &c.Address)
+	}
+	if err = json.Unmarshal(b, (*childMapConfig)(c)); err != nil {
+		return
+	}
+	if _, err = c.PublicKey(); err != nil {
+		return
+	}
+	return c.Filter.Validate()
+}
+
+func (c ChildMapConfig) MarshalJSON() ([]byte, error) {
+	// Maps without keys or filters are written as only their
+	// address, as they were before those could be given.
+	if len(c.Key) == 0 && len(c.PushKey) == 0 && c.Filter == nil {
+		return json.Marshal(c.Address)
+	}
+	return json.Marshal(childMapConfig(c))
+}
+
+// PublicKey parses Key, and returns nil if it is empty.
+func (c ChildMapConfig) PublicKey() (key *[ed25519.PublicKeySize]byte, err error) {
+	if len(c.Key) == 0 {
+		return nil, nil
+	}
+	return ParsePublicKey(c.Key)
+}
+
 type Duration time.Duration
 
 func (d Duration) MarshalJSON() ([]byte, error) {
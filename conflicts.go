@@ -0,0 +1,161 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Conflict policies, which determine which copy of a node is shown
+// when its address is known from more than one source. They are set
+// by Conf.Conflicts.Policy.
+const (
+	PolicyLocal    = "local"    // local nodes first, then most recent
+	PolicyRecent   = "recent"   // most recently updated or retrieved
+	PolicyPriority = "priority" // Conf.Conflicts.Priority, then most recent
+)
+
+var (
+	InvalidConflictPolicyError = errors.New(
+		"Conflicts.Policy must be local, recent, or priority")
+)
+
+// CheckConflictPolicy returns InvalidConflictPolicyError if the
+// conflict policy of the given configuration is not known. An empty
+// policy is PolicyLocal.
+func CheckConflictPolicy(conf *Config) error {
+	switch conf.Conflicts.Policy {
+	case "", PolicyLocal, PolicyRecent, PolicyPriority:
+		return nil
+	}
+	return InvalidConflictPolicyError
+}
+
+// NodeCopy is one of several copies of a node with the same address,
+// each from a different source.
+type NodeCopy struct {
+	*Node
+
+	// Source is "local" or the hostname of the child map from which
+	// the copy was retrieved.
+	Source string
+
+	// Updated is the time at which the copy was last updated if it
+	// is local, or retrieved if it is cached.
+	Updated time.Time
+}
+
+// nodeCopies implements sort.Interface to sort copies of a node in
+// order of decreasing precedence, according to Conf.Conflicts. Ties
+// are broken by recency, and then by source ID, so that local nodes
+// come first.
+type nodeCopies []*NodeCopy
+
+func (c nodeCopies) Len() int      { return len(c) }
+func (c nodeCopies) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c nodeCopies) Less(i, j int) bool {
+	a, b := c[i], c[j]
+	switch Conf.Conflicts.Policy {
+	case PolicyRecent:
+	case PolicyPriority:
+		if pa, pb := sourcePriority(a.Source), sourcePriority(b.Source); pa != pb {
+			return pa < pb
+		}
+	default:
+		if (a.SourceID == 0) != (b.SourceID == 0) {
+			return a.SourceID == 0
+		}
+	}
+	if !a.Updated.Equal(b.Updated) {
+		return a.Updated.After(b.Updated)
+	}
+	return a.SourceID < b.SourceID
+}
+
+// sourcePriority returns the index of the given source in
+// Conf.Conflicts.Priority, or its length if the source is not listed.
+func sourcePriority(source string) int {
+	for i, s := range Conf.Conflicts.Priority {
+		if s == source {
+			return i
+		}
+	}
+	return len(Conf.Conflicts.Priority)
+}
+
+// Conflict is an address which is known from more than one source.
+type Conflict struct {
+	Addr IP
+
+	// Shown is the copy which takes precedence, and is the only one
+	// which is dumped or looked up. Shadowed are the others, in order
+	// of decreasing precedence.
+	Shown    *NodeCopy
+	Shadowed []*NodeCopy
+}
+
+// FindConflicts returns every address which is known from more than
+// one source in the given Store, ordered by address, with the copies
+// of each ordered according to Conf.Conflicts.
+func FindConflicts(db Store) (conflicts []*Conflict, err error) {
+	nodes, updated, err := db.DumpDuplicates()
+	if err != nil {
+		return
+	}
+	conflicts = make([]*Conflict, 0)
+	if len(nodes) == 0 {
+		return
+	}
+	idSources, err := db.GetMapIDToSource()
+	if err != nil {
+		return
+	}
+
+	// Group the copies by address. DumpDuplicates returns them in
+	// order of address, so each group is contiguous.
+	var copies nodeCopies
+	for i, node := range nodes {
+		copies = append(copies, &NodeCopy{
+			Node:    node,
+			Source:  idSources[node.SourceID],
+			Updated: updated[i],
+		})
+		if i+1 < len(nodes) && bytes.Equal(nodes[i+1].Addr, node.Addr) {
+			continue
+		}
+
+		sort.Sort(copies)
+		conflicts = append(conflicts, &Conflict{
+			Addr:     node.Addr,
+			Shown:    copies[0],
+			Shadowed: copies[1:],
+		})
+		copies = nil
+	}
+	return
+}
+
+// copyKey identifies the copy of the node with the given address from
+// the given source.
+func copyKey(addr IP, sourceID int) string {
+	return addr.String() + "/" + strconv.Itoa(sourceID)
+}
+
+// preferredCopy returns the copy of a node which takes precedence
+// among the given copies from each source, which it sorts in order of
+// decreasing precedence. If there are none, it returns nil. Stores
+// read every copy of a node at once, and choose the one to dump or
+// look up with preferredCopy, so that no other is shown in its place
+// if the copies change in the meantime.
+func preferredCopy(copies nodeCopies) *NodeCopy {
+	if len(copies) == 0 {
+		return nil
+	}
+	sort.Sort(copies)
+	return copies[0]
+}
@@ -4,95 +4,120 @@ package main
 // and contributors; (GPLv3) see LICENSE or doc.go
 
 import (
+	"bytes"
 	_ "code.google.com/p/go-sqlite/go1/sqlite3"
 	"database/sql"
-	"errors"
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	"strconv"
+	"strings"
 	"time"
 )
 
 var (
-	Db DB
+	// Db is the Store used by the running instance, which is usually
+	// a DB.
+	Db Store
 )
 
+// DB wraps a *sql.DB with the name of its driver, so that queries can
+// be adjusted for the dialect in use. All queries are written with
+// "?" placeholders and single-quoted string literals, and are
+// rewritten as necessary by Exec, Query, QueryRow, and Prepare.
 type DB struct {
 	*sql.DB
 	DriverName string
 	ReadOnly   bool
 }
 
-// InitializeTables issues the commands to create all tables and
-// columns. Will not create the tables if they exist already. If
-// it encounters an error, it is returned.
-func (db DB) InitializeTables() (err error) {
-	// First, create the 'nodes' table.
-	_, err = db.Query(`CREATE TABLE IF NOT EXISTS nodes (
-address BINARY(16) PRIMARY KEY,
-owner VARCHAR(255) NOT NULL,
-email VARCHAR(255) NOT NULL,
-contact VARCHAR(255),
-details VARCHAR(255),
-pgp BINARY(8),
-lat FLOAT NOT NULL,
-lon FLOAT NOT NULL,
-status INT NOT NULL,
-updated INT NOT NULL);`)
-	if err != nil {
-		return
-	}
-	_, err = db.Query(`CREATE TABLE IF NOT EXISTS nodes_cached (
-address BINARY(16) PRIMARY KEY,
-owner VARCHAR(255) NOT NULL,
-details VARCHAR(255),
-lat FLOAT NOT NULL,
-lon FLOAT NOT NULL,
-status INT NOT NULL,
-source INT NOT NULL,
-retrieved INT NOT NULL);`)
-	if err != nil {
-		return
-	}
-	_, err = db.Query(`CREATE TABLE IF NOT EXISTS nodes_verify_queue (
-id INT PRIMARY KEY,
-address BINARY(16) NOT NULL,
-owner VARCHAR(255) NOT NULL,
-email VARCHAR(255) NOT NULL,
-contact VARCHAR(255),
-details VARCHAR(255),
-pgp BINARY(8),
-lat FLOAT NOT NULL,
-lon FLOAT NOT NULL,
-status INT NOT NULL,
-verifysent BOOL NOT NULL,
-expiration INT NOT NULL);`)
-	if err != nil {
-		return
-	}
-	// <mysql> SQL? A standard? Hahahaha!
-	if db.DriverName == "mysql" {
-		_, err = db.Query(`CREATE TABLE IF NOT EXISTS cached_maps (
-id INTEGER PRIMARY KEY AUTO_INCREMENT,
-hostname VARCHAR(255) NOT NULL,
-name VARCHAR(255) NOT NULL);`)
-	} else {
-		_, err = db.Query(`CREATE TABLE IF NOT EXISTS cached_maps (
-id INTEGER PRIMARY KEY AUTOINCREMENT,
-hostname VARCHAR(255) NOT NULL,
-name VARCHAR(255) NOT NULL);`)
+// Tx wraps a *sql.Tx in the same way that DB wraps a *sql.DB.
+type Tx struct {
+	*sql.Tx
+	DriverName string
+}
+
+// Rebind rewrites a query written with "?" placeholders into the
+// placeholder style of the given driver. PostgreSQL uses numbered
+// placeholders, such as "$1", so each "?" outside of a quoted string
+// is replaced in order. Queries for other drivers are returned as-is.
+func Rebind(driverName, query string) string {
+	if driverName != "postgres" {
+		return query
 	}
-	if err != nil {
-		return
+
+	b := new(bytes.Buffer)
+	b.Grow(len(query) + 8)
+
+	n := 0
+	var quoted bool
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == '?' && !quoted:
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
 	}
+	return b.String()
+}
 
-	_, err = db.Query(`CREATE TABLE IF NOT EXISTS captcha (
-id BINARY(32) NOT NULL,
-solution BINARY(6) NOT NULL,
-expiration INT NOT NULL);`)
+// Exec performs *sql.DB.Exec after rebinding the query.
+func (db DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(Rebind(db.DriverName, query), args...)
+}
+
+// Query performs *sql.DB.Query after rebinding the query.
+func (db DB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(Rebind(db.DriverName, query), args...)
+}
+
+// QueryRow performs *sql.DB.QueryRow after rebinding the query.
+func (db DB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(Rebind(db.DriverName, query), args...)
+}
+
+// Prepare performs *sql.DB.Prepare after rebinding the query.
+func (db DB) Prepare(query string) (*sql.Stmt, error) {
+	return db.DB.Prepare(Rebind(db.DriverName, query))
+}
+
+// Begin starts a transaction, which is wrapped so that its queries
+// are rebound in the same way as those of the DB.
+func (db DB) Begin() (*Tx, error) {
+	tx, err := db.DB.Begin()
 	if err != nil {
-		return
+		return nil, err
 	}
+	return &Tx{tx, db.DriverName}, nil
+}
 
-	return
+// Exec performs *sql.Tx.Exec after rebinding the query.
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(Rebind(tx.DriverName, query), args...)
+}
+
+// Query performs *sql.Tx.Query after rebinding the query.
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(Rebind(tx.DriverName, query), args...)
+}
+
+// QueryRow performs *sql.Tx.QueryRow after rebinding the query.
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(Rebind(tx.DriverName, query), args...)
+}
+
+// Prepare performs *sql.Tx.Prepare after rebinding the query.
+func (tx *Tx) Prepare(query string) (*sql.Stmt, error) {
+	return tx.Tx.Prepare(Rebind(tx.DriverName, query))
+}
+
+// IsReadOnly returns the ReadOnly field, so that DB implements Store.
+func (db DB) IsReadOnly() bool {
+	return db.ReadOnly
 }
 
 // LenNodes returns the number of nodes in the database. If there is
@@ -114,72 +139,202 @@ func (db DB) LenNodes(useCached bool) (n int) {
 	return
 }
 
-// DumpNodes returns an array containing all nodes in the database,
-// including both local and cached nodes.
-func (db DB) DumpNodes() (nodes []*Node, err error) {
-	// Begin by getting the required length of the array. If we get
-	// -1, then there has been an error.
-	if n := db.LenNodes(true); n != -1 {
-		// If successful, initialize the array with the length.
-		nodes = make([]*Node, n)
-	} else {
-		// Otherwise, error out.
-		l.Errf("Could not count number of nodes in database\n")
-		return nil, errors.New("Could not count number of nodes")
+// cachedMapsJoin joins each row of the nodes_cached table to the row
+// of the cached_maps table for the child map it was retrieved
+// through, if there is one, so that cachedStale can be selected.
+const cachedMapsJoin = `
+LEFT JOIN cached_maps ON cached_maps.id = nodes_cached.via`
+
+// cachedStale is selected as 1 for cached nodes which are stale,
+// because the most recent attempt to sync the child map they were
+// retrieved through failed, and 0 otherwise.
+const cachedStale = `CASE WHEN lastfailure > lastsync THEN 1 ELSE 0 END`
+
+// selectPreferred returns the copy of each node, local or cached,
+// which takes precedence, as described by FindConflicts, in order of
+// address. If either WHERE clause is nonempty, only the nodes with a
+// copy in the nodes or nodes_cached table matched by it are included,
+// but every copy of those nodes is considered. The arguments are
+// those of the local clause, followed by those of the cached one.
+//
+// Every copy is read in a single query, ordered by address, so that
+// the choice between them is made in the same pass, and cannot be
+// affected by changes made in the meantime.
+func (db DB) selectPreferred(localWhere, cachedWhere string, args ...interface{}) (copies []*NodeCopy, err error) {
+	var where string
+	if len(localWhere) > 0 || len(cachedWhere) > 0 {
+		where = `
+WHERE address IN (SELECT address FROM nodes` + localWhere + `
+UNION SELECT address FROM nodes_cached` + cachedWhere + `)`
 	}
 
-	// Perform the query.
 	rows, err := db.Query(`
-SELECT address,owner,contact,details,pgp,lat,lon,status,0
+SELECT address,owner,contact,details,pgp,lat,lon,status,source,
+hostname,changed,stale
+FROM (SELECT address,owner,contact,details,pgp,lat,lon,status,
+0 AS source,'local' AS hostname,updated AS changed,0 AS stale
 FROM nodes
-UNION SELECT address,owner,"",details,"",lat,lon,status,source
-FROM nodes_cached;`)
+UNION ALL SELECT address,owner,'',details,'',lat,lon,status,source,
+COALESCE((SELECT s.hostname FROM cached_maps AS s
+WHERE s.id = nodes_cached.source),''),
+retrieved,`+cachedStale+`
+FROM nodes_cached`+cachedMapsJoin+`) AS n`+where+`
+ORDER BY address,source;`, args...)
 	if err != nil {
-		l.Errf("Error dumping database: %s", err)
 		return
 	}
 	defer rows.Close()
 
-	// Now, loop through, initialize the nodes, and fill them out
-	// using only the selected columns.
-	for i := 0; rows.Next(); i++ {
-		// Initialize the node and put it in the table.
-		node := new(Node)
-		nodes[i] = node
-
-		// Create temporary values to simplify scanning.
+	// Group the copies of each node, which are contiguous, and keep
+	// the one which takes precedence.
+	copies = make([]*NodeCopy, 0)
+	var group nodeCopies
+	for rows.Next() {
+		c := &NodeCopy{Node: new(Node)}
 		contact := sql.NullString{}
 		details := sql.NullString{}
+		var changed int64
 
-		// Scan all of the values into it.
-		err = rows.Scan(&node.Addr, &node.OwnerName,
-			&contact, &details, &node.PGP,
-			&node.Latitude, &node.Longitude, &node.Status, &node.SourceID)
+		err = rows.Scan(&c.Addr, &c.OwnerName,
+			&contact, &details, &c.PGP,
+			&c.Latitude, &c.Longitude, &c.Status, &c.SourceID,
+			&c.Source, &changed, &c.Stale)
 		if err != nil {
-			l.Errf("Error dumping database: %s", err)
 			return
 		}
+		c.Contact = contact.String
+		c.Details = details.String
+		if c.SourceID != 0 {
+			c.RetrieveTime = changed
+		}
+		c.Updated = time.Unix(changed, 0)
 
-		node.Contact = contact.String
-		node.Details = details.String
+		if len(group) > 0 && !bytes.Equal(group[0].Addr, c.Addr) {
+			copies = append(copies, preferredCopy(group))
+			group = nil
+		}
+		group = append(group, c)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	if len(group) > 0 {
+		copies = append(copies, preferredCopy(group))
+	}
+	return
+}
+
+// DumpNodes returns an array containing all nodes in the database,
+// including both local and cached nodes. Where an address is known
+// from more than one source, only the copy which takes precedence is
+// included, as described by FindConflicts.
+func (db DB) DumpNodes() (nodes []*Node, err error) {
+	copies, err := db.selectPreferred("", "")
+	if err != nil {
+		l.Errf("Error dumping database: %s", err)
+		return
+	}
+
+	nodes = make([]*Node, len(copies))
+	for i, c := range copies {
+		nodes[i] = c.Node
+	}
+	return
+}
+
+// QueryNodes returns the nodes, both local and cached, which are
+// matched by the given query, in its sort order, excluding shadowed
+// copies as DumpNodes does. Nodes outside the bounds of its Area are
+// excluded by the database, using the indexes on the lat and lon
+// columns, so that only the nodes near the Area need to be checked
+// precisely. If the query has a Limit and more nodes match, next
+// marks the last node returned.
+func (db DB) QueryNodes(q *NodeQuery) (nodes []*Node, next *NodeCursor, err error) {
+	if err = q.Validate(); err != nil {
+		return
+	}
+	localWhere, localArgs := q.sqlWhere(false)
+	cachedWhere, cachedArgs := q.sqlWhere(true)
+
+	copies, err := db.selectPreferred(localWhere, cachedWhere,
+		append(localArgs, cachedArgs...)...)
+	if err != nil {
+		return
 	}
+
+	// The copy which takes precedence may not be the one which
+	// caused the node to be selected, so each is checked again.
+	matched := make(nodePositions, 0)
+	for _, c := range copies {
+		if q.Matches(c.Node) {
+			matched = append(matched,
+				nodePosition{c.Node, q.cursor(c.Node, c.Updated.Unix())})
+		}
+	}
+	nodes, next = q.page(matched)
 	return
 }
 
+// sqlWhere returns a WHERE clause, beginning with a space, and its
+// arguments, which exclude rows of either the nodes or nodes_cached
+// table that cannot be matched by the query. If nothing can be
+// excluded, the clause is empty.
+func (q *NodeQuery) sqlWhere(cached bool) (where string, args []interface{}) {
+	conds := make([]string, 0)
+	if a := q.Area; a != nil {
+		conds = append(conds, "lat >= ? AND lat <= ?")
+		args = append(args, a.MinLat, a.MaxLat)
+
+		// If the area crosses the antimeridian, then the longitude
+		// may be on either side of it.
+		if a.MinLon <= a.MaxLon {
+			conds = append(conds, "lon >= ? AND lon <= ?")
+		} else {
+			conds = append(conds, "(lon >= ? OR lon <= ?)")
+		}
+		args = append(args, a.MinLon, a.MaxLon)
+	}
+
+	if q.StatusAll != 0 {
+		conds = append(conds, "(status & ?) = ?")
+		args = append(args, int64(q.StatusAll), int64(q.StatusAll))
+	}
+	if q.StatusAny != 0 {
+		conds = append(conds, "(status & ?) != 0")
+		args = append(args, int64(q.StatusAny))
+	}
+
+	// Local nodes all have the source ID 0, so they are either all
+	// included or all excluded. Cached nodes are matched by their
+	// source column.
+	if q.SourceIDs != nil && !cached && !q.hasSource(0) {
+		conds = append(conds, "1 = 0")
+	} else if q.SourceIDs != nil && cached {
+		placeholders := make([]string, 0, len(q.SourceIDs))
+		for _, id := range q.SourceIDs {
+			if id != 0 {
+				placeholders = append(placeholders, "?")
+				args = append(args, id)
+			}
+		}
+
+		if len(placeholders) == 0 {
+			conds = append(conds, "1 = 0")
+		} else {
+			conds = append(conds,
+				"source IN ("+strings.Join(placeholders, ",")+")")
+		}
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
 // DumpLocal returns a slice containing all of the local nodes in the
 // database.
 func (db DB) DumpLocal() (nodes []*Node, err error) {
-	// Begin by getting the required length of the array. If we get
-	// -1, then there has been an error.
-	if n := db.LenNodes(true); n != -1 {
-		// If successful, initialize the array with the length.
-		nodes = make([]*Node, n)
-	} else {
-		// Otherwise, error out.
-		l.Errf("Could not count number of nodes in database\n")
-		return nil, errors.New("Could not count number of nodes")
-	}
-
 	// Perform the query.
 	rows, err := db.Query(`
 SELECT address,owner,contact,details,pgp,lat,lon,status
@@ -192,10 +347,9 @@ FROM nodes;`)
 
 	// Now, loop through, initialize the nodes, and fill them out
 	// using only the selected columns.
-	for i := 0; rows.Next(); i++ {
-		// Initialize the node and put it in the table.
+	nodes = make([]*Node, 0)
+	for rows.Next() {
 		node := new(Node)
-		nodes[i] = node
 
 		// Create temporary values to simplify scanning.
 		contact := sql.NullString{}
@@ -212,156 +366,454 @@ FROM nodes;`)
 
 		node.Contact = contact.String
 		node.Details = details.String
+		nodes = append(nodes, node)
 	}
-	return
+	return nodes, rows.Err()
 }
 
 // DumpChanges returns all nodes, both local and cached, which have
-// been updated or retrieved more recently than the given time.
+// been updated or retrieved more recently than the given time,
+// excluding shadowed copies as DumpNodes does.
 func (db DB) DumpChanges(time time.Time) (nodes []*Node, err error) {
+	since := time.Unix()
+	copies, err := db.selectPreferred(" WHERE updated >= ?",
+		" WHERE retrieved >= ?", since, since)
+	if err != nil {
+		return
+	}
+
+	// A node which has changed may be shadowed by a copy which has
+	// not, in which case the node has not changed as it is shown.
+	nodes = make([]*Node, 0)
+	for _, c := range copies {
+		if c.Updated.Unix() >= since {
+			nodes = append(nodes, c.Node)
+		}
+	}
+	return
+}
+
+// DumpLocalUpdated returns the address and owner of each local node
+// which has been updated more recently than the given time, along
+// with the time at which each was last updated.
+func (db DB) DumpLocalUpdated(since time.Time) (nodes []*Node, updated []time.Time, err error) {
 	rows, err := db.Query(`
-SELECT address,owner,contact,details,pgp,lat,lon,status
-FROM nodes WHERE updated >= ?
-UNION
-SELECT address,owner,"",details,"",lat,lon,status
-FROM nodes_cached WHERE retrieved >= ?;`, time, time)
+SELECT updated,address,owner
+FROM nodes
+WHERE updated >= ?;`, since.Unix())
 	if err != nil {
 		return
 	}
+	defer rows.Close()
 
-	// Append each node to the array in sequence.
 	for rows.Next() {
+		var t int64
 		node := new(Node)
-
-		contact := sql.NullString{}
-		details := sql.NullString{}
-
-		err = rows.Scan(&node.Addr, &node.OwnerName,
-			&contact, &details, &node.PGP,
-			&node.Latitude, &node.Longitude, &node.Status)
-		if err != nil {
+		if err = rows.Scan(&t, &node.Addr, &node.OwnerName); err != nil {
 			return
 		}
-
-		node.Contact = contact.String
-		node.Details = details.String
-
 		nodes = append(nodes, node)
+		updated = append(updated, time.Unix(t, 0))
+	}
+	return nodes, updated, rows.Err()
+}
+
+// LastModified returns the latest time at which any node was added,
+// updated, retrieved from a child map, or deleted, at which a child
+// map was synced or failed to be, which would mark its nodes stale,
+// or at which any of these was removed, such as by expiry. It is zero
+// if there has been no such change. Because removals are recorded, it
+// never moves backwards.
+func (db DB) LastModified() (t time.Time, err error) {
+	var latest sql.NullInt64
+	err = db.QueryRow(`SELECT MAX(t) FROM (
+SELECT MAX(updated) AS t FROM nodes
+UNION ALL SELECT MAX(retrieved) FROM nodes_cached
+UNION ALL SELECT MAX(deleted) FROM nodes_deleted
+UNION ALL SELECT MAX(lastsync) FROM cached_maps
+UNION ALL SELECT MAX(lastfailure) FROM cached_maps
+UNION ALL SELECT MAX(removed) FROM last_removal) AS latest;`).Scan(&latest)
+	if err != nil || !latest.Valid {
+		return
 	}
+	return unixOrZero(latest.Int64), nil
+}
+
+// recordRemoval records that rows which LastModified considers have
+// just been removed, so that it does not move backwards.
+func recordRemoval(e Execer) (err error) {
+	now := time.Now().Unix()
+	_, err = e.Exec(`UPDATE last_removal
+SET removed = ? WHERE removed < ?;`, now, now)
 	return
 }
 
+// Execer is implemented by both DB and *Tx, so that statements which
+// modify nodes can be executed either on their own or as part of a
+// larger transaction.
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
 // AddNode inserts a node into the 'nodes' table with the current
 // timestamp.
 func (db DB) AddNode(node *Node) (err error) {
-	// Inserts a new node into the database
-	stmt, err := db.Prepare(`INSERT INTO nodes
-(address, owner, email, contact, details, pgp, lat, lon, status, updated)
-VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
-	if err != nil {
-		return
-	}
-	_, err = stmt.Exec([]byte(node.Addr), node.OwnerName, node.OwnerEmail,
-		node.Contact, node.Details, []byte(node.PGP),
-		node.Latitude, node.Longitude, node.Status,
-		time.Now())
-	stmt.Close()
-	return
+	return addNode(db, node)
 }
 
+// AddNodes inserts several nodes into the 'nodes' table with the
+// current timestamp, in a single transaction. If any of them cannot
+// be inserted, none are.
 func (db DB) AddNodes(nodes []*Node) (err error) {
-	stmt, err := db.Prepare(`INSERT INTO nodes
-(address, owner, email, contact, details, pgp, lat, lon, status, updated)
-VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`)
+	tx, err := db.Begin()
 	if err != nil {
 		return
 	}
 
 	for _, node := range nodes {
-		_, err = stmt.Exec([]byte(node.Addr),
-			node.OwnerName, node.OwnerEmail,
-			node.Contact, node.Details, []byte(node.PGP),
-			node.Latitude, node.Longitude, node.Status,
-			time.Now())
-		if err != nil {
+		if err = addNode(tx, node); err != nil {
+			tx.Rollback()
 			return
 		}
 	}
-	stmt.Close()
-	return
+	return tx.Commit()
+}
+
+// addNode inserts a node into the 'nodes' table with the current
+// timestamp, and clears any tombstone left by a previous deletion of
+// the same address.
+func addNode(e Execer, node *Node) (err error) {
+	// Inserts a new node into the database
+	_, err = e.Exec(`INSERT INTO nodes
+(address, owner, email, contact, details, pgp, lat, lon, status, updated)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		[]byte(node.Addr), node.OwnerName, node.OwnerEmail,
+		node.Contact, node.Details, []byte(node.PGP),
+		node.Latitude, node.Longitude, node.Status,
+		time.Now().Unix())
+	if err != nil {
+		return
+	}
+
+	// If the node had been deleted before, it no longer is.
+	return clearTombstone(e, node.Addr)
 }
 
 // UpdateNode replaces the node in the database with the IP matching
 // the given node.
 func (db DB) UpdateNode(node *Node) (err error) {
+	return updateNode(db, node)
+}
+
+// updateNode replaces the node in the 'nodes' table with the IP
+// matching the given node, and sets its timestamp to the current
+// time.
+func updateNode(e Execer, node *Node) (err error) {
 	// Updates an existing node in the database
-	stmt, err := db.Prepare(`UPDATE nodes SET
-owner = ?, contact = ?, details = ?, pgp = ?, lat = ?, lon = ?, status = ?
-WHERE address = ?`)
-	if err != nil {
-		return
-	}
-	_, err = stmt.Exec(node.OwnerName, node.Contact,
+	_, err = e.Exec(`UPDATE nodes SET
+owner = ?, contact = ?, details = ?, pgp = ?, lat = ?, lon = ?, status = ?,
+updated = ?
+WHERE address = ?`,
+		node.OwnerName, node.Contact,
 		node.Details, []byte(node.PGP),
-		node.Latitude, node.Longitude, node.Status, []byte(node.Addr))
-	stmt.Close()
+		node.Latitude, node.Longitude, node.Status,
+		time.Now().Unix(), []byte(node.Addr))
 	return
 }
 
 // DeleteNode removes the node with the matching IP from the 'nodes'
-// table in the database.
+// table in the database, and leaves a tombstone in its place so that
+// the deletion can be reported by DumpDeleted. If there is no such
+// node, it returns sql.ErrNoRows.
 func (db DB) DeleteNode(addr IP) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+
+	if err = deleteNode(tx, addr); err != nil {
+		tx.Rollback()
+		return
+	}
+	return tx.Commit()
+}
+
+// deleteNode removes the node with the matching IP from the 'nodes'
+// table and replaces any old tombstone for the same address with a
+// new one. It should be used within a transaction, so that the two
+// cannot be separated. If there is no such node, it returns
+// sql.ErrNoRows.
+func deleteNode(e Execer, addr IP) (err error) {
 	// Deletes the given node from the database
-	stmt, err := db.Prepare("DELETE FROM nodes WHERE address = ?")
+	res, err := e.Exec("DELETE FROM nodes WHERE address = ?",
+		[]byte(addr))
 	if err != nil {
 		return
 	}
-	_, err = stmt.Exec([]byte(addr))
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return addTombstone(e, addr, 0)
+}
 
-	stmt.Close()
+// ImportNodes adds, updates, and deletes the given local nodes in a
+// single transaction, recording each change in the history with no
+// actor. If any change cannot be made, none are.
+func (db DB) ImportNodes(added, updated, deleted []*Node) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+
+	for _, node := range added {
+		if err = addNode(tx, node); err == nil {
+			err = recordChangeIn(tx, ActionAdd, "", node)
+		}
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+	for _, node := range updated {
+		if err = updateNode(tx, node); err == nil {
+			err = recordChangeIn(tx, ActionUpdate, "", node)
+		}
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+	for _, node := range deleted {
+		if err = deleteNode(tx, node.Addr); err == nil {
+			err = recordChangeIn(tx, ActionDelete, "", node)
+		}
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+	return tx.Commit()
+}
+
+// Tombstone marks the deletion of a node, so that consumers of
+// DumpChanges can learn of nodes which no longer exist.
+type Tombstone struct {
+	// SourceID is the local ID of the source map of the deleted
+	// node, as in Node. Source is the hostname of that map, or
+	// "local", as nodes are keyed in /api/all, and is set only when
+	// tombstones are served to parent maps, so that they remove only
+	// the copy from that source. Tombstones from child maps which do
+	// not give it have the SourceID anySource.
+	SourceID int    `json:"-"`
+	Source   string `json:",omitempty"`
+
+	Addr    IP
+	Deleted time.Time
+}
+
+// anySource is the SourceID of a Tombstone which does not identify
+// the source of the deleted node, so that every copy of it cached
+// through the same child map is removed.
+const anySource = -1
+
+// ClearTombstone removes the tombstone for the given address, if
+// there is one.
+func (db DB) ClearTombstone(addr IP) (err error) {
+	return clearTombstone(db, addr)
+}
+
+func clearTombstone(e Execer, addr IP) (err error) {
+	_, err = e.Exec("DELETE FROM nodes_deleted WHERE address = ?",
+		[]byte(addr))
 	return
 }
 
+// addTombstone records that the node with the given address and
+// source ID has just been deleted, replacing any older tombstone for
+// the same address.
+func addTombstone(e Execer, addr IP, source int) (err error) {
+	if err = clearTombstone(e, addr); err != nil {
+		return
+	}
+	_, err = e.Exec(`INSERT INTO nodes_deleted
+(address, source, deleted)
+VALUES(?, ?, ?)`, []byte(addr), source, time.Now().Unix())
+	return
+}
+
+// DumpDeleted returns tombstones for all nodes which have been
+// deleted more recently than the given time, and whose tombstones
+// have not yet expired.
+func (db DB) DumpDeleted(since time.Time) (tombstones []*Tombstone, err error) {
+	rows, err := db.Query(`
+SELECT address,source,deleted
+FROM nodes_deleted WHERE deleted >= ?;`, since.Unix())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	tombstones = make([]*Tombstone, 0)
+	for rows.Next() {
+		tombstone := new(Tombstone)
+		var deleted int64
+		err = rows.Scan(&tombstone.Addr, &tombstone.SourceID, &deleted)
+		if err != nil {
+			return
+		}
+		tombstone.Deleted = time.Unix(deleted, 0)
+		tombstones = append(tombstones, tombstone)
+	}
+	return tombstones, rows.Err()
+}
+
+// DeleteExpiredTombstones removes tombstones which are older than
+// Conf.CacheExpiration, because any consumer which has synchronized
+// within that time will have seen them already.
+func (db DB) DeleteExpiredTombstones() (err error) {
+	res, err := db.Exec(`DELETE FROM nodes_deleted
+WHERE deleted < ?;`,
+		time.Now().Add(-time.Duration(Conf.CacheExpiration)).Unix())
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	return recordRemoval(db)
+}
+
 // GetNode retrieves a single node from the database using the given
-// address. If there is a database error, it will be returned. If no
-// node matches, however, both return values will be nil.
+// address. If it is known from more than one source, the copy which
+// takes precedence is returned, as described by FindConflicts. If
+// there is a database error, it will be returned. If no node matches,
+// however, both return values will be nil.
 func (db DB) GetNode(addr IP) (node *Node, err error) {
-	// Retrieves the node with the given address from the database
-	stmt, err := db.Prepare(`
-SELECT owner, email, contact, details, pgp, lat, lon, status
+	baddr := []byte(addr)
+	rows, err := db.Query(`
+SELECT owner, email, contact, details, pgp, lat, lon, status, 0,
+'local', updated, 0
 FROM nodes
 WHERE address = ?
-UNION
-SELECT owner, "", "", details, "", lat, lon, status
-FROM nodes_cached
-WHERE address = ?
-LIMIT 1`)
+UNION ALL
+SELECT owner, '', '', details, '', lat, lon, status, source,
+COALESCE((SELECT s.hostname FROM cached_maps AS s
+WHERE s.id = nodes_cached.source), ''),
+retrieved, `+cachedStale+`
+FROM nodes_cached`+cachedMapsJoin+`
+WHERE address = ?;`, baddr, baddr)
 	if err != nil {
 		return
 	}
+	defer rows.Close()
+
+	var copies nodeCopies
+	for rows.Next() {
+		// Initialize the node and temporary variables.
+		c := &NodeCopy{Node: &Node{Addr: addr}}
+		contact := sql.NullString{}
+		details := sql.NullString{}
+		var changed int64
+
+		err = rows.Scan(&c.OwnerName, &c.OwnerEmail,
+			&contact, &details, &c.PGP,
+			&c.Latitude, &c.Longitude, &c.Status, &c.SourceID,
+			&c.Source, &changed, &c.Stale)
+		if err != nil {
+			return
+		}
+		c.Contact = contact.String
+		c.Details = details.String
+		if c.SourceID != 0 {
+			c.RetrieveTime = changed
+		}
+		c.Updated = time.Unix(changed, 0)
+
+		copies = append(copies, c)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	if c := preferredCopy(copies); c != nil {
+		node = c.Node
+	}
+	return
+}
+
+// GetLocalNode retrieves a single local node from the database using
+// the given address, including its owner's email address, regardless
+// of whether a cached copy takes precedence. If no node matches, both
+// return values will be nil.
+func (db DB) GetLocalNode(addr IP) (node *Node, err error) {
+	row := db.QueryRow(`
+SELECT owner, email, contact, details, pgp, lat, lon, status
+FROM nodes
+WHERE address = ?;`, []byte(addr))
 
-	// Initialize the node and temporary variable.
 	node = &Node{Addr: addr}
-	baddr := []byte(addr)
 	contact := sql.NullString{}
 	details := sql.NullString{}
-
-	// Perform the actual query.
-	row := stmt.QueryRow(baddr, baddr)
 	err = row.Scan(&node.OwnerName, &node.OwnerEmail,
 		&contact, &details, &node.PGP,
 		&node.Latitude, &node.Longitude, &node.Status)
-	stmt.Close()
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
 
 	node.Contact = contact.String
 	node.Details = details.String
+	return
+}
 
-	// If the error is of the particular type sql.ErrNoRows, it simply
-	// means that the node does not exist. In that case, return (nil,
-	// nil).
-	if err == sql.ErrNoRows {
-		return nil, nil
+// DumpDuplicates returns every copy of each node whose address is
+// known from more than one source, ordered by address and then source
+// ID, along with the time at which each copy was last updated, if it
+// is local, or retrieved, if it is cached.
+func (db DB) DumpDuplicates() (nodes []*Node, updated []time.Time, err error) {
+	rows, err := db.Query(`
+SELECT address,owner,contact,details,pgp,lat,lon,status,source,changed,
+stale
+FROM (SELECT address,owner,contact,details,pgp,lat,lon,status,
+0 AS source,updated AS changed,0 AS stale
+FROM nodes
+UNION ALL SELECT address,owner,'',details,'',lat,lon,status,
+source,retrieved,` + cachedStale + `
+FROM nodes_cached` + cachedMapsJoin + `) AS n
+WHERE address IN (SELECT address
+FROM (SELECT address FROM nodes
+UNION ALL SELECT address FROM nodes_cached) AS a
+GROUP BY address HAVING COUNT(*) > 1)
+ORDER BY address,source;`)
+	if err != nil {
+		return
 	}
+	defer rows.Close()
 
-	return
+	for rows.Next() {
+		node := new(Node)
+		contact := sql.NullString{}
+		details := sql.NullString{}
+		var changed int64
+
+		err = rows.Scan(&node.Addr, &node.OwnerName,
+			&contact, &details, &node.PGP,
+			&node.Latitude, &node.Longitude, &node.Status,
+			&node.SourceID, &changed, &node.Stale)
+		if err != nil {
+			return
+		}
+		node.Contact = contact.String
+		node.Details = details.String
+		if node.SourceID != 0 {
+			node.RetrieveTime = changed
+		}
+
+		nodes = append(nodes, node)
+		updated = append(updated, time.Unix(changed, 0))
+	}
+	return nodes, updated, rows.Err()
 }
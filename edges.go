@@ -2,31 +2,50 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"github.com/inhies/go-cjdns/admin"
 	"net"
+	"sort"
 	"strings"
+	"time"
 )
 
 var NetworkAdminNotConnectedError = errors.New("Network admin interface not connected")
 var NetworkAdminCredentialsMissingError = errors.New("Network admin credentials missing")
 var NetworkAdminCredentialsInvalidError = errors.New("Network admin credentials invalid")
 
-var KnownPeers []Pair
-
+// Pair is a link between two nodes, where A is the lesser IP.
 type Pair struct {
 	A IP
 	B IP
+
+	// FirstSeen is the time at which the link was first found, or
+	// found again after it dropped, and LastSeen the time at which it
+	// was most recently found. Dropped is the time at which it was
+	// first found to be missing, or zero while it is present. Each
+	// time a link is found again is a separate appearance, with its
+	// own Pair.
+	FirstSeen, LastSeen, Dropped time.Time
+
+	// Quality is the quality of the link when it was last seen, from
+	// 0 to 1, or 0 if it is not known. If it was found from both of
+	// its ends, or by several backends, it is the best quality given.
+	Quality float64 `json:",omitempty"`
 }
 
 type Peers struct {
 	Source       IP
 	Destinations []IP
+
+	// Quality, if not nil, gives the quality of the link to each of
+	// the Destinations, from 0 for unusable to 1 for perfect.
+	Quality []float64
 }
 
 type Network interface {
-	// Connect initializes the object and connects to whatever
-	// administration interfaces necessary.
-	Connect(*Config) error
+	// Connect initializes the object from the given configuration and
+	// connects to whatever administration interfaces necessary.
+	Connect(*NetworkAdminConfig) error
 
 	// Close closes any open connections and removes any stored
 	// passwords.
@@ -42,21 +61,124 @@ type Network interface {
 	PeersOfAll([]IP) ([]*Peers, error)
 }
 
+// NetworkValidator is implemented by Networks which can check their
+// configuration without connecting, so that mistakes are found when
+// the configuration is read.
+type NetworkValidator interface {
+	Validate(*NetworkAdminConfig) error
+}
+
+// NetworkAddressRange is implemented by Networks whose nodes all have
+// addresses within a known range, so that nodes outside of it can be
+// refused.
+type NetworkAddressRange interface {
+	AddressRange() *net.IPNet
+}
+
+// UnknownNetworkError is returned when a network backend is
+// configured with a type which has not been registered.
+type UnknownNetworkError struct {
+	Type string
+}
+
+func (err UnknownNetworkError) Error() string {
+	return fmt.Sprintf("unknown NetworkAdmin type %q; known types are %s",
+		err.Type, strings.Join(NetworkTypes(), ", "))
+}
+
+// networks maps the lowercase names of network backends to functions
+// which create them.
+var networks = make(map[string]func() Network)
+
+// RegisterNetwork makes a network backend available by the given
+// name, which is matched against NetworkAdmin types without regard
+// to case. The given function must return a new, unconnected Network
+// each time it is called. If a backend is registered twice with the
+// same name, it panics.
+func RegisterNetwork(name string, create func() Network) {
+	name = strings.ToLower(name)
+	if _, ok := networks[name]; ok {
+		panic("network backend registered twice: " + name)
+	}
+	networks[name] = create
+}
+
+// NetworkTypes returns the sorted names of every registered network
+// backend.
+func NetworkTypes() (types []string) {
+	types = make([]string, 0, len(networks))
+	for name := range networks {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	return
+}
+
+// NewNetwork creates an unconnected Network of the type given by the
+// configuration, or returns UnknownNetworkError.
+func NewNetwork(conf *NetworkAdminConfig) (Network, error) {
+	create, ok := networks[strings.ToLower(conf.Type)]
+	if !ok {
+		return nil, UnknownNetworkError{conf.Type}
+	}
+	return create(), nil
+}
+
+// CheckNetworkAdmin returns an error if any of the network backends
+// given by the configuration are not registered, or are not
+// configured correctly, as far as can be told without connecting.
+func CheckNetworkAdmin(conf *Config) error {
+	for i := range conf.NetworkAdmin {
+		network, err := NewNetwork(&conf.NetworkAdmin[i])
+		if err != nil {
+			return err
+		}
+		if v, ok := network.(NetworkValidator); ok {
+			if err = v.Validate(&conf.NetworkAdmin[i]); err != nil {
+				return fmt.Errorf("NetworkAdmin %q: %s",
+					conf.NetworkAdmin[i].Type, err)
+			}
+		}
+	}
+	return nil
+}
+
+// NetworkRanges returns the address ranges of the network backends
+// given by the configuration, if every one of them implements
+// NetworkAddressRange. If any does not, such as static, whose
+// nodes may have any address, it returns nil, so that no range is
+// enforced. Backends which are not registered are skipped.
+func NetworkRanges(conf *Config) (ranges []*net.IPNet) {
+	for i := range conf.NetworkAdmin {
+		network, err := NewNetwork(&conf.NetworkAdmin[i])
+		if err != nil {
+			continue
+		}
+		r, ok := network.(NetworkAddressRange)
+		if !ok {
+			return nil
+		}
+		ranges = append(ranges, r.AddressRange())
+	}
+	return
+}
+
+func init() {
+	RegisterNetwork("cjdns", func() Network { return &CJDNSNetwork{} })
+}
+
 // PopulateRoutes finds the peers of every known node in the
-// database. It is blocking, and may wait on network IO.
-func PopulatePeers(db DB) {
-	if Conf.NetworkAdmin == nil {
+// database from each of the configured network backends, and records
+// the links which any of them find with Store.UpdatePeers. If any
+// backend fails, nothing is recorded, so that its links are not
+// thought to have dropped. It is blocking, and may wait on network
+// IO.
+func PopulatePeers(db Store) {
+	if len(Conf.NetworkAdmin) == 0 {
 		l.Infoln("Network admin interface not specified; skipping")
 		return
 	}
 
-	// Choose which kind of network to connect to.
-	var network Network
-	switch strings.ToLower(Conf.NetworkAdmin.Type) {
-	case "cjdns":
-		network = &CJDNSNetwork{}
-	}
-
 	// Dump all the nodes in the database.
 	nodes, err := db.DumpNodes()
 	if err != nil {
@@ -70,41 +192,160 @@ func PopulatePeers(db DB) {
 		ips[i] = node.Addr
 	}
 
-	// Connect to the network and find the peers for the whole list of
-	// IPs.
-	err = network.Connect(Conf)
-	if err != nil {
-		l.Errf("Error listing peers: %s", err)
+	// Flatten the peer network from every backend into a single set
+	// of pairs. Remove duplicates by always putting the node with the
+	// lesser IP first, so that links found from either end, or by
+	// several backends, are the same.
+	found := make(map[string]int)
+	pairs := make([]Pair, 0, len(ips))
+	for i := range Conf.NetworkAdmin {
+		conf := &Conf.NetworkAdmin[i]
+		peers, err := peersFromNetwork(conf, ips)
+		if err != nil {
+			l.Errf("Error listing peers from %q: %s", conf.Type, err)
+			return
+		}
+		for _, peer := range peers {
+			if peer == nil {
+				continue
+			}
+			for j, destinationIP := range peer.Destinations {
+				pair := Pair{A: peer.Source, B: destinationIP}
+				if destinationIP.LessThan(peer.Source) {
+					pair.A, pair.B = destinationIP, peer.Source
+				} else if !peer.Source.LessThan(destinationIP) {
+					// Nodes are not linked to themselves.
+					continue
+				}
+				if j < len(peer.Quality) {
+					pair.Quality = peer.Quality[j]
+				}
+
+				key := peerKey(pair)
+				if k, ok := found[key]; !ok {
+					found[key] = len(pairs)
+					pairs = append(pairs, pair)
+				} else if pair.Quality > pairs[k].Quality {
+					pairs[k].Quality = pair.Quality
+				}
+			}
+		}
+	}
+
+	if err = db.UpdatePeers(pairs, time.Now()); err != nil {
+		l.Errf("Error storing peers: %s", err)
 		return
 	}
-	peers, err := network.PeersOfAll(ips)
+	l.Infof("Peering data refreshed")
+}
+
+// peersFromNetwork connects to the network backend given by the
+// configuration, finds the peers of each of the given IPs, and closes
+// it again.
+func peersFromNetwork(conf *NetworkAdminConfig, ips []IP) (peers []*Peers, err error) {
+	network, err := NewNetwork(conf)
 	if err != nil {
-		l.Errf("Error listing peers: %s", err)
 		return
 	}
+	if err = network.Connect(conf); err != nil {
+		return
+	}
+	defer network.Close()
+	return network.PeersOfAll(ips)
+}
+
+// linkTable holds the links found by a Network which reads all of them
+// at once when it connects. Such Networks embed it to implement
+// Close, PeersOf, and PeersOfAll.
+type linkTable struct {
+	// peers maps the address of each node which was found to the
+	// addresses of the nodes linked to it, and quality maps it to the
+	// qualities of those links, in the same order. They are nil until
+	// reset is called.
+	peers   map[string][]IP
+	quality map[string][]float64
+}
+
+// reset empties the table, so that it is ready for links to be added.
+func (t *linkTable) reset() {
+	t.peers = make(map[string][]IP)
+	t.quality = make(map[string][]float64)
+}
+
+// link records a link between the nodes with the given addresses, of
+// the given quality from 0 to 1, or 0 if it is not known. If the link
+// is already known, its quality is raised if the given one is better.
+// Links to invalid addresses, or from a node to itself, are ignored.
+func (t *linkTable) link(a, b net.IP, quality float64) {
+	if a == nil || b == nil || a.Equal(b) {
+		return
+	}
+	t.add(a, b, quality)
+	t.add(b, a, quality)
+}
 
-	// Allocate a set of pairs with enough capacity to hold the entire
-	// list of peers, assuming each one has two connections.
-	pairs := make([]Pair, 0, len(peers))
-
-	// Flatten the peer network. Remove duplicates by only adding a
-	// connection between nodes if they are already sorted such that
-	// the node with the lesser IP is first.
-	// TODO(DuoNoxSol): Only discard them in this way if both nodes
-	// are in the map
-	for _, peer := range peers {
-		for _, destinationIP := range peer.Destinations {
-			if peer.Source.LessThan(destinationIP) {
-				pairs = append(pairs, Pair{
-					A: peer.Source,
-					B: destinationIP,
-				})
+// add records the link from a to b for link.
+func (t *linkTable) add(a, b net.IP, quality float64) {
+	key := a.String()
+	for i, known := range t.peers[key] {
+		if b.Equal(net.IP(known)) {
+			if quality > t.quality[key][i] {
+				t.quality[key][i] = quality
 			}
+			return
 		}
 	}
+	t.peers[key] = append(t.peers[key], IP(b))
+	t.quality[key] = append(t.quality[key], quality)
+}
 
-	l.Infof("Peering data refreshed")
-	KnownPeers = pairs
+func (t *linkTable) Close() error {
+	t.peers = nil
+	t.quality = nil
+	return nil
+}
+
+func (t *linkTable) PeersOf(ip IP) (peers *Peers, err error) {
+	if t.peers == nil {
+		return nil, NetworkAdminNotConnectedError
+	}
+	key := ip.String()
+	return &Peers{
+		Source:       ip,
+		Destinations: t.peers[key],
+		Quality:      t.quality[key],
+	}, nil
+}
+
+func (t *linkTable) PeersOfAll(ips []IP) (peers []*Peers, err error) {
+	peers = make([]*Peers, len(ips))
+	for i, ip := range ips {
+		peers[i], err = t.PeersOf(ip)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// socketAddress parses the address of a socket given as
+// "unix:///path" or "tcp://host:port", and returns its network and
+// address as given to net.Dial.
+func socketAddress(s string) (network, address string, ok bool) {
+	switch {
+	case strings.HasPrefix(s, "unix://"):
+		network, address = "unix", strings.TrimPrefix(s, "unix://")
+	case strings.HasPrefix(s, "tcp://"):
+		network, address = "tcp", strings.TrimPrefix(s, "tcp://")
+	}
+	return network, address, len(address) > 0
+}
+
+// CJDNSRange is the range of the addresses of nodes on cjdns,
+// fc00::/8.
+var CJDNSRange = &net.IPNet{
+	IP:   net.ParseIP("fc00::"),
+	Mask: net.CIDRMask(8, 8*net.IPv6len),
 }
 
 type CJDNSNetwork struct {
@@ -122,18 +363,11 @@ type CJDNSNetwork struct {
 	Routes admin.Routes
 }
 
-func (n *CJDNSNetwork) Connect(conf *Config) (err error) {
-	// Check to make sure that the credentials can be retrieved. If
-	// not, error and exit.
-	if conf.NetworkAdmin == nil ||
-		conf.NetworkAdmin.Credentials == nil {
-		return NetworkAdminCredentialsMissingError
-	}
-
-	// Try to cast the credentials to the appropriate type. If this
-	// fails, report them invalid.
-	credentials, err := makeCJDNSAdminConfig(
-		conf.NetworkAdmin.Credentials)
+func (n *CJDNSNetwork) Connect(conf *NetworkAdminConfig) (err error) {
+	// Check to make sure that the credentials can be retrieved, and
+	// try to cast them to the appropriate type. If this fails, report
+	// them missing or invalid.
+	credentials, err := cjdnsCredentials(conf)
 	if err != nil {
 		return
 	}
@@ -145,6 +379,26 @@ func (n *CJDNSNetwork) Connect(conf *Config) (err error) {
 	return
 }
 
+// Validate checks that the credentials can be used to connect.
+func (n *CJDNSNetwork) Validate(conf *NetworkAdminConfig) (err error) {
+	_, err = cjdnsCredentials(conf)
+	return
+}
+
+// cjdnsCredentials returns the credentials of the given configuration
+// as a *admin.CjdnsAdminConfig.
+func cjdnsCredentials(conf *NetworkAdminConfig) (*admin.CjdnsAdminConfig, error) {
+	if conf.Credentials == nil {
+		return nil, NetworkAdminCredentialsMissingError
+	}
+	return makeCJDNSAdminConfig(conf.Credentials)
+}
+
+// AddressRange returns CJDNSRange.
+func (n *CJDNSNetwork) AddressRange() *net.IPNet {
+	return CJDNSRange
+}
+
 func (n *CJDNSNetwork) Close() error {
 	n.connected = false
 	return n.conn.Conn.Close()
@@ -0,0 +1,89 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+)
+
+// EncodeNodes writes the given Nodes to the given io.Writer in the
+// given format, so that they can be read again by DecodeNodes.
+func EncodeNodes(w io.Writer, format string, nodes []*Node) (err error) {
+	switch format {
+	case FormatJSON:
+		return json.NewEncoder(w).Encode(nodes)
+	case FormatGeoJSON:
+		return json.NewEncoder(w).Encode(FeatureCollectionNodes(nodes))
+	case FormatCSV:
+		return encodeCSV(w, nodes)
+	default:
+		return InvalidFormatError
+	}
+}
+
+// encodeCSV writes the given Nodes to the given io.Writer as a table
+// with a header row, using the columns in CSVColumns.
+func encodeCSV(w io.Writer, nodes []*Node) (err error) {
+	cw := csv.NewWriter(w)
+	if err = cw.Write(CSVColumns); err != nil {
+		return
+	}
+
+	for _, node := range nodes {
+		err = cw.Write([]string{
+			node.Addr.String(),
+			node.OwnerName,
+			node.Contact,
+			node.Details,
+			node.PGP.String(),
+			strconv.FormatFloat(node.Latitude, 'f', -1, 64),
+			strconv.FormatFloat(node.Longitude, 'f', -1, 64),
+			strconv.FormatUint(uint64(node.Status), 10),
+		})
+		if err != nil {
+			return
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ExportFile writes the local nodes, or all nodes including cached
+// ones if useCached is true, to a file at the given path in the given
+// format, and returns the number of nodes written. If the format is
+// empty, it is guessed from the extension. The file is created or
+// truncated. Owners' email addresses are never exported.
+func ExportFile(path, format string, useCached bool) (n int, err error) {
+	if len(format) == 0 {
+		format = FormatFromPath(path)
+	} else if format != FormatJSON && format != FormatGeoJSON &&
+		format != FormatCSV {
+		return 0, InvalidFormatError
+	}
+
+	var nodes []*Node
+	if useCached {
+		nodes, err = Db.DumpNodes()
+	} else {
+		nodes, err = Db.DumpLocal()
+	}
+	if err != nil {
+		return
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return
+	}
+
+	err = EncodeNodes(f, format, nodes)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return len(nodes), err
+}
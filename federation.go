@@ -0,0 +1,323 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultCrawlDepth is the number of levels below the direct child
+// maps which are crawled if Conf.Aggregator.MaxDepth is not given.
+const defaultCrawlDepth = 8
+
+// FederationNode is a map in the tree of maps which this one caches
+// nodes from, directly or through others.
+type FederationNode struct {
+	Name, Address string
+
+	// NodeCount is the number of nodes known from the map itself,
+	// not including those it relays from its own child maps.
+	NodeCount int
+
+	// LastSync is the time at which the nodes of the map were last
+	// retrieved, either from it or through the map which relays
+	// them. It is zero for this map.
+	LastSync time.Time
+
+	Children []*FederationNode `json:",omitempty"`
+}
+
+// childMapsByHostname implements sort.Interface to sort child maps by
+// their addresses, so that the tree is in a consistent order.
+type childMapsByHostname []*ChildMap
+
+func (c childMapsByHostname) Len() int           { return len(c) }
+func (c childMapsByHostname) Less(i, j int) bool { return c[i].Hostname < c[j].Hostname }
+func (c childMapsByHostname) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// BuildFederation returns the tree of maps whose nodes are cached,
+// with this one at its root, and the child maps given by
+// ChildMapConfigs below it. Each other map is placed below the map
+// through which it is relayed. Maps which are relayed in a loop, or
+// through a map which is no longer synced, are left out.
+func BuildFederation() (root *FederationNode, err error) {
+	childMaps, err := Db.DumpChildMaps()
+	if err != nil {
+		return
+	}
+	counts, err := Db.CountSources()
+	if err != nil {
+		return
+	}
+	configs, err := childMapConfigs(childMaps)
+	if err != nil {
+		return
+	}
+	direct := make(map[string]bool, len(configs))
+	for _, config := range configs {
+		direct[config.Address] = true
+	}
+
+	sort.Sort(childMapsByHostname(childMaps))
+	children := make(map[int][]*ChildMap, len(childMaps))
+	for _, childMap := range childMaps {
+		if !direct[childMap.Hostname] {
+			children[childMap.ParentID] = append(
+				children[childMap.ParentID], childMap)
+		}
+	}
+
+	// Each map is placed at most once, so that loops end.
+	placed := make(map[int]bool, len(childMaps))
+	var build func(parent *FederationNode, childMap *ChildMap)
+	build = func(parent *FederationNode, childMap *ChildMap) {
+		placed[childMap.ID] = true
+		node := &FederationNode{
+			Name:      childMap.Name,
+			Address:   childMap.Hostname,
+			NodeCount: counts[childMap.ID],
+			LastSync:  childMap.LastSync,
+		}
+		if node.LastSync.IsZero() {
+			node.LastSync = parent.LastSync
+		}
+		parent.Children = append(parent.Children, node)
+		for _, child := range children[childMap.ID] {
+			if !placed[child.ID] {
+				build(node, child)
+			}
+		}
+	}
+
+	root = &FederationNode{
+		Name:      Conf.Name,
+		Address:   Conf.Web.Hostname,
+		NodeCount: counts[0],
+	}
+	for _, childMap := range childMaps {
+		if direct[childMap.Hostname] {
+			placed[childMap.ID] = true
+		}
+	}
+	for _, childMap := range childMaps {
+		if direct[childMap.Hostname] {
+			build(root, childMap)
+		}
+	}
+	return
+}
+
+// recordRelayed records that the maps with the given IDs are relayed
+// through the given child map, unless they are synced directly, or
+// are already known to be relayed through a map which it relays in
+// turn, such as by CrawlFederation.
+func recordRelayed(childMap *ChildMap, ids []int) (err error) {
+	childMaps, err := Db.DumpChildMaps()
+	if err != nil {
+		return
+	}
+	byID := make(map[int]*ChildMap, len(childMaps))
+	for _, c := range childMaps {
+		byID[c.ID] = c
+	}
+
+	for _, id := range ids {
+		relayed := byID[id]
+		if id == childMap.ID || relayed == nil ||
+			!relayed.LastSync.IsZero() ||
+			isRelayedThrough(byID, relayed.ParentID, childMap.ID) {
+			continue
+		}
+		if err = Db.UpdateMapParent(id, childMap.ID); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// isRelayedThrough reports whether the map with the given ID is, or
+// is relayed through, the one with the ID through. Loops in the
+// parents of the maps are ignored.
+func isRelayedThrough(byID map[int]*ChildMap, id, through int) bool {
+	seen := make(map[int]bool)
+	for id != 0 && !seen[id] {
+		if id == through {
+			return true
+		}
+		seen[id] = true
+		if byID[id] == nil {
+			break
+		}
+		id = byID[id].ParentID
+	}
+	return false
+}
+
+// CrawlFederation discovers the maps below the child maps given by
+// ChildMapConfigs, by recursively retrieving /api/child_maps from each
+// map which is synced by another, up to Conf.Aggregator.MaxDepth
+// levels down. The map through which each is relayed is recorded, so
+// that BuildFederation can give the whole tree, even where maps relay
+// many levels of others. Each map is crawled at most once, so that
+// loops end. Maps which cannot be crawled are logged and skipped.
+func CrawlFederation() (err error) {
+	configs, err := ChildMapConfigs()
+	if err != nil {
+		return
+	}
+	ids, err := Db.GetMapSourceToID()
+	if err != nil {
+		return
+	}
+
+	c := &crawler{
+		sources:  &sourceIDs{ids: ids},
+		direct:   make(map[string]bool, len(configs)),
+		crawled:  make(map[string]bool),
+		maxDepth: Conf.Aggregator.MaxDepth,
+	}
+	if c.maxDepth <= 0 {
+		c.maxDepth = defaultCrawlDepth
+	}
+	c.direct[strings.TrimRight(Conf.Web.Hostname, "/")] = true
+	for _, config := range configs {
+		c.direct[strings.TrimRight(config.Address, "/")] = true
+	}
+	for _, config := range configs {
+		c.crawl(config.Address, 0)
+	}
+	return
+}
+
+// crawler holds the state of CrawlFederation.
+type crawler struct {
+	sources *sourceIDs
+
+	// direct contains the addresses of this map and those which it
+	// syncs directly, whose parents are never recorded, and crawled
+	// those of the maps which have been crawled already.
+	direct, crawled map[string]bool
+
+	maxDepth int
+}
+
+// crawl records the parents of the maps listed by the map at the
+// given address, which is the given number of levels below the direct
+// child maps, and then crawls those which it syncs directly.
+func (c *crawler) crawl(address string, depth int) {
+	key := strings.TrimRight(address, "/")
+	if c.crawled[key] || depth > c.maxDepth {
+		return
+	}
+	c.crawled[key] = true
+
+	listed, err := FetchChildMaps(address)
+	if err != nil {
+		l.Errf("Crawling %q produced: %s", address, err)
+		return
+	}
+
+	next := make([]string, 0, len(listed))
+	for _, childMap := range listed {
+		if len(childMap.Hostname) == 0 ||
+			c.direct[strings.TrimRight(childMap.Hostname, "/")] {
+			continue
+		}
+
+		// The map is relayed through the one which listed it, unless
+		// that one relays it from another in turn.
+		parent := address
+		if len(childMap.Parent) > 0 {
+			parent = childMap.Parent
+		}
+		id, err := c.sources.ID(childMap.Hostname, childMap.Name)
+		if err != nil {
+			l.Errf("Error while crawling %q: %s", address, err)
+			return
+		}
+		parentID, err := c.sources.ID(parent, "")
+		if err != nil {
+			l.Errf("Error while crawling %q: %s", address, err)
+			return
+		}
+		if id != parentID {
+			if err = Db.UpdateMapParent(id, parentID); err != nil {
+				l.Errf("Error while crawling %q: %s", address, err)
+				return
+			}
+		}
+
+		if len(childMap.Parent) == 0 && !childMap.LastSync.IsZero() {
+			next = append(next, childMap.Hostname)
+		}
+	}
+	for _, child := range next {
+		c.crawl(child, depth+1)
+	}
+}
+
+// childMapsWrapper wraps a response from /api/child_maps.
+type childMapsWrapper struct {
+	Data  []*ChildMap `json:"data"`
+	Error interface{} `json:"error"`
+}
+
+// FetchChildMaps retrieves the child maps of the map at the given
+// address from its /api/child_maps.
+func FetchChildMaps(address string) (childMaps []*ChildMap, err error) {
+	f, err := fetch(strings.TrimRight(address, "/")+"/api/child_maps",
+		Validators{})
+	if err != nil {
+		return
+	}
+
+	var jresp childMapsWrapper
+	if err = json.Unmarshal(f.Body, &jresp); err != nil {
+		return
+	} else if jresp.Error != nil {
+		return nil, fmt.Errorf("remote error: %v", jresp.Error)
+	}
+	return jresp.Data, nil
+}
+
+// UpdateMapParent records that the map with the given ID is relayed
+// through the one with the ID parent.
+func (db DB) UpdateMapParent(id, parent int) (err error) {
+	_, err = db.Exec(`UPDATE cached_maps
+SET parent = ? WHERE id = ?;`, parent, id)
+	return
+}
+
+// CountSources returns the number of nodes known from each source, by
+// its ID, including every copy of nodes which are known from several.
+// Local nodes have the ID 0.
+func (db DB) CountSources() (counts map[int]int, err error) {
+	counts = make(map[int]int)
+	var local int
+	if err = db.QueryRow(`SELECT COUNT(*) FROM nodes;`).Scan(&local); err != nil {
+		return
+	}
+	counts[0] = local
+
+	rows, err := db.Query(`SELECT source, COUNT(*)
+FROM nodes_cached
+GROUP BY source;`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var source, n int
+		if err = rows.Scan(&source, &n); err != nil {
+			return
+		}
+		counts[source] += n
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,122 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"errors"
+)
+
+var (
+	InvalidFilterBBoxError = errors.New(
+		"filter BBox must be [minLon, minLat, maxLon, maxLat] within range")
+	InvalidPolygonError = errors.New(
+		"filter Polygon must be at least three [lon, lat] points within range")
+)
+
+// ImportFilter restricts which of the nodes retrieved from a child
+// map are cached. A node is cached only if it passes every part of
+// the filter which is given.
+type ImportFilter struct {
+	// BBox, if given, is the bounding box [minLon, minLat, maxLon,
+	// maxLat], as in GeoJSON, which nodes must be within. If minLon
+	// is greater than maxLon, it crosses the antimeridian.
+	BBox []float64 `json:",omitempty"`
+
+	// Polygon, if given, is a list of [lon, lat] points, as in
+	// GeoJSON, which nodes must be within. It is closed
+	// automatically, and must not cross the antimeridian.
+	Polygon [][]float64 `json:",omitempty"`
+
+	// StatusRequired is the status bits which nodes must all have,
+	// and StatusForbidden those which they must have none of, such as
+	// StatusActive to exclude planned nodes.
+	StatusRequired  uint32 `json:",omitempty"`
+	StatusForbidden uint32 `json:",omitempty"`
+
+	// ExcludeSources is a list of addresses of sources whose nodes
+	// are never cached, such as the child maps of the child map. Its
+	// own nodes have its own address.
+	ExcludeSources []string `json:",omitempty"`
+}
+
+// Validate checks that BBox and Polygon are within range. Filters
+// which are not valid allow no nodes.
+func (f *ImportFilter) Validate() (err error) {
+	if f == nil {
+		return nil
+	}
+	if f.BBox != nil {
+		if _, err = f.bbox(); err != nil {
+			return
+		}
+	}
+	if f.Polygon != nil {
+		if len(f.Polygon) < 3 {
+			return InvalidPolygonError
+		}
+		for _, point := range f.Polygon {
+			if len(point) != 2 || !validLon(point[0]) || !validLat(point[1]) {
+				return InvalidPolygonError
+			}
+		}
+	}
+	return nil
+}
+
+// Allows reports whether the given node, which was retrieved from the
+// source with the given address, passes the filter. A nil filter
+// allows every node.
+func (f *ImportFilter) Allows(node *Node, source string) bool {
+	if f == nil {
+		return true
+	}
+	if node.Status&f.StatusRequired != f.StatusRequired ||
+		node.Status&f.StatusForbidden != 0 {
+		return false
+	}
+	for _, excluded := range f.ExcludeSources {
+		if excluded == source {
+			return false
+		}
+	}
+	if f.BBox != nil {
+		area, err := f.bbox()
+		if err != nil || !area.Contains(node.Latitude, node.Longitude) {
+			return false
+		}
+	}
+	if f.Polygon != nil && (f.Validate() != nil ||
+		!polygonContains(f.Polygon, node.Latitude, node.Longitude)) {
+		return false
+	}
+	return true
+}
+
+// bbox returns BBox as an Area.
+func (f *ImportFilter) bbox() (*Area, error) {
+	if len(f.BBox) != 4 {
+		return nil, InvalidFilterBBoxError
+	}
+	area, err := NewBBox(f.BBox[0], f.BBox[1], f.BBox[2], f.BBox[3])
+	if err != nil {
+		return nil, InvalidFilterBBoxError
+	}
+	return area, nil
+}
+
+// polygonContains reports whether the given coordinates are within
+// the polygon of [lon, lat] points, by counting how many of its edges
+// a ray cast from them crosses.
+func polygonContains(polygon [][]float64, lat, lon float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		xi, yi := polygon[i][0], polygon[i][1]
+		xj, yj := polygon[j][0], polygon[j][1]
+		if (yi > lat) != (yj > lat) &&
+			lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
@@ -0,0 +1,182 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	// EarthRadius is the mean radius of the Earth in kilometers.
+	EarthRadius = 6371.0
+
+	// kmPerDegree is the length of one degree of latitude, or of
+	// longitude at the equator, in kilometers.
+	kmPerDegree = EarthRadius * math.Pi / 180
+)
+
+var (
+	InvalidBBoxError = errors.New(
+		"bbox must be minLon,minLat,maxLon,maxLat within range")
+	InvalidNearError = errors.New(
+		"near must be lat,lon within range")
+	InvalidRadiusError = errors.New(
+		"radius must be a positive number of kilometers")
+	AreaConflictError = errors.New("bbox and near cannot be combined")
+)
+
+// Area is a region of the Earth's surface, which is either a
+// bounding box or a circle. Either way, MinLat, MinLon, MaxLat, and
+// MaxLon bound it, so that it can be found efficiently using indexed
+// columns. If MinLon is greater than MaxLon, the box crosses the
+// antimeridian.
+type Area struct {
+	MinLat, MinLon, MaxLat, MaxLon float64
+
+	// If Radius is nonzero, the area is the circle of that many
+	// kilometers around Lat and Lon, and the bounds above are only
+	// those of the circle.
+	Lat, Lon, Radius float64
+}
+
+// NewBBox returns an Area covering the given bounding box. If minLon
+// is greater than maxLon, the box crosses the antimeridian. It
+// returns InvalidBBoxError if any coordinate is out of range, or if
+// minLat is greater than maxLat.
+func NewBBox(minLon, minLat, maxLon, maxLat float64) (*Area, error) {
+	if !validLat(minLat) || !validLat(maxLat) || minLat > maxLat ||
+		!validLon(minLon) || !validLon(maxLon) {
+		return nil, InvalidBBoxError
+	}
+	return &Area{
+		MinLat: minLat, MinLon: minLon,
+		MaxLat: maxLat, MaxLon: maxLon,
+	}, nil
+}
+
+// NewCircle returns an Area covering every point within the given
+// radius, in kilometers, of the given coordinates.
+func NewCircle(lat, lon, radius float64) (*Area, error) {
+	if !validLat(lat) || !validLon(lon) {
+		return nil, InvalidNearError
+	} else if !(radius > 0) || math.IsInf(radius, 1) {
+		return nil, InvalidRadiusError
+	}
+
+	a := &Area{
+		Lat: lat, Lon: lon, Radius: radius,
+		MinLat: lat - radius/kmPerDegree,
+		MaxLat: lat + radius/kmPerDegree,
+		MinLon: -180, MaxLon: 180,
+	}
+
+	// If the circle covers a pole, then it covers every longitude
+	// near it. Otherwise, degrees of longitude shrink with the
+	// cosine of the latitude, and are shortest at the edge of the
+	// circle nearest the pole.
+	if a.MinLat <= -90 || a.MaxLat >= 90 {
+		a.MinLat = math.Max(a.MinLat, -90)
+		a.MaxLat = math.Min(a.MaxLat, 90)
+		return a, nil
+	}
+	farthest := math.Max(math.Abs(a.MinLat), math.Abs(a.MaxLat))
+	dlon := radius / (kmPerDegree * math.Cos(farthest*math.Pi/180))
+	if dlon < 180 {
+		a.MinLon = wrapLon(lon - dlon)
+		a.MaxLon = wrapLon(lon + dlon)
+	}
+	return a, nil
+}
+
+// ParseBBox parses a bounding box given as
+// "minLon,minLat,maxLon,maxLat", as in GeoJSON.
+func ParseBBox(s string) (*Area, error) {
+	c, err := parseCoords(s, 4)
+	if err != nil {
+		return nil, InvalidBBoxError
+	}
+	return NewBBox(c[0], c[1], c[2], c[3])
+}
+
+// ParseCircle parses a center given as "lat,lon" and a radius in
+// kilometers.
+func ParseCircle(near, radius string) (*Area, error) {
+	c, err := parseCoords(near, 2)
+	if err != nil {
+		return nil, InvalidNearError
+	}
+	r, err := strconv.ParseFloat(strings.TrimSpace(radius), 64)
+	if err != nil {
+		return nil, InvalidRadiusError
+	}
+	return NewCircle(c[0], c[1], r)
+}
+
+// parseCoords parses exactly n comma-separated numbers.
+func parseCoords(s string, n int) (coords []float64, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != n {
+		return nil, strconv.ErrSyntax
+	}
+	coords = make([]float64, n)
+	for i, part := range parts {
+		coords[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Contains reports whether the given coordinates are within the
+// Area.
+func (a *Area) Contains(lat, lon float64) bool {
+	if !a.boundsContain(lat, lon) {
+		return false
+	}
+	if a.Radius == 0 {
+		return true
+	}
+	return Distance(a.Lat, a.Lon, lat, lon) <= a.Radius
+}
+
+// boundsContain reports whether the given coordinates are within the
+// bounds of the Area, which may cross the antimeridian.
+func (a *Area) boundsContain(lat, lon float64) bool {
+	if lat < a.MinLat || lat > a.MaxLat {
+		return false
+	}
+	if a.MinLon <= a.MaxLon {
+		return lon >= a.MinLon && lon <= a.MaxLon
+	}
+	return lon >= a.MinLon || lon <= a.MaxLon
+}
+
+// Distance returns the great-circle distance in kilometers between
+// two points, using the haversine formula.
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	const rad = math.Pi / 180
+	dlat := (lat2 - lat1) * rad
+	dlon := (lon2 - lon1) * rad
+	h := math.Pow(math.Sin(dlat/2), 2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Pow(math.Sin(dlon/2), 2)
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+func validLat(lat float64) bool { return lat >= -90 && lat <= 90 }
+func validLon(lon float64) bool { return lon >= -180 && lon <= 180 }
+
+// wrapLon brings a longitude which has gone past the antimeridian
+// back into the range [-180, 180].
+func wrapLon(lon float64) float64 {
+	if lon < -180 {
+		return lon + 360
+	} else if lon > 180 {
+		return lon - 360
+	}
+	return lon
+}
@@ -0,0 +1,168 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Actions are the kinds of changes which are recorded in the history
+// of a node.
+const (
+	ActionAdd    = "add"    // added directly, such as by an admin
+	ActionVerify = "verify" // added by verification from the queue
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+// NodeChange is a single entry in the history of a local node. Before
+// is nil if the node was added, and After is nil if it was deleted.
+type NodeChange struct {
+	Action string
+
+	// Actor is the remote address from which the change was made. It
+	// is empty for changes made locally, such as by an import.
+	Actor string `json:",omitempty"`
+
+	Time time.Time
+
+	Before *Node `json:",omitempty"`
+	After  *Node `json:",omitempty"`
+}
+
+// RecordChange inserts an entry into the 'nodes_history' table for
+// the given node. For additions and updates, the node should be as it
+// is after the change, and for deletions, as it was before. The
+// OwnerEmail is never recorded.
+func (db DB) RecordChange(action, actor string, node *Node) (err error) {
+	return recordChangeIn(db, action, actor, node)
+}
+
+// recordChangeIn is the underlying function of RecordChange, which can
+// also be used within a transaction.
+func recordChangeIn(e Execer, action, actor string, node *Node) (err error) {
+	_, err = e.Exec(`INSERT INTO nodes_history
+(address, action, actor, changed,
+owner, contact, details, pgp, lat, lon, status)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		[]byte(node.Addr), action, actor, time.Now().Unix(),
+		node.OwnerName, node.Contact, node.Details, []byte(node.PGP),
+		node.Latitude, node.Longitude, node.Status)
+	return
+}
+
+// recordChange is a helper function which invokes Db.RecordChange
+// and logs any error, rather than returning it, because a failure to
+// record history should not undo a change which has already been
+// made.
+func recordChange(action, actor string, node *Node) {
+	if err := Db.RecordChange(action, actor, node); err != nil {
+		l.Errf("Error recording %s of %q in history: %s",
+			action, node.Addr, err)
+	}
+}
+
+// NodeHistory returns every recorded change to the node with the
+// given address, oldest first. If there are no changes, it returns an
+// empty slice.
+func (db DB) NodeHistory(addr IP) (changes []*NodeChange, err error) {
+	rows, err := db.Query(`
+SELECT action,actor,changed,owner,contact,details,pgp,lat,lon,status
+FROM nodes_history
+WHERE address = ?
+ORDER BY id;`, []byte(addr))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	// Keep track of the most recent state of the node, so that the
+	// Before field of each change can be filled in.
+	var last *Node
+	changes = make([]*NodeChange, 0)
+	for rows.Next() {
+		change := new(NodeChange)
+		node := &Node{Addr: addr}
+
+		var changed int64
+		contact := sql.NullString{}
+		details := sql.NullString{}
+		var pgp []byte
+
+		err = rows.Scan(&change.Action, &change.Actor, &changed,
+			&node.OwnerName, &contact, &details, &pgp,
+			&node.Latitude, &node.Longitude, &node.Status)
+		if err != nil {
+			return
+		}
+		change.Time = time.Unix(changed, 0)
+		node.Contact = contact.String
+		node.Details = details.String
+		node.PGP = PGPID(pgp)
+
+		last = linkChange(change, node, last)
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+// linkChange fills in the Before and After fields of the given change
+// from the state of the node recorded with it and the most recent
+// state before it, and returns the most recent state after it.
+func linkChange(change *NodeChange, node, last *Node) *Node {
+	// Deletions record the node as it was before the change, and
+	// leave nothing after it.
+	switch change.Action {
+	case ActionDelete:
+		change.Before = node
+		return nil
+	case ActionUpdate:
+		change.Before = last
+		change.After = node
+	default:
+		change.After = node
+	}
+	return node
+}
+
+// DumpLocalAsOf reconstructs the local nodes as they were at the given
+// time, using the most recent change to each node made at or before
+// that time. Nodes whose most recent change was a deletion are
+// omitted.
+func (db DB) DumpLocalAsOf(t time.Time) (nodes []*Node, err error) {
+	rows, err := db.Query(`
+SELECT address,owner,contact,details,pgp,lat,lon,status
+FROM nodes_history
+WHERE id IN (
+SELECT MAX(id) FROM nodes_history WHERE changed <= ? GROUP BY address)
+AND action != ?;`, t.Unix(), ActionDelete)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	nodes = make([]*Node, 0)
+	for rows.Next() {
+		node := new(Node)
+
+		contact := sql.NullString{}
+		details := sql.NullString{}
+		var pgp []byte
+
+		err = rows.Scan(&node.Addr, &node.OwnerName,
+			&contact, &details, &pgp,
+			&node.Latitude, &node.Longitude, &node.Status)
+		if err != nil {
+			return
+		}
+
+		node.Contact = contact.String
+		node.Details = details.String
+		node.PGP = PGPID(pgp)
+
+		nodes = append(nodes, node)
+	}
+	return nodes, rows.Err()
+}
@@ -0,0 +1,248 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"github.com/agl/ed25519"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader is the HTTP header field in which signed
+	// responses carry the base64-encoded ed25519 signature made with
+	// the identity key of the map which sent them, and
+	// SignatureTimeHeader is the one in which they carry the Unix time
+	// at which they were signed. The signature covers the path and
+	// query of the request, the time, and the body, as given by
+	// signedMessage.
+	SignatureHeader     = "X-NodeAtlas-Signature"
+	SignatureTimeHeader = "X-NodeAtlas-Signature-Time"
+
+	// signatureWindow is how far the time at which a response was
+	// signed may be from the present before the response is rejected,
+	// so that old responses cannot be replayed indefinitely, while
+	// allowing for clocks which are somewhat apart.
+	signatureWindow = 5 * time.Minute
+
+	// defaultIdentityFile is the path to the identity key used if
+	// Conf.IdentityFile is not given.
+	defaultIdentityFile = "identity.key"
+)
+
+var (
+	// Identity is the ed25519 private key with which this instance
+	// signs its responses, and IdentityPublic is the corresponding
+	// public key. They are set by LoadIdentity.
+	Identity       *[ed25519.PrivateKeySize]byte
+	IdentityPublic *[ed25519.PublicKeySize]byte
+)
+
+var (
+	InvalidIdentityError  = errors.New("identity key is invalid")
+	InvalidPublicKeyError = errors.New("public key is invalid")
+	UnsignedResponseError = errors.New("response is not signed")
+	BadSignatureError     = errors.New("response signature is invalid")
+	SignatureTimeError    = errors.New("response signature is too old or too new")
+)
+
+// LoadIdentity reads the identity key of this instance from the file
+// at the given path, and sets Identity and IdentityPublic. If the
+// file does not exist, a new key is generated and written to it. If
+// the path is empty, defaultIdentityFile is used.
+func LoadIdentity(path string) (err error) {
+	if len(path) == 0 {
+		path = defaultIdentityFile
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return generateIdentity(path)
+	} else if err != nil {
+		return
+	}
+
+	key, err := base64.StdEncoding.DecodeString(
+		string(bytes.TrimSpace(b)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return InvalidIdentityError
+	}
+	setIdentity(key)
+	return
+}
+
+// generateIdentity generates a new identity key, writes it to a new
+// file at the given path, which is readable only by its owner, and
+// sets Identity and IdentityPublic.
+func generateIdentity(path string) (err error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(
+		base64.StdEncoding.EncodeToString(private[:]) + "\n")
+	if err != nil {
+		return
+	}
+	setIdentity(private[:])
+	l.Infof("Generated new identity key in %q\n", path)
+	return
+}
+
+// setIdentity sets Identity to the given private key, and
+// IdentityPublic to the public key which makes up its second half.
+func setIdentity(key []byte) {
+	Identity = new([ed25519.PrivateKeySize]byte)
+	copy(Identity[:], key)
+	IdentityPublic = new([ed25519.PublicKeySize]byte)
+	copy(IdentityPublic[:], key[ed25519.PrivateKeySize-ed25519.PublicKeySize:])
+}
+
+// EncodePublicKey returns the given public key in base64, or an empty
+// string if it is nil.
+func EncodePublicKey(key *[ed25519.PublicKeySize]byte) string {
+	if key == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+// ParsePublicKey parses a base64-encoded ed25519 public key, as given
+// by EncodePublicKey.
+func ParsePublicKey(s string) (key *[ed25519.PublicKeySize]byte, err error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, InvalidPublicKeyError
+	}
+	key = new([ed25519.PublicKeySize]byte)
+	copy(key[:], b)
+	return
+}
+
+// signedMessage returns the message which is signed for a response
+// to a request for the given path and query, made at the given time,
+// as given in SignatureTimeHeader, with the given body. Including the
+// path and query prevents a response to one request from being passed
+// off as that to another, and including the time prevents it from
+// being replayed once it is outside signatureWindow.
+func signedMessage(uri, signed string, body []byte) []byte {
+	message := make([]byte, 0, len(uri)+len(signed)+len(body)+2)
+	message = append(message, uri...)
+	message = append(message, '\n')
+	message = append(message, signed...)
+	message = append(message, '\n')
+	return append(message, body...)
+}
+
+// VerifySignature checks that the given header, from a response to a
+// request for the given path and query, carries a signature of the
+// response and the given body by the given public key, which was made
+// within signatureWindow of now. It returns UnsignedResponseError if
+// there is no signature, SignatureTimeError if it was made too long
+// ago or in the future, and BadSignatureError if it does not match.
+func VerifySignature(key *[ed25519.PublicKeySize]byte, uri string, header http.Header, body []byte) error {
+	signature := header.Get(SignatureHeader)
+	signed := header.Get(SignatureTimeHeader)
+	if len(signature) == 0 || len(signed) == 0 {
+		return UnsignedResponseError
+	}
+
+	t, err := strconv.ParseInt(signed, 10, 64)
+	if err != nil {
+		return BadSignatureError
+	}
+	if age := time.Since(time.Unix(t, 0)); age > signatureWindow ||
+		age < -signatureWindow {
+		return SignatureTimeError
+	}
+
+	b, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(b) != ed25519.SignatureSize {
+		return BadSignatureError
+	}
+	sig := new([ed25519.SignatureSize]byte)
+	copy(sig[:], b)
+	if !ed25519.Verify(key, signedMessage(uri, signed, body), sig) {
+		return BadSignatureError
+	}
+	return nil
+}
+
+// signedHandler is an http.Handler which signs the responses of
+// another to requests for any of the given paths with Identity, and
+// places the signature in SignatureHeader and the time in
+// SignatureTimeHeader. Responses that nothing has changed are signed
+// as well, with an empty body, so that they cannot be forged to keep
+// a parent map from seeing changes. If Identity is not set, responses
+// are not signed.
+type signedHandler struct {
+	http.Handler
+	paths map[string]bool
+}
+
+func (h signedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if Identity == nil || !h.paths[strings.TrimRight(r.URL.Path, "/")] {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	// Buffer the whole response, so that it can be signed before
+	// any of it is written.
+	bw := &bufferedResponse{header: make(http.Header)}
+	h.Handler.ServeHTTP(bw, r)
+
+	for k, v := range bw.header {
+		w.Header()[k] = v
+	}
+	signed := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := ed25519.Sign(Identity,
+		signedMessage(r.URL.RequestURI(), signed, bw.body.Bytes()))
+	w.Header().Set(SignatureHeader,
+		base64.StdEncoding.EncodeToString(signature[:]))
+	w.Header().Set(SignatureTimeHeader, signed)
+	if bw.status != http.StatusNotModified {
+		w.Header().Set("Content-Length", strconv.Itoa(bw.body.Len()))
+	}
+	if bw.status != 0 {
+		w.WriteHeader(bw.status)
+	}
+	w.Write(bw.body.Bytes())
+}
+
+// bufferedResponse is an http.ResponseWriter which keeps the entire
+// response in memory.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
@@ -4,31 +4,410 @@ package main
 // and contributors; (GPLv3) see LICENSE or doc.go
 
 import (
+	"bufio"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
-// Import reads a slice of JSON-encoded Nodes from the given io.Reader
-// and adds them to the database. Cache-related fields such as
-// RetrieveTime are discarded.
-func Import(r io.Reader) (err error) {
-	// Unmarshal the Nodes from the given io.Reader.
-	nodes := make([]*Node, 0)
-	err = json.NewDecoder(r).Decode(&nodes)
+// Formats are the encodings in which nodes can be imported and
+// exported.
+const (
+	// FormatJSON is a JSON array of Nodes.
+	FormatJSON = "json"
+
+	// FormatGeoJSON is a GeoJSON FeatureCollection, as produced by
+	// FeatureCollectionNodes.
+	FormatGeoJSON = "geojson"
+
+	// FormatCSV is a table of nodes with a header row naming the
+	// columns, which are listed in CSVColumns.
+	FormatCSV = "csv"
+)
+
+// CSVColumns are the names of the columns used when exporting nodes
+// as CSV, in order. When importing, the header row may list them in
+// any order, and only Addr is required.
+var CSVColumns = []string{
+	"Addr", "OwnerName", "Contact", "Details", "PGP",
+	"Latitude", "Longitude", "Status",
+}
+
+// Import modes determine how imported nodes which already exist in
+// the local database are treated.
+const (
+	// ImportInsert only adds new nodes, and fails if any imported
+	// node already exists.
+	ImportInsert = "insert"
+
+	// ImportUpsert adds new nodes and updates existing ones with the
+	// imported data.
+	ImportUpsert = "upsert"
+
+	// ImportReplace makes the local nodes match the import exactly,
+	// adding and updating nodes as ImportUpsert does, and deleting
+	// any local nodes which are not part of the import.
+	ImportReplace = "replace"
+)
+
+var (
+	InvalidImportModeError = errors.New(
+		"import mode must be insert, upsert, or replace")
+	InvalidFormatError = errors.New(
+		"format must be json, geojson, or csv")
+	CSVColumnUnknownError = "unknown CSV column %q"
+	CSVColumnMissingError = errors.New("CSV header has no Addr column")
+	CSVRowError           = "CSV line %d: %s"
+	NodeMissingError      = errors.New("node is null")
+	NodeDuplicatedError   = errors.New("address appears more than once")
+	NodeExistsError       = errors.New("address already exists")
+)
+
+// ImportResult describes what was done, or what would be done in a
+// dry run, with a single node during an import.
+type ImportResult struct {
+	// Addr is the address of the node, which may be nil if it could
+	// not be read.
+	Addr IP
+
+	// Action is one of ActionAdd, ActionUpdate, or ActionDelete. It
+	// is empty if the node could not be imported.
+	Action string
+
+	// Err explains why the node could not be imported, if it could
+	// not.
+	Err error
+}
+
+func (r *ImportResult) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("error  %s: %s", r.Addr, r.Err)
+	}
+	return fmt.Sprintf("%-6s %s", r.Action, r.Addr)
+}
+
+// ImportFailedError is returned by Import when one or more nodes
+// could not be imported, in which case none of them were.
+type ImportFailedError struct {
+	Failed int
+}
+
+func (err ImportFailedError) Error() string {
+	return fmt.Sprintf("%d nodes could not be imported", err.Failed)
+}
+
+// FormatFromPath guesses the format of a file from its extension. It
+// returns FormatGeoJSON for ".geojson", FormatCSV for ".csv", and
+// FormatJSON for anything else.
+func FormatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".geojson":
+		return FormatGeoJSON
+	case ".csv":
+		return FormatCSV
+	default:
+		return FormatJSON
+	}
+}
+
+// DecodeNodes reads Nodes from the given io.Reader in the given
+// format. If the format is empty, it is detected from the first
+// non-whitespace character: '[' begins a JSON array of Nodes, '{' a
+// GeoJSON FeatureCollection, and anything else a CSV table.
+func DecodeNodes(r io.Reader, format string) (nodes []*Node, err error) {
+	if len(format) == 0 {
+		br := bufio.NewReader(r)
+		format, err = detectFormat(br)
+		if err != nil {
+			return
+		}
+		r = br
+	}
+
+	switch format {
+	case FormatJSON:
+		nodes = make([]*Node, 0)
+		err = json.NewDecoder(r).Decode(&nodes)
+	case FormatGeoJSON:
+		nodes, err = decodeGeoJSON(r)
+	case FormatCSV:
+		nodes, err = decodeCSV(r)
+	default:
+		err = InvalidFormatError
+	}
+	return
+}
+
+// detectFormat peeks at the first non-whitespace character of the
+// given bufio.Reader to determine the format of its contents, and
+// leaves that character unread.
+func detectFormat(br *bufio.Reader) (format string, err error) {
+	for {
+		var c rune
+		c, _, err = br.ReadRune()
+		if err != nil {
+			return
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n', '\ufeff':
+			continue
+		case '[':
+			format = FormatJSON
+		case '{':
+			format = FormatGeoJSON
+		default:
+			format = FormatCSV
+		}
+		return format, br.UnreadRune()
+	}
+}
+
+// geoJSONNodes is the structure into which a GeoJSON FeatureCollection
+// of nodes, as produced by FeatureCollectionNodes, is decoded.
+type geoJSONNodes struct {
+	Features []struct {
+		Id       IP `json:"id"`
+		Geometry struct {
+			Coordinates []float64 `json:"coordinates"`
+		} `json:"geometry"`
+		Properties struct {
+			OwnerName string
+			Status    uint32
+			Contact   string
+			Details   string
+			PGP       PGPID
+		} `json:"properties"`
+	} `json:"features"`
+}
+
+// decodeGeoJSON reads a GeoJSON FeatureCollection of nodes from the
+// given io.Reader. The id of each Feature is the address of the node,
+// and its geometry is a Point.
+func decodeGeoJSON(r io.Reader) (nodes []*Node, err error) {
+	collection := new(geoJSONNodes)
+	err = json.NewDecoder(r).Decode(collection)
+	if err != nil {
+		return
+	}
+
+	nodes = make([]*Node, len(collection.Features))
+	for i, f := range collection.Features {
+		nodes[i] = &Node{
+			Addr:      f.Id,
+			OwnerName: f.Properties.OwnerName,
+			Status:    f.Properties.Status,
+			Contact:   f.Properties.Contact,
+			Details:   f.Properties.Details,
+			PGP:       f.Properties.PGP,
+		}
+
+		// GeoJSON coordinates are longitude first.
+		if coords := f.Geometry.Coordinates; len(coords) >= 2 {
+			nodes[i].Longitude = coords[0]
+			nodes[i].Latitude = coords[1]
+		}
+	}
+	return
+}
+
+// decodeCSV reads a table of nodes from the given io.Reader. The
+// first row must name the columns, using the names in CSVColumns.
+func decodeCSV(r io.Reader) (nodes []*Node, err error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
 	if err != nil {
 		return
 	}
 
-	// Insert them into the database as new. Timestamps will be the
-	// current time.
-	err = Db.AddNodes(nodes)
+	// Match up the names in the header with the known columns, so
+	// that the rows can be read in any order. Column names are not
+	// case sensitive.
+	columns := make([]string, len(header))
+	var hasAddr bool
+	for i, name := range header {
+		for _, column := range CSVColumns {
+			if strings.EqualFold(strings.TrimSpace(name), column) {
+				columns[i] = column
+				break
+			}
+		}
+		if len(columns[i]) == 0 {
+			return nil, fmt.Errorf(CSVColumnUnknownError, name)
+		}
+		hasAddr = hasAddr || columns[i] == "Addr"
+	}
+	if !hasAddr {
+		return nil, CSVColumnMissingError
+	}
+
+	nodes = make([]*Node, 0)
+	for line := 2; ; line++ {
+		var row []string
+		row, err = cr.Read()
+		if err == io.EOF {
+			return nodes, nil
+		} else if err != nil {
+			return
+		}
+
+		node := new(Node)
+		for i, value := range row {
+			if err = setCSVField(node, columns[i], value); err != nil {
+				return nil, fmt.Errorf(CSVRowError, line, err)
+			}
+		}
+		nodes = append(nodes, node)
+	}
+}
+
+// setCSVField parses the given value into the field of the node named
+// by the given column. Empty cells leave the field unset.
+func setCSVField(node *Node, column, value string) (err error) {
+	if len(value) == 0 {
+		return
+	}
+
+	switch column {
+	case "Addr":
+		err = node.Addr.UnmarshalJSON([]byte(strconv.Quote(value)))
+	case "OwnerName":
+		node.OwnerName = value
+	case "Contact":
+		node.Contact = value
+	case "Details":
+		node.Details = value
+	case "PGP":
+		node.PGP, err = DecodePGPID([]byte(value))
+	case "Latitude":
+		node.Latitude, err = strconv.ParseFloat(value, 64)
+	case "Longitude":
+		node.Longitude, err = strconv.ParseFloat(value, 64)
+	case "Status":
+		var status uint64
+		status, err = strconv.ParseUint(value, 0, 32)
+		node.Status = uint32(status)
+	}
 	return
 }
 
-// ImportFile opens the given file and imports JSON-encoded Nodes from
-// it.
-func ImportFile(path string) (err error) {
+// Import reads Nodes from the given io.Reader in the given format, or
+// detects the format if it is empty, as DecodeNodes does. It adds them
+// to the database, treating existing nodes according to the given
+// import mode. Cache-related fields such as RetrieveTime are
+// discarded.
+//
+// Every node is validated with ValidateNode before any changes are
+// made, and the changes are made at once with Db.ImportNodes, so if
+// any node cannot be imported, the database is left unchanged and an
+// ImportFailedError is returned. If dryRun is true, no changes are
+// made at all. In either case, the results describe what happened, or
+// would happen, to each node.
+func Import(r io.Reader, format, mode string, dryRun bool) (results []*ImportResult, err error) {
+	if mode != ImportInsert && mode != ImportUpsert && mode != ImportReplace {
+		return nil, InvalidImportModeError
+	}
+
+	// Decode the Nodes from the given io.Reader.
+	nodes, err := DecodeNodes(r, format)
+	if err != nil {
+		return
+	}
+
+	// Find out which nodes exist already, so that we can decide what
+	// to do with each imported node, and which to delete if we're
+	// replacing them.
+	localNodes, err := Db.DumpLocal()
+	if err != nil {
+		return
+	}
+	existing := make(map[string]*Node, len(localNodes))
+	for _, node := range localNodes {
+		existing[node.Addr.String()] = node
+	}
+
+	var failed int
+	var added, updated, deleted []*Node
+	seen := make(map[string]bool, len(nodes))
+	results = make([]*ImportResult, 0, len(nodes))
+	for _, node := range nodes {
+		result := new(ImportResult)
+		results = append(results, result)
+
+		if node == nil {
+			result.Err = NodeMissingError
+			failed++
+			continue
+		}
+		result.Addr = node.Addr
+		addr := node.Addr.String()
+
+		// Check the node for problems before touching the database,
+		// and record any that we find.
+		if err := ValidateNode(node); err != nil {
+			result.Err = err
+		} else if seen[addr] {
+			result.Err = NodeDuplicatedError
+		} else if existing[addr] != nil && mode == ImportInsert {
+			result.Err = NodeExistsError
+		}
+		if result.Err != nil {
+			failed++
+			continue
+		}
+		seen[addr] = true
+
+		// Cache-related fields are discarded.
+		node.SourceID = 0
+		node.RetrieveTime = 0
+		node.Stale = false
+
+		if existing[addr] != nil {
+			result.Action = ActionUpdate
+			updated = append(updated, node)
+		} else {
+			result.Action = ActionAdd
+			added = append(added, node)
+		}
+	}
+
+	// If we are replacing the local nodes, delete any which were not
+	// part of the import.
+	if mode == ImportReplace {
+		for _, node := range localNodes {
+			if seen[node.Addr.String()] {
+				continue
+			}
+			results = append(results, &ImportResult{
+				Addr:   node.Addr,
+				Action: ActionDelete,
+			})
+			deleted = append(deleted, node)
+		}
+	}
+
+	// If any nodes could not be imported, then none of them should
+	// be, so that the database isn't left half-imported.
+	if failed > 0 {
+		return results, ImportFailedError{failed}
+	}
+	if dryRun {
+		return
+	}
+	return results, Db.ImportNodes(added, updated, deleted)
+}
+
+// ImportFile opens the given file and imports Nodes from it, as Import
+// does. If the format is empty, it is guessed from the extension if it
+// is ".geojson" or ".csv", and detected from the contents otherwise.
+func ImportFile(path, format, mode string, dryRun bool) (results []*ImportResult, err error) {
 	// Open the file in readonly mode.
 	f, err := os.Open(path)
 	if err != nil {
@@ -36,6 +415,10 @@ func ImportFile(path string) (err error) {
 	}
 	defer f.Close()
 
+	if len(format) == 0 && FormatFromPath(path) != FormatJSON {
+		format = FormatFromPath(path)
+	}
+
 	// Pass it along to Import.
-	return Import(f)
+	return Import(f, format, mode, dryRun)
 }
@@ -0,0 +1,1164 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var DuplicateKeyError = errors.New("memstore: duplicate key")
+
+// MemStore is a Store which keeps everything in memory, and is
+// therefore lost when the process exits. It is useful for tests and
+// for running an ephemeral demonstration instance. It behaves as DB
+// does, including returning sql.ErrNoRows for missing records and
+// DuplicateKeyError where DB would violate a primary key. Its methods
+// are documented on DB. It is safe for concurrent use.
+type MemStore struct {
+	ReadOnly bool
+
+	mutex sync.RWMutex
+
+	// nodes holds local nodes, keyed by address, and cached holds
+	// cached nodes, keyed by copyKey.
+	nodes  map[string]*memNode
+	cached map[string]*memCached
+
+	history []*memChange
+	deleted map[string]*Tombstone
+
+	// removed is the Unix time at which any row which LastModified
+	// considers was last removed.
+	removed int64
+
+	childMaps []*ChildMap
+	nextMapID int
+
+	// peers holds links between nodes, keyed by peerKey, and
+	// peerHistory the earlier appearances of links which dropped and
+	// were found again.
+	peers       map[string]*Pair
+	peerHistory []*Pair
+
+	outbox       []*memPushed
+	nextOutboxID int64
+
+	queue    map[int64]*memQueued
+	captchas map[string]*memCAPTCHA
+}
+
+// memNode is a local node and the Unix time at which it was last
+// updated.
+type memNode struct {
+	node    *Node
+	updated int64
+}
+
+// memCached is a cached node and the ID of the child map through
+// which it was retrieved.
+type memCached struct {
+	node *Node
+	via  int
+}
+
+// memChange is an entry in the history of a local node.
+type memChange struct {
+	action, actor string
+	changed       int64
+	node          *Node
+}
+
+// memPushed is an event in the outbox of a parent map.
+type memPushed struct {
+	parent string
+	event  *PushEvent
+}
+
+// memQueued is a node in the verify queue.
+type memQueued struct {
+	node       *Node
+	verifysent bool
+	expiration int64
+}
+
+// memCAPTCHA is a CAPTCHA solution and the Unix time at which it
+// expires.
+type memCAPTCHA struct {
+	solution   []byte
+	expiration int64
+}
+
+// NewMemStore returns an empty *MemStore, ready for use.
+func NewMemStore() *MemStore {
+	return &MemStore{
+		nodes:     make(map[string]*memNode),
+		cached:    make(map[string]*memCached),
+		history:   make([]*memChange, 0),
+		deleted:   make(map[string]*Tombstone),
+		childMaps: make([]*ChildMap, 0),
+		nextMapID: 1,
+		peers:     make(map[string]*Pair),
+		outbox:    make([]*memPushed, 0),
+		queue:     make(map[int64]*memQueued),
+		captchas:  make(map[string]*memCAPTCHA),
+	}
+}
+
+// copyNode returns a copy of the given node, so that the nodes held
+// by the MemStore cannot be modified by callers, or vice versa.
+func copyNode(node *Node) *Node {
+	c := *node
+	return &c
+}
+
+// localNode returns a copy of the given local node as it would be
+// dumped, without its owner's email address.
+func localNode(node *Node) *Node {
+	c := copyNode(node)
+	c.OwnerEmail = ""
+	c.SourceID = 0
+	c.RetrieveTime = 0
+	return c
+}
+
+// cachedNode returns a copy of the given cached node as it would be
+// dumped, with only the fields which are cached, and marked stale if
+// the last sync of the child map it was retrieved through failed. The
+// mutex must be held.
+func (m *MemStore) cachedNode(cached *memCached) *Node {
+	node := cached.node
+	c := &Node{
+		SourceID:     node.SourceID,
+		Status:       node.Status,
+		Latitude:     node.Latitude,
+		Longitude:    node.Longitude,
+		Addr:         node.Addr,
+		RetrieveTime: node.RetrieveTime,
+		OwnerName:    node.OwnerName,
+		Details:      node.Details,
+	}
+	if childMap := m.childMap(cached.via); childMap != nil {
+		c.Stale = childMap.LastFailure.After(childMap.LastSync)
+	}
+	return c
+}
+
+// nodesByAddr implements sort.Interface to sort nodes by address, so
+// that dumps are in a consistent order.
+type nodesByAddr []*Node
+
+func (n nodesByAddr) Len() int           { return len(n) }
+func (n nodesByAddr) Less(i, j int) bool { return n[i].Addr.LessThan(n[j].Addr) }
+func (n nodesByAddr) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+
+func (m *MemStore) Close() error {
+	return nil
+}
+
+func (m *MemStore) IsReadOnly() bool {
+	return m.ReadOnly
+}
+
+func (m *MemStore) LenNodes(useCached bool) (n int) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	n = len(m.nodes)
+	if useCached {
+		counted := make(map[string]bool)
+		for _, cached := range m.cached {
+			addr := cached.node.Addr.String()
+			if m.nodes[addr] == nil && !counted[addr] {
+				counted[addr] = true
+				n++
+			}
+		}
+	}
+	return
+}
+
+// preferredCopies returns the copy of each node which takes
+// precedence, as described by FindConflicts, in no particular order.
+// The mutex must be held, so that every copy is seen at once.
+func (m *MemStore) preferredCopies() (preferred []*NodeCopy) {
+	idSources := m.idSources()
+	copies := make(map[string]nodeCopies, len(m.nodes)+len(m.cached))
+	for addr, n := range m.nodes {
+		copies[addr] = append(copies[addr], &NodeCopy{
+			Node:    localNode(n.node),
+			Source:  idSources[0],
+			Updated: time.Unix(n.updated, 0),
+		})
+	}
+	for _, cached := range m.cached {
+		node := m.cachedNode(cached)
+		addr := node.Addr.String()
+		copies[addr] = append(copies[addr], &NodeCopy{
+			Node:    node,
+			Source:  idSources[node.SourceID],
+			Updated: time.Unix(node.RetrieveTime, 0),
+		})
+	}
+
+	preferred = make([]*NodeCopy, 0, len(copies))
+	for _, c := range copies {
+		preferred = append(preferred, preferredCopy(c))
+	}
+	return
+}
+
+func (m *MemStore) DumpNodes() (nodes []*Node, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	copies := m.preferredCopies()
+	nodes = make([]*Node, len(copies))
+	for i, c := range copies {
+		nodes[i] = c.Node
+	}
+	sort.Sort(nodesByAddr(nodes))
+	return
+}
+
+func (m *MemStore) QueryNodes(q *NodeQuery) (nodes []*Node, next *NodeCursor, err error) {
+	if err = q.Validate(); err != nil {
+		return
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	// Find every matching node and its position in the sort order.
+	matched := make(nodePositions, 0)
+	for _, c := range m.preferredCopies() {
+		if q.Matches(c.Node) {
+			matched = append(matched,
+				nodePosition{c.Node, q.cursor(c.Node, c.Updated.Unix())})
+		}
+	}
+	nodes, next = q.page(matched)
+	return
+}
+
+func (m *MemStore) DumpLocal() (nodes []*Node, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	nodes = make([]*Node, 0, len(m.nodes))
+	for _, n := range m.nodes {
+		nodes = append(nodes, localNode(n.node))
+	}
+	sort.Sort(nodesByAddr(nodes))
+	return
+}
+
+func (m *MemStore) DumpChanges(t time.Time) (nodes []*Node, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	since := t.Unix()
+	nodes = make([]*Node, 0)
+	for _, c := range m.preferredCopies() {
+		if c.Updated.Unix() >= since {
+			nodes = append(nodes, c.Node)
+		}
+	}
+	sort.Sort(nodesByAddr(nodes))
+	return
+}
+
+func (m *MemStore) DumpLocalUpdated(since time.Time) (nodes []*Node, updated []time.Time, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, n := range m.nodes {
+		if n.updated >= since.Unix() {
+			nodes = append(nodes, &Node{
+				Addr:      n.node.Addr,
+				OwnerName: n.node.OwnerName,
+			})
+			updated = append(updated, time.Unix(n.updated, 0))
+		}
+	}
+	return
+}
+
+func (m *MemStore) CountSources() (counts map[int]int, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	counts = map[int]int{0: len(m.nodes)}
+	for _, cached := range m.cached {
+		counts[cached.node.SourceID]++
+	}
+	return
+}
+
+func (m *MemStore) LastModified() (t time.Time, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var latest int64
+	later := func(u int64) {
+		if u > latest {
+			latest = u
+		}
+	}
+	for _, n := range m.nodes {
+		later(n.updated)
+	}
+	for _, cached := range m.cached {
+		later(cached.node.RetrieveTime)
+	}
+	for _, tombstone := range m.deleted {
+		later(tombstone.Deleted.Unix())
+	}
+	later(m.removed)
+	for _, childMap := range m.childMaps {
+		if !childMap.LastSync.IsZero() {
+			later(childMap.LastSync.Unix())
+		}
+		if !childMap.LastFailure.IsZero() {
+			later(childMap.LastFailure.Unix())
+		}
+	}
+	return unixOrZero(latest), nil
+}
+
+func (m *MemStore) GetNode(addr IP) (node *Node, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	idSources := m.idSources()
+	var copies nodeCopies
+	if n := m.nodes[addr.String()]; n != nil {
+		node := copyNode(n.node)
+		node.RetrieveTime = 0
+		copies = append(copies, &NodeCopy{
+			Node:    node,
+			Source:  idSources[0],
+			Updated: time.Unix(n.updated, 0),
+		})
+	}
+	for _, cached := range m.cached {
+		if cached.node.Addr.String() == addr.String() {
+			node := m.cachedNode(cached)
+			copies = append(copies, &NodeCopy{
+				Node:    node,
+				Source:  idSources[node.SourceID],
+				Updated: time.Unix(node.RetrieveTime, 0),
+			})
+		}
+	}
+	if c := preferredCopy(copies); c != nil {
+		node = c.Node
+	}
+	return
+}
+
+func (m *MemStore) GetLocalNode(addr IP) (node *Node, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if n := m.nodes[addr.String()]; n != nil {
+		node = copyNode(n.node)
+		node.RetrieveTime = 0
+		return
+	}
+	return nil, nil
+}
+
+func (m *MemStore) DumpDuplicates() (nodes []*Node, updated []time.Time, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	// Gather every copy of each address, and then keep only those
+	// with more than one.
+	copies := make(map[string]nodePositions)
+	for addr, n := range m.nodes {
+		node := localNode(n.node)
+		copies[addr] = append(copies[addr], nodePosition{node,
+			&NodeCursor{Addr: node.Addr, Updated: n.updated}})
+	}
+	for _, cached := range m.cached {
+		node := m.cachedNode(cached)
+		addr := node.Addr.String()
+		copies[addr] = append(copies[addr], nodePosition{node,
+			&NodeCursor{Addr: node.Addr, SourceID: node.SourceID,
+				Updated: node.RetrieveTime}})
+	}
+
+	duplicates := make(nodePositions, 0)
+	for _, c := range copies {
+		if len(c) > 1 {
+			duplicates = append(duplicates, c...)
+		}
+	}
+	sort.Sort(duplicates)
+	for _, p := range duplicates {
+		nodes = append(nodes, p.node)
+		updated = append(updated, time.Unix(p.cursor.Updated, 0))
+	}
+	return
+}
+
+func (m *MemStore) AddNode(node *Node) (err error) {
+	return m.AddNodes([]*Node{node})
+}
+
+func (m *MemStore) AddNodes(nodes []*Node) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// Check every node before adding any, so that if any of them
+	// cannot be added, none are.
+	if err = m.checkNew(nodes); err != nil {
+		return
+	}
+	for _, node := range nodes {
+		m.add(node)
+	}
+	return
+}
+
+func (m *MemStore) UpdateNode(node *Node) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.update(node)
+	return
+}
+
+func (m *MemStore) DeleteNode(addr IP) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.nodes[addr.String()] == nil {
+		return sql.ErrNoRows
+	}
+	m.remove(addr)
+	return
+}
+
+func (m *MemStore) ImportNodes(added, updated, deleted []*Node) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err = m.checkNew(added); err != nil {
+		return
+	}
+	for _, node := range deleted {
+		if m.nodes[node.Addr.String()] == nil {
+			return sql.ErrNoRows
+		}
+	}
+
+	for _, node := range added {
+		m.add(node)
+		m.record(ActionAdd, "", node)
+	}
+	for _, node := range updated {
+		m.update(node)
+		m.record(ActionUpdate, "", node)
+	}
+	for _, node := range deleted {
+		m.remove(node.Addr)
+		m.record(ActionDelete, "", node)
+	}
+	return
+}
+
+// checkNew returns DuplicateKeyError if any of the given nodes exist
+// already, or appear more than once. The mutex must be held.
+func (m *MemStore) checkNew(nodes []*Node) error {
+	seen := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		addr := node.Addr.String()
+		if seen[addr] || m.nodes[addr] != nil {
+			return DuplicateKeyError
+		}
+		seen[addr] = true
+	}
+	return nil
+}
+
+// add inserts a local node with the current timestamp and clears its
+// tombstone, as addNode does. The mutex must be held.
+func (m *MemStore) add(node *Node) {
+	addr := node.Addr.String()
+	m.nodes[addr] = &memNode{
+		node:    copyNode(node),
+		updated: time.Now().Unix(),
+	}
+	delete(m.deleted, addr)
+}
+
+// update replaces a local node, except for its owner's email
+// address, and sets its timestamp, as updateNode does. If there is no
+// such node, it does nothing. The mutex must be held.
+func (m *MemStore) update(node *Node) {
+	n := m.nodes[node.Addr.String()]
+	if n == nil {
+		return
+	}
+
+	email := n.node.OwnerEmail
+	n.node = copyNode(node)
+	n.node.OwnerEmail = email
+	n.updated = time.Now().Unix()
+}
+
+// remove deletes a local node and leaves a tombstone, as deleteNode
+// does. The mutex must be held.
+func (m *MemStore) remove(addr IP) {
+	delete(m.nodes, addr.String())
+	m.deleted[addr.String()] = &Tombstone{
+		Addr:    addr,
+		Deleted: time.Unix(time.Now().Unix(), 0),
+	}
+}
+
+// record appends a change to the history. The mutex must be held.
+func (m *MemStore) record(action, actor string, node *Node) {
+	m.history = append(m.history, &memChange{
+		action:  action,
+		actor:   actor,
+		changed: time.Now().Unix(),
+		node:    localNode(node),
+	})
+}
+
+func (m *MemStore) RecordChange(action, actor string, node *Node) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.record(action, actor, node)
+	return
+}
+
+func (m *MemStore) NodeHistory(addr IP) (changes []*NodeChange, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var last *Node
+	changes = make([]*NodeChange, 0)
+	for _, c := range m.history {
+		if c.node.Addr.String() != addr.String() {
+			continue
+		}
+
+		change := &NodeChange{
+			Action: c.action,
+			Actor:  c.actor,
+			Time:   time.Unix(c.changed, 0),
+		}
+		last = linkChange(change, copyNode(c.node), last)
+		changes = append(changes, change)
+	}
+	return
+}
+
+func (m *MemStore) DumpLocalAsOf(t time.Time) (nodes []*Node, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	// Find the most recent change to each node at or before the
+	// given time.
+	latest := make(map[string]*memChange)
+	for _, c := range m.history {
+		if c.changed <= t.Unix() {
+			latest[c.node.Addr.String()] = c
+		}
+	}
+
+	nodes = make([]*Node, 0, len(latest))
+	for _, c := range latest {
+		if c.action != ActionDelete {
+			nodes = append(nodes, copyNode(c.node))
+		}
+	}
+	sort.Sort(nodesByAddr(nodes))
+	return
+}
+
+func (m *MemStore) ClearTombstone(addr IP) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.deleted, addr.String())
+	return
+}
+
+func (m *MemStore) DumpDeleted(since time.Time) (tombstones []*Tombstone, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	tombstones = make([]*Tombstone, 0)
+	for _, tombstone := range m.deleted {
+		if tombstone.Deleted.Unix() >= since.Unix() {
+			t := *tombstone
+			tombstones = append(tombstones, &t)
+		}
+	}
+	return
+}
+
+func (m *MemStore) DeleteExpiredTombstones() (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	expiry := time.Now().Add(-time.Duration(Conf.CacheExpiration)).Unix()
+	for addr, tombstone := range m.deleted {
+		if tombstone.Deleted.Unix() < expiry {
+			delete(m.deleted, addr)
+			m.recordRemoval()
+		}
+	}
+	return
+}
+
+func (m *MemStore) UpdateCache(u *CacheUpdate) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	childMap := m.childMap(u.MapID)
+	if childMap == nil || childMap.Disabled ||
+		(u.Listed && !childMap.Listed) {
+		return ChildMapNotSyncedError
+	}
+	if !u.PushTime.IsZero() {
+		if !u.PushTime.After(childMap.LastPush) {
+			return PushReplayedError
+		}
+		childMap.LastPush = time.Unix(u.PushTime.Unix(), 0)
+	}
+
+	deleted := make(map[string]bool, len(u.Deleted))
+	for _, tombstone := range u.Deleted {
+		if tombstone.SourceID == anySource {
+			deleted[tombstone.Addr.String()] = true
+		} else {
+			deleted[copyKey(tombstone.Addr, tombstone.SourceID)] = true
+		}
+	}
+	var present map[string]bool
+	if u.Full {
+		present = make(map[string]bool, len(u.Nodes))
+		for _, node := range u.Nodes {
+			present[copyKey(node.Addr, node.SourceID)] = true
+		}
+	}
+	for key, cached := range m.cached {
+		if cached.via != u.MapID {
+			continue
+		}
+		if deleted[cached.node.Addr.String()] || deleted[key] ||
+			(u.Full && !present[key]) {
+			m.uncache(key)
+		}
+	}
+
+	for _, node := range u.Nodes {
+		if node.RetrieveTime == 0 {
+			node.RetrieveTime = time.Now().Unix()
+		}
+		m.cached[copyKey(node.Addr, node.SourceID)] = &memCached{
+			node: copyNode(node),
+			via:  u.MapID,
+		}
+		delete(m.deleted, node.Addr.String())
+	}
+
+	if !u.Time.IsZero() {
+		childMap.LastSync = time.Unix(u.Time.Unix(), 0)
+		childMap.LastAttempt = childMap.LastSync
+		if u.Full {
+			childMap.LastFullSync = childMap.LastSync
+		}
+		childMap.LastError = ""
+		childMap.Latency = Duration(u.Latency / time.Millisecond * time.Millisecond)
+		childMap.Validators = u.Validators
+		childMap.ParentID = 0
+		if u.Filtered != nil {
+			childMap.Filtered = make(map[string]int, len(u.Filtered))
+			for source, n := range u.Filtered {
+				childMap.Filtered[source] = n
+			}
+		}
+		childMap.NodeCount = 0
+		for _, cached := range m.cached {
+			if cached.via == u.MapID {
+				childMap.NodeCount++
+			}
+		}
+	}
+	return
+}
+
+func (m *MemStore) RecordSyncFailure(mapID int, attempt time.Time, message string) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if childMap := m.childMap(mapID); childMap != nil {
+		childMap.LastAttempt = time.Unix(attempt.Unix(), 0)
+		childMap.LastFailure = time.Unix(time.Now().Unix(), 0)
+		childMap.LastError = message
+	}
+	return
+}
+
+func (m *MemStore) DeleteExpiredCache() (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	expiry := time.Now().Add(-time.Duration(Conf.CacheExpiration)).Unix()
+	for key, cached := range m.cached {
+		if cached.node.RetrieveTime >= expiry {
+			continue
+		}
+		childMap := m.childMap(cached.via)
+		if childMap != nil && childMap.LastSync.Unix() >= expiry {
+			continue
+		}
+		m.uncache(key)
+	}
+	return
+}
+
+func (m *MemStore) ClearMapCache(mapID int) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for key, cached := range m.cached {
+		if cached.via == mapID {
+			m.uncache(key)
+		}
+	}
+	if childMap := m.childMap(mapID); childMap != nil {
+		childMap.LastSync = time.Time{}
+		childMap.LastFullSync = time.Time{}
+		childMap.NodeCount = 0
+		childMap.Validators = Validators{}
+		childMap.Filtered = nil
+	}
+	m.recordRemoval()
+	return
+}
+
+// uncache removes the cached copy of a node with the given key, as
+// from copyKey, and records a tombstone if no other copy of the node
+// remains. The mutex must be held.
+func (m *MemStore) uncache(key string) {
+	cached := m.cached[key]
+	if cached == nil {
+		return
+	}
+	delete(m.cached, key)
+	m.recordRemoval()
+
+	addr := cached.node.Addr.String()
+	if m.nodes[addr] != nil {
+		return
+	}
+	for _, other := range m.cached {
+		if other.node.Addr.String() == addr {
+			return
+		}
+	}
+	m.deleted[addr] = &Tombstone{
+		SourceID: cached.node.SourceID,
+		Addr:     cached.node.Addr,
+		Deleted:  time.Unix(time.Now().Unix(), 0),
+	}
+}
+
+// recordRemoval records that a row which LastModified considers has
+// just been removed. The mutex must be held.
+func (m *MemStore) recordRemoval() {
+	if now := time.Now().Unix(); now > m.removed {
+		m.removed = now
+	}
+}
+
+// childMap returns the child map with the given ID, or nil if there
+// is none. The mutex must be held.
+func (m *MemStore) childMap(id int) *ChildMap {
+	for _, childMap := range m.childMaps {
+		if childMap.ID == id {
+			return childMap
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) AddNewMapSource(address, name string) (id int, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	id = m.nextMapID
+	m.childMaps = append(m.childMaps, &ChildMap{
+		ID:       id,
+		Name:     name,
+		Hostname: address,
+	})
+	m.nextMapID++
+	return
+}
+
+func (m *MemStore) UpdateMapSourceData(address, name string) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, childMap := range m.childMaps {
+		if childMap.Hostname == address {
+			childMap.Name = name
+		}
+	}
+	return
+}
+
+func (m *MemStore) UpdateChildMap(childMap *ChildMap) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	c := m.childMap(childMap.ID)
+	if c == nil {
+		return sql.ErrNoRows
+	}
+	c.Name = childMap.Name
+	c.Listed = childMap.Listed
+	c.Disabled = childMap.Disabled
+	c.Renamed = childMap.Renamed
+	c.Key = childMap.Key
+	c.PushKey = childMap.PushKey
+	return
+}
+
+func (m *MemStore) UpdateMapParent(id, parent int) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if childMap := m.childMap(id); childMap != nil {
+		childMap.ParentID = parent
+	}
+	return
+}
+
+func (m *MemStore) DumpChildMaps() (childMaps []*ChildMap, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	childMaps = make([]*ChildMap, len(m.childMaps))
+	for i, childMap := range m.childMaps {
+		c := *childMap
+		childMaps[i] = &c
+	}
+	setChildMapParents(childMaps)
+	return
+}
+
+func (m *MemStore) GetMapSourceToID() (sourceToID map[string]int, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	sourceToID = map[string]int{
+		"local": 0,
+	}
+	for _, childMap := range m.childMaps {
+		sourceToID[childMap.Hostname] = childMap.ID
+	}
+	return
+}
+
+func (m *MemStore) GetMapIDToSource() (IDToSource map[int]string, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.idSources(), nil
+}
+
+// idSources returns a mapping of local IDs to public hostnames, as
+// GetMapIDToSource does. The mutex must be held.
+func (m *MemStore) idSources() (IDToSource map[int]string) {
+	IDToSource = map[int]string{
+		0: "local",
+	}
+	for _, childMap := range m.childMaps {
+		IDToSource[childMap.ID] = childMap.Hostname
+	}
+	return
+}
+
+func (m *MemStore) FindSourceMap(id int) (source string, err error) {
+	if id == 0 {
+		return "local", nil
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, childMap := range m.childMaps {
+		if childMap.ID == id {
+			return childMap.Hostname, nil
+		}
+	}
+	return "", sql.ErrNoRows
+}
+
+func (m *MemStore) UpdatePeers(pairs []Pair, seen time.Time) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// Times are kept to the second, as they are by DB.
+	seen = time.Unix(seen.Unix(), 0)
+	found := make(map[string]bool, len(pairs))
+	for _, pair := range pairs {
+		key := peerKey(pair)
+		found[key] = true
+
+		p := m.peers[key]
+		if p != nil && !p.Dropped.IsZero() {
+			m.peerHistory = append(m.peerHistory, p)
+		}
+		if p == nil || !p.Dropped.IsZero() {
+			p = &Pair{A: pair.A, B: pair.B, FirstSeen: seen}
+			m.peers[key] = p
+		}
+		p.LastSeen = seen
+		p.Quality = pair.Quality
+	}
+	for key, p := range m.peers {
+		if !found[key] && p.Dropped.IsZero() {
+			p.Dropped = seen
+		}
+	}
+	return
+}
+
+func (m *MemStore) DumpPeers() (pairs []*Pair, err error) {
+	return m.selectPeers(false, func(p *Pair) bool {
+		return p.Dropped.IsZero()
+	}), nil
+}
+
+func (m *MemStore) DumpPeerChanges(since time.Time) (pairs []*Pair, err error) {
+	since = time.Unix(since.Unix(), 0)
+	return m.selectPeers(true, func(p *Pair) bool {
+		return !p.FirstSeen.Before(since) ||
+			(!p.Dropped.IsZero() && !p.Dropped.Before(since))
+	}), nil
+}
+
+func (m *MemStore) GetPeersOf(addr IP) (pairs []*Pair, err error) {
+	return m.selectPeers(true, func(p *Pair) bool {
+		return string(addr) == string(p.A) || string(addr) == string(p.B)
+	}), nil
+}
+
+// selectPeers returns copies of the links for which the given function
+// returns true, including their earlier appearances if history is
+// true, ordered by address and then by when they were first seen.
+func (m *MemStore) selectPeers(history bool, match func(*Pair) bool) (pairs []*Pair) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	pairs = make([]*Pair, 0)
+	add := func(p *Pair) {
+		if match(p) {
+			c := *p
+			pairs = append(pairs, &c)
+		}
+	}
+	for _, p := range m.peers {
+		add(p)
+	}
+	if history {
+		for _, p := range m.peerHistory {
+			add(p)
+		}
+	}
+	sort.Sort(pairsByAddr(pairs))
+	return
+}
+
+func (m *MemStore) QueuePush(parents []string, event *PushEvent) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, parent := range parents {
+		m.nextOutboxID++
+		e := *event
+		e.ID = m.nextOutboxID
+		e.Node = copyNode(event.Node)
+		m.outbox = append(m.outbox, &memPushed{parent, &e})
+	}
+	return
+}
+
+func (m *MemStore) DumpOutbox(parent string, limit int) (events []*PushEvent, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	events = make([]*PushEvent, 0)
+	for _, p := range m.outbox {
+		if len(events) == limit {
+			break
+		}
+		if p.parent == parent {
+			e := *p.event
+			e.Node = copyNode(p.event.Node)
+			events = append(events, &e)
+		}
+	}
+	return
+}
+
+func (m *MemStore) DeleteOutbox(parent string, through int64) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	outbox := make([]*memPushed, 0, len(m.outbox))
+	for _, p := range m.outbox {
+		if p.parent != parent || p.event.ID > through {
+			outbox = append(outbox, p)
+		}
+	}
+	m.outbox = outbox
+	return
+}
+
+func (m *MemStore) DeleteExpiredOutbox() (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	expiry := time.Now().Add(-time.Duration(Conf.CacheExpiration)).Unix()
+	outbox := make([]*memPushed, 0, len(m.outbox))
+	for _, p := range m.outbox {
+		if p.event.Time.Unix() >= expiry {
+			outbox = append(outbox, p)
+		}
+	}
+	m.outbox = outbox
+	return
+}
+
+func (m *MemStore) QueueNode(id int64, emailsent bool, grace Duration, node *Node) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.queue[id] != nil {
+		return DuplicateKeyError
+	}
+	m.queue[id] = &memQueued{
+		node:       copyNode(node),
+		verifysent: emailsent,
+		expiration: time.Now().Add(time.Duration(grace)).Unix(),
+	}
+	return
+}
+
+func (m *MemStore) GetQueuedNode(id int64) (node *Node, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	queued := m.queue[id]
+	if queued == nil {
+		return nil, sql.ErrNoRows
+	}
+	node = copyNode(queued.node)
+	node.SourceID = 0
+	node.RetrieveTime = 0
+	return
+}
+
+func (m *MemStore) DeleteQueuedNode(id int64) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.queue, id)
+	return
+}
+
+func (m *MemStore) DeleteExpiredFromQueue() (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now().Unix()
+	for id, queued := range m.queue {
+		if queued.expiration <= now {
+			delete(m.queue, id)
+		}
+	}
+	return
+}
+
+func (m *MemStore) DumpUnsentVerifications() (emails map[int64]string, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	emails = make(map[int64]string)
+	for id, queued := range m.queue {
+		if !queued.verifysent {
+			emails[id] = queued.node.OwnerEmail
+		}
+	}
+	return
+}
+
+func (m *MemStore) SetVerificationSent(id int64) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if queued := m.queue[id]; queued != nil {
+		queued.verifysent = true
+	}
+	return
+}
+
+func (m *MemStore) SetCAPTCHA(id string, solution []byte, expiration time.Time) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.captchas[id] = &memCAPTCHA{
+		solution:   append([]byte(nil), solution...),
+		expiration: expiration.Unix(),
+	}
+	return
+}
+
+func (m *MemStore) GetCAPTCHA(id string) (solution []byte, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	c := m.captchas[id]
+	if c == nil || c.expiration <= time.Now().Unix() {
+		return nil, sql.ErrNoRows
+	}
+	return append([]byte(nil), c.solution...), nil
+}
+
+func (m *MemStore) DeleteCAPTCHA(id string) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.captchas, id)
+	return
+}
+
+func (m *MemStore) DeleteExpiredCAPTCHAs() (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now().Unix()
+	for id, c := range m.captchas {
+		if c.expiration <= now {
+			delete(m.captchas, id)
+		}
+	}
+	return
+}
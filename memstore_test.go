@@ -0,0 +1,200 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coocood/jas"
+	"github.com/inhies/go-log"
+)
+
+// useMemStore replaces Db with a new MemStore, and Conf with a
+// configuration which registers nodes without verification, for the
+// duration of a test. The node RSS feed is written to a temporary
+// static directory. It returns a function which removes it.
+func useMemStore(t *testing.T) (cleanup func()) {
+	l, _ = log.NewLevel(log.ERR, false, os.Stderr, "", 0)
+
+	Conf = &Config{CacheExpiration: Duration(time.Hour)}
+	err := json.Unmarshal([]byte(`{"SMTP": {"VerifyDisabled": true}}`),
+		Conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Db = NewMemStore()
+
+	StaticDir, err = ioutil.TempDir("", "nodeatlas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(filepath.Join(StaticDir, "web"), 0755); err != nil {
+		os.RemoveAll(StaticDir)
+		t.Fatal(err)
+	}
+	CleanNodeRSS()
+	return func() { os.RemoveAll(StaticDir) }
+}
+
+// apiResponse is the body of a response from the API.
+type apiResponse struct {
+	Data  interface{} `json:"data"`
+	Error interface{} `json:"error"`
+}
+
+// callAPI makes a request to the given router with the given method,
+// path, and form values, and returns the decoded response.
+func callAPI(t *testing.T, router http.Handler, method, path string, form url.Values) (resp apiResponse) {
+	req, err := http.NewRequest(method, path,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "192.0.2.1:4321"
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if err = json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s %s gave %q: %s", method, path, w.Body.String(), err)
+	}
+	return
+}
+
+func TestMemStorePostNode(t *testing.T) {
+	defer useMemStore(t)()
+	router := jas.NewRouter(new(Api))
+
+	register := func(name string) apiResponse {
+		token := callAPI(t, router, "GET", "/api/token", nil)
+		id, ok := token.Data.(float64)
+		if !ok {
+			t.Fatalf("token is %v", token.Data)
+		}
+		return callAPI(t, router, "POST", "/api/node", url.Values{
+			"token":     {strconv.FormatUint(uint64(id), 10)},
+			"address":   {"fc00::1"},
+			"latitude":  {"39.2"},
+			"longitude": {"-76.6"},
+			"name":      {name},
+			"email":     {"owner@example.com"},
+		})
+	}
+
+	if resp := register("Owner"); resp.Error != nil ||
+		resp.Data != "node registered" {
+		t.Fatalf("registering gave %+v", resp)
+	}
+	addr := IP(net.ParseIP("fc00::1"))
+	node, err := Db.GetNode(addr)
+	if err != nil || node == nil {
+		t.Fatalf("registered node is %v: %v", node, err)
+	}
+	if node.OwnerName != "Owner" || node.OwnerEmail != "owner@example.com" ||
+		node.Latitude != 39.2 || node.Longitude != -76.6 {
+		t.Errorf("registered node is %+v", node)
+	}
+	if history, err := Db.NodeHistory(addr); err != nil ||
+		len(history) != 1 || history[0].Action != ActionAdd {
+		t.Errorf("history is %v: %v", history, err)
+	}
+
+	// The address is already registered, so it is refused.
+	if resp := register("Other"); resp.Error == nil {
+		t.Errorf("registering again gave %+v", resp)
+	}
+	if node, _ = Db.GetNode(addr); node.OwnerName != "Owner" {
+		t.Errorf("node was replaced by %+v", node)
+	}
+}
+
+func TestMemStoreSyncChildMap(t *testing.T) {
+	defer useMemStore(t)()
+
+	local := &Node{Addr: IP(net.ParseIP("fc00::1")), OwnerName: "Local"}
+	relayed := &Node{Addr: IP(net.ParseIP("fc00::2")), OwnerName: "Relayed"}
+
+	// The child map gives every node on the first sync, and then only
+	// those which have changed since.
+	var since []string
+	child := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var data interface{}
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/api/status"):
+				data = map[string]string{"Name": "Child"}
+			case len(r.FormValue("since")) == 0:
+				since = append(since, "")
+				data = map[string][]*Node{
+					"local":             {local},
+					"http://grandchild": {relayed},
+				}
+			default:
+				since = append(since, r.FormValue("since"))
+				updated := *local
+				updated.OwnerName = "Updated"
+				data = map[string]interface{}{
+					"nodes": map[string][]*Node{"local": {&updated}},
+					"deleted": []*Tombstone{{
+						Addr:    relayed.Addr,
+						Source:  "http://grandchild",
+						Deleted: time.Now(),
+					}},
+				}
+			}
+			json.NewEncoder(w).Encode(apiResponse{Data: data})
+		}))
+	defer child.Close()
+	configs := []ChildMapConfig{{Address: child.URL}}
+
+	if err := SyncChildMaps(configs); err != nil {
+		t.Fatal(err)
+	}
+	if n := Db.LenNodes(true); n != 2 {
+		t.Fatalf("%d nodes were cached, not 2", n)
+	}
+	ids, err := Db.GetMapSourceToID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := Db.GetNode(local.Addr)
+	if err != nil || node == nil || node.SourceID != ids[child.URL] {
+		t.Fatalf("cached node is %+v: %v", node, err)
+	}
+	node, err = Db.GetNode(relayed.Addr)
+	if err != nil || node == nil || node.SourceID != ids["http://grandchild"] {
+		t.Fatalf("relayed node is %+v: %v", node, err)
+	}
+
+	start := time.Now().Add(-time.Minute)
+	if err = SyncChildMaps(configs); err != nil {
+		t.Fatal(err)
+	}
+	if len(since) != 2 || len(since[1]) == 0 {
+		t.Fatalf("the second sync was not incremental: %q", since)
+	}
+	if node, _ = Db.GetNode(local.Addr); node == nil ||
+		node.OwnerName != "Updated" {
+		t.Errorf("updated node is %+v", node)
+	}
+	if node, _ = Db.GetNode(relayed.Addr); node != nil {
+		t.Errorf("deleted node is %+v", node)
+	}
+	deleted, err := Db.DumpDeleted(start)
+	if err != nil || len(deleted) != 1 ||
+		deleted[0].SourceID != ids["http://grandchild"] {
+		t.Errorf("tombstones are %v: %v", deleted, err)
+	}
+}
@@ -0,0 +1,845 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Migration is a single step in the evolution of the database
+// schema. Migrations are applied in order of increasing Version, and
+// each one is recorded in the schema_version table once it has been
+// applied, so that it is never applied twice.
+type Migration struct {
+	// Version is the schema version which the database will be at
+	// once the Migration has been applied. It must be unique and
+	// greater than that of the previous Migration.
+	Version int
+
+	// Description is a short, human-readable summary of the changes
+	// made by the Migration.
+	Description string
+
+	// Statements maps database driver names, such as "sqlite3",
+	// "mysql", and "postgres", to the SQL statements which must be
+	// executed, in order, to apply the Migration under that dialect.
+	Statements map[string][]string
+}
+
+// SchemaTooNewError is returned when the database has been migrated
+// by a newer version of NodeAtlas than the one running.
+type SchemaTooNewError struct {
+	Version, Latest int
+}
+
+func (err SchemaTooNewError) Error() string {
+	return fmt.Sprintf("database schema version %d is newer than the "+
+		"latest known to this binary (%d)", err.Version, err.Latest)
+}
+
+// UnsupportedDriverError is returned when a Migration has no
+// statements for the configured database driver.
+type UnsupportedDriverError struct {
+	DriverName string
+	Version    int
+}
+
+func (err UnsupportedDriverError) Error() string {
+	return fmt.Sprintf("migration %d has no statements for driver %q",
+		err.Version, err.DriverName)
+}
+
+// Migrations is the ordered list of every schema change made to the
+// database. To change the schema, append a new Migration to the end
+// of the list; never modify one which has already been released.
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create initial tables",
+		Statements: map[string][]string{
+			"sqlite3": {
+				createNodesTable,
+				createNodesCachedTable,
+				createNodesVerifyQueueTable,
+				`CREATE TABLE IF NOT EXISTS cached_maps (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+hostname VARCHAR(255) NOT NULL,
+name VARCHAR(255) NOT NULL);`,
+				createCaptchaTable,
+			},
+			// <mysql> SQL? A standard? Hahahaha!
+			"mysql": {
+				createNodesTable,
+				createNodesCachedTable,
+				createNodesVerifyQueueTable,
+				`CREATE TABLE IF NOT EXISTS cached_maps (
+id INTEGER PRIMARY KEY AUTO_INCREMENT,
+hostname VARCHAR(255) NOT NULL,
+name VARCHAR(255) NOT NULL);`,
+				createCaptchaTable,
+			},
+			// PostgreSQL has no BINARY type, and its INT is too
+			// small for uint32 statuses and int64 queue IDs.
+			"postgres": {
+				`CREATE TABLE IF NOT EXISTS nodes (
+address BYTEA PRIMARY KEY,
+owner VARCHAR(255) NOT NULL,
+email VARCHAR(255) NOT NULL,
+contact VARCHAR(255),
+details VARCHAR(255),
+pgp BYTEA,
+lat DOUBLE PRECISION NOT NULL,
+lon DOUBLE PRECISION NOT NULL,
+status BIGINT NOT NULL,
+updated BIGINT NOT NULL);`,
+				`CREATE TABLE IF NOT EXISTS nodes_cached (
+address BYTEA PRIMARY KEY,
+owner VARCHAR(255) NOT NULL,
+details VARCHAR(255),
+lat DOUBLE PRECISION NOT NULL,
+lon DOUBLE PRECISION NOT NULL,
+status BIGINT NOT NULL,
+source INT NOT NULL,
+retrieved BIGINT NOT NULL);`,
+				`CREATE TABLE IF NOT EXISTS nodes_verify_queue (
+id BIGINT PRIMARY KEY,
+address BYTEA NOT NULL,
+owner VARCHAR(255) NOT NULL,
+email VARCHAR(255) NOT NULL,
+contact VARCHAR(255),
+details VARCHAR(255),
+pgp BYTEA,
+lat DOUBLE PRECISION NOT NULL,
+lon DOUBLE PRECISION NOT NULL,
+status BIGINT NOT NULL,
+verifysent BOOLEAN NOT NULL,
+expiration BIGINT NOT NULL);`,
+				`CREATE TABLE IF NOT EXISTS cached_maps (
+id SERIAL PRIMARY KEY,
+hostname VARCHAR(255) NOT NULL,
+name VARCHAR(255) NOT NULL);`,
+				`CREATE TABLE IF NOT EXISTS captcha (
+id BYTEA NOT NULL,
+solution BYTEA NOT NULL,
+expiration BIGINT NOT NULL);`,
+			},
+		},
+	},
+	{
+		Version:     2,
+		Description: "add node change history",
+		Statements: map[string][]string{
+			"sqlite3": {
+				`CREATE TABLE nodes_history (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+address BINARY(16) NOT NULL,
+action VARCHAR(16) NOT NULL,
+actor VARCHAR(255) NOT NULL,
+changed INT NOT NULL,
+owner VARCHAR(255) NOT NULL,
+contact VARCHAR(255),
+details VARCHAR(255),
+pgp BINARY(8),
+lat FLOAT NOT NULL,
+lon FLOAT NOT NULL,
+status INT NOT NULL);`,
+				createNodesHistoryAddressIndex,
+				createNodesHistoryChangedIndex,
+				seedNodesHistory,
+			},
+			"mysql": {
+				`CREATE TABLE nodes_history (
+id INTEGER PRIMARY KEY AUTO_INCREMENT,
+address BINARY(16) NOT NULL,
+action VARCHAR(16) NOT NULL,
+actor VARCHAR(255) NOT NULL,
+changed INT NOT NULL,
+owner VARCHAR(255) NOT NULL,
+contact VARCHAR(255),
+details VARCHAR(255),
+pgp BINARY(8),
+lat FLOAT NOT NULL,
+lon FLOAT NOT NULL,
+status INT NOT NULL);`,
+				createNodesHistoryAddressIndex,
+				createNodesHistoryChangedIndex,
+				seedNodesHistory,
+			},
+			"postgres": {
+				`CREATE TABLE nodes_history (
+id SERIAL PRIMARY KEY,
+address BYTEA NOT NULL,
+action VARCHAR(16) NOT NULL,
+actor VARCHAR(255) NOT NULL,
+changed BIGINT NOT NULL,
+owner VARCHAR(255) NOT NULL,
+contact VARCHAR(255),
+details VARCHAR(255),
+pgp BYTEA,
+lat DOUBLE PRECISION NOT NULL,
+lon DOUBLE PRECISION NOT NULL,
+status BIGINT NOT NULL);`,
+				createNodesHistoryAddressIndex,
+				createNodesHistoryChangedIndex,
+				seedNodesHistory,
+			},
+		},
+	},
+	{
+		Version:     3,
+		Description: "add deletion tombstones",
+		Statements: map[string][]string{
+			"sqlite3": {
+				`CREATE TABLE nodes_deleted (
+address BINARY(16) PRIMARY KEY,
+source INT NOT NULL,
+deleted INT NOT NULL);`,
+			},
+			"mysql": {
+				`CREATE TABLE nodes_deleted (
+address BINARY(16) PRIMARY KEY,
+source INT NOT NULL,
+deleted INT NOT NULL);`,
+			},
+			"postgres": {
+				`CREATE TABLE nodes_deleted (
+address BYTEA PRIMARY KEY,
+source INT NOT NULL,
+deleted BIGINT NOT NULL);`,
+			},
+		},
+	},
+	{
+		Version:     4,
+		Description: "index node coordinates",
+		Statements: map[string][]string{
+			"sqlite3":  createCoordinateIndexes,
+			"mysql":    createCoordinateIndexes,
+			"postgres": createCoordinateIndexes,
+		},
+	},
+	{
+		Version:     5,
+		Description: "track incremental sync of child maps",
+		Statements: map[string][]string{
+			"sqlite3": {
+				`ALTER TABLE cached_maps
+ADD COLUMN lastsync INT NOT NULL DEFAULT 0;`,
+				`ALTER TABLE cached_maps
+ADD COLUMN lastfullsync INT NOT NULL DEFAULT 0;`,
+				clearNodesCached,
+				addNodesCachedVia,
+				createNodesCachedViaIndex,
+			},
+			"mysql": {
+				`ALTER TABLE cached_maps
+ADD COLUMN lastsync INT NOT NULL DEFAULT 0;`,
+				`ALTER TABLE cached_maps
+ADD COLUMN lastfullsync INT NOT NULL DEFAULT 0;`,
+				clearNodesCached,
+				addNodesCachedVia,
+				createNodesCachedViaIndex,
+			},
+			"postgres": {
+				`ALTER TABLE cached_maps
+ADD COLUMN lastsync BIGINT NOT NULL DEFAULT 0;`,
+				`ALTER TABLE cached_maps
+ADD COLUMN lastfullsync BIGINT NOT NULL DEFAULT 0;`,
+				clearNodesCached,
+				addNodesCachedVia,
+				createNodesCachedViaIndex,
+			},
+		},
+	},
+	{
+		Version:     6,
+		Description: "track failed syncs of child maps",
+		Statements: map[string][]string{
+			"sqlite3": {
+				`ALTER TABLE cached_maps
+ADD COLUMN lastfailure INT NOT NULL DEFAULT 0;`,
+			},
+			"mysql": {
+				`ALTER TABLE cached_maps
+ADD COLUMN lastfailure INT NOT NULL DEFAULT 0;`,
+			},
+			"postgres": {
+				`ALTER TABLE cached_maps
+ADD COLUMN lastfailure BIGINT NOT NULL DEFAULT 0;`,
+			},
+		},
+	},
+	{
+		Version:     7,
+		Description: "track health of child maps",
+		Statements: map[string][]string{
+			"sqlite3": {
+				`ALTER TABLE cached_maps
+ADD COLUMN lastattempt INT NOT NULL DEFAULT 0;`,
+				addCachedMapsLastError,
+				addCachedMapsLatency,
+				addCachedMapsNodeCount,
+			},
+			"mysql": {
+				`ALTER TABLE cached_maps
+ADD COLUMN lastattempt INT NOT NULL DEFAULT 0;`,
+				addCachedMapsLastError,
+				addCachedMapsLatency,
+				addCachedMapsNodeCount,
+			},
+			"postgres": {
+				`ALTER TABLE cached_maps
+ADD COLUMN lastattempt BIGINT NOT NULL DEFAULT 0;`,
+				addCachedMapsLastError,
+				addCachedMapsLatency,
+				addCachedMapsNodeCount,
+			},
+		},
+	},
+	{
+		Version:     8,
+		Description: "cache nodes with the same address from several sources",
+		Statements: map[string][]string{
+			// SQLite cannot change the primary key of an existing
+			// table, so it is copied to a new one.
+			"sqlite3": {
+				`CREATE TABLE nodes_cached_new (
+address BINARY(16) NOT NULL,
+owner VARCHAR(255) NOT NULL,
+details VARCHAR(255),
+lat FLOAT NOT NULL,
+lon FLOAT NOT NULL,
+status INT NOT NULL,
+source INT NOT NULL,
+retrieved INT NOT NULL,
+via INT NOT NULL DEFAULT 0,
+PRIMARY KEY (address, source));`,
+				`INSERT INTO nodes_cached_new
+SELECT address, owner, details, lat, lon, status, source, retrieved,
+via FROM nodes_cached;`,
+				`DROP TABLE nodes_cached;`,
+				`ALTER TABLE nodes_cached_new RENAME TO nodes_cached;`,
+				`CREATE INDEX nodes_cached_lat_lon
+ON nodes_cached (lat, lon);`,
+				createNodesCachedViaIndex,
+			},
+			"mysql": {
+				`ALTER TABLE nodes_cached
+DROP PRIMARY KEY, ADD PRIMARY KEY (address, source);`,
+			},
+			"postgres": {
+				`ALTER TABLE nodes_cached
+DROP CONSTRAINT nodes_cached_pkey, ADD PRIMARY KEY (address, source);`,
+			},
+		},
+	},
+	{
+		Version:     9,
+		Description: "add outbox of changes to push to parent maps",
+		Statements: map[string][]string{
+			"sqlite3": {
+				`CREATE TABLE outbox (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+parent VARCHAR(255) NOT NULL,
+action VARCHAR(16) NOT NULL,
+address BINARY(16) NOT NULL,
+changed INT NOT NULL,
+owner VARCHAR(255) NOT NULL,
+details VARCHAR(255),
+lat FLOAT NOT NULL,
+lon FLOAT NOT NULL,
+status INT NOT NULL);`,
+				createOutboxParentIndex,
+			},
+			"mysql": {
+				`CREATE TABLE outbox (
+id INTEGER PRIMARY KEY AUTO_INCREMENT,
+parent VARCHAR(255) NOT NULL,
+action VARCHAR(16) NOT NULL,
+address BINARY(16) NOT NULL,
+changed INT NOT NULL,
+owner VARCHAR(255) NOT NULL,
+details VARCHAR(255),
+lat FLOAT NOT NULL,
+lon FLOAT NOT NULL,
+status INT NOT NULL);`,
+				createOutboxParentIndex,
+			},
+			"postgres": {
+				`CREATE TABLE outbox (
+id SERIAL PRIMARY KEY,
+parent VARCHAR(255) NOT NULL,
+action VARCHAR(16) NOT NULL,
+address BYTEA NOT NULL,
+changed BIGINT NOT NULL,
+owner VARCHAR(255) NOT NULL,
+details VARCHAR(255),
+lat DOUBLE PRECISION NOT NULL,
+lon DOUBLE PRECISION NOT NULL,
+status BIGINT NOT NULL);`,
+				createOutboxParentIndex,
+			},
+		},
+	},
+	{
+		Version:     10,
+		Description: "manage child maps through the admin API",
+		Statements: map[string][]string{
+			"sqlite3": {
+				addCachedMapsListed,
+				addCachedMapsDisabled,
+				addCachedMapsRenamed,
+				addCachedMapsPubKey,
+				addCachedMapsPushKey,
+			},
+			"mysql": {
+				addCachedMapsListed,
+				addCachedMapsDisabled,
+				addCachedMapsRenamed,
+				addCachedMapsPubKey,
+				addCachedMapsPushKey,
+			},
+			"postgres": {
+				addCachedMapsListed,
+				addCachedMapsDisabled,
+				addCachedMapsRenamed,
+				addCachedMapsPubKey,
+				addCachedMapsPushKey,
+			},
+		},
+	},
+	{
+		Version:     11,
+		Description: "remember validators of child map responses",
+		Statements: map[string][]string{
+			"sqlite3": {
+				addCachedMapsETag,
+				addCachedMapsLastModified,
+				`CREATE TABLE last_removal (removed INT NOT NULL);`,
+				insertLastRemoval,
+			},
+			"mysql": {
+				addCachedMapsETag,
+				addCachedMapsLastModified,
+				`CREATE TABLE last_removal (removed INT NOT NULL);`,
+				insertLastRemoval,
+			},
+			"postgres": {
+				addCachedMapsETag,
+				addCachedMapsLastModified,
+				`CREATE TABLE last_removal (removed BIGINT NOT NULL);`,
+				insertLastRemoval,
+			},
+		},
+	},
+	{
+		Version:     12,
+		Description: "count nodes filtered from child maps",
+		Statements: map[string][]string{
+			"sqlite3": {
+				addCachedMapsFiltered,
+			},
+			"mysql": {
+				addCachedMapsFiltered,
+			},
+			"postgres": {
+				addCachedMapsFiltered,
+			},
+		},
+	},
+	{
+		Version:     13,
+		Description: "record which maps relay each other",
+		Statements: map[string][]string{
+			"sqlite3": {
+				addCachedMapsParent,
+			},
+			"mysql": {
+				addCachedMapsParent,
+			},
+			"postgres": {
+				addCachedMapsParent,
+			},
+		},
+	},
+	{
+		Version:     14,
+		Description: "store the links between nodes and their history",
+		Statements: map[string][]string{
+			"sqlite3": {
+				`CREATE TABLE peers (
+a BINARY(16) NOT NULL,
+b BINARY(16) NOT NULL,
+firstseen INT NOT NULL,
+lastseen INT NOT NULL,
+dropped INT NOT NULL DEFAULT 0,
+PRIMARY KEY (a, b));`,
+				createPeersBIndex,
+				`CREATE TABLE peers_history (
+a BINARY(16) NOT NULL,
+b BINARY(16) NOT NULL,
+firstseen INT NOT NULL,
+lastseen INT NOT NULL,
+dropped INT NOT NULL);`,
+				createPeersHistoryAIndex,
+				createPeersHistoryBIndex,
+			},
+			"mysql": {
+				`CREATE TABLE peers (
+a BINARY(16) NOT NULL,
+b BINARY(16) NOT NULL,
+firstseen INT NOT NULL,
+lastseen INT NOT NULL,
+dropped INT NOT NULL DEFAULT 0,
+PRIMARY KEY (a, b));`,
+				createPeersBIndex,
+				`CREATE TABLE peers_history (
+a BINARY(16) NOT NULL,
+b BINARY(16) NOT NULL,
+firstseen INT NOT NULL,
+lastseen INT NOT NULL,
+dropped INT NOT NULL);`,
+				createPeersHistoryAIndex,
+				createPeersHistoryBIndex,
+			},
+			"postgres": {
+				`CREATE TABLE peers (
+a BYTEA NOT NULL,
+b BYTEA NOT NULL,
+firstseen BIGINT NOT NULL,
+lastseen BIGINT NOT NULL,
+dropped BIGINT NOT NULL DEFAULT 0,
+PRIMARY KEY (a, b));`,
+				createPeersBIndex,
+				`CREATE TABLE peers_history (
+a BYTEA NOT NULL,
+b BYTEA NOT NULL,
+firstseen BIGINT NOT NULL,
+lastseen BIGINT NOT NULL,
+dropped BIGINT NOT NULL);`,
+				createPeersHistoryAIndex,
+				createPeersHistoryBIndex,
+			},
+		},
+	},
+	{
+		Version:     15,
+		Description: "record the quality of links between nodes",
+		Statements: map[string][]string{
+			"sqlite3": {
+				`ALTER TABLE peers
+ADD COLUMN quality FLOAT NOT NULL DEFAULT 0;`,
+				`ALTER TABLE peers_history
+ADD COLUMN quality FLOAT NOT NULL DEFAULT 0;`,
+			},
+			"mysql": {
+				`ALTER TABLE peers
+ADD COLUMN quality FLOAT NOT NULL DEFAULT 0;`,
+				`ALTER TABLE peers_history
+ADD COLUMN quality FLOAT NOT NULL DEFAULT 0;`,
+			},
+			"postgres": {
+				`ALTER TABLE peers
+ADD COLUMN quality DOUBLE PRECISION NOT NULL DEFAULT 0;`,
+				`ALTER TABLE peers_history
+ADD COLUMN quality DOUBLE PRECISION NOT NULL DEFAULT 0;`,
+			},
+		},
+	},
+	{
+		Version:     16,
+		Description: "reject replayed pushes from child maps",
+		Statements: map[string][]string{
+			"sqlite3": {
+				`ALTER TABLE cached_maps
+ADD COLUMN lastpush INT NOT NULL DEFAULT 0;`,
+			},
+			"mysql": {
+				`ALTER TABLE cached_maps
+ADD COLUMN lastpush INT NOT NULL DEFAULT 0;`,
+			},
+			"postgres": {
+				`ALTER TABLE cached_maps
+ADD COLUMN lastpush BIGINT NOT NULL DEFAULT 0;`,
+			},
+		},
+	},
+}
+
+// createCoordinateIndexes allows nodes to be found by location
+// without scanning every row.
+var createCoordinateIndexes = []string{
+	`CREATE INDEX nodes_lat_lon ON nodes (lat, lon);`,
+	`CREATE INDEX nodes_cached_lat_lon ON nodes_cached (lat, lon);`,
+}
+
+// The following statements are shared between dialects by the
+// initial Migration. They use CREATE TABLE IF NOT EXISTS so that
+// databases created before the schema_version table existed can be
+// brought under version control without being modified.
+const (
+	createNodesTable = `CREATE TABLE IF NOT EXISTS nodes (
+address BINARY(16) PRIMARY KEY,
+owner VARCHAR(255) NOT NULL,
+email VARCHAR(255) NOT NULL,
+contact VARCHAR(255),
+details VARCHAR(255),
+pgp BINARY(8),
+lat FLOAT NOT NULL,
+lon FLOAT NOT NULL,
+status INT NOT NULL,
+updated INT NOT NULL);`
+
+	createNodesCachedTable = `CREATE TABLE IF NOT EXISTS nodes_cached (
+address BINARY(16) PRIMARY KEY,
+owner VARCHAR(255) NOT NULL,
+details VARCHAR(255),
+lat FLOAT NOT NULL,
+lon FLOAT NOT NULL,
+status INT NOT NULL,
+source INT NOT NULL,
+retrieved INT NOT NULL);`
+
+	createNodesVerifyQueueTable = `CREATE TABLE IF NOT EXISTS nodes_verify_queue (
+id INT PRIMARY KEY,
+address BINARY(16) NOT NULL,
+owner VARCHAR(255) NOT NULL,
+email VARCHAR(255) NOT NULL,
+contact VARCHAR(255),
+details VARCHAR(255),
+pgp BINARY(8),
+lat FLOAT NOT NULL,
+lon FLOAT NOT NULL,
+status INT NOT NULL,
+verifysent BOOL NOT NULL,
+expiration INT NOT NULL);`
+
+	createCaptchaTable = `CREATE TABLE IF NOT EXISTS captcha (
+id BINARY(32) NOT NULL,
+solution BINARY(6) NOT NULL,
+expiration INT NOT NULL);`
+)
+
+// The following statements are shared between dialects by the
+// Migration which adds node change history. Existing local nodes are
+// recorded as having been added at their last update, so that as-of
+// queries can find them.
+const (
+	createNodesHistoryAddressIndex = `CREATE INDEX nodes_history_address
+ON nodes_history (address);`
+
+	createNodesHistoryChangedIndex = `CREATE INDEX nodes_history_changed
+ON nodes_history (changed);`
+
+	seedNodesHistory = `INSERT INTO nodes_history
+(address, action, actor, changed,
+owner, contact, details, pgp, lat, lon, status)
+SELECT address, 'add', '', updated,
+owner, contact, details, pgp, lat, lon, status
+FROM nodes;`
+)
+
+// The following statements are shared between dialects by the
+// Migration which tracks incremental sync. Cached nodes record the ID
+// of the child map they were retrieved through, which may differ
+// from their source if that map relays them from its own child maps.
+// Existing cached nodes do not know it, so they are discarded, and
+// will be retrieved again by the next full sync.
+const (
+	clearNodesCached = `DELETE FROM nodes_cached;`
+
+	addNodesCachedVia = `ALTER TABLE nodes_cached
+ADD COLUMN via INT NOT NULL DEFAULT 0;`
+
+	createNodesCachedViaIndex = `CREATE INDEX nodes_cached_via
+ON nodes_cached (via);`
+)
+
+// The following statements are shared between dialects by the
+// Migration which tracks the health of child maps. Latency is in
+// milliseconds.
+const (
+	addCachedMapsLastError = `ALTER TABLE cached_maps
+ADD COLUMN lasterror VARCHAR(255) NOT NULL DEFAULT '';`
+
+	addCachedMapsLatency = `ALTER TABLE cached_maps
+ADD COLUMN latency INT NOT NULL DEFAULT 0;`
+
+	addCachedMapsNodeCount = `ALTER TABLE cached_maps
+ADD COLUMN nodecount INT NOT NULL DEFAULT 0;`
+)
+
+// createOutboxParentIndex is shared between dialects by the Migration
+// which adds the outbox, which is read one parent map at a time.
+const createOutboxParentIndex = `CREATE INDEX outbox_parent
+ON outbox (parent, id);`
+
+// The following statements are shared between dialects by the
+// Migration which allows child maps to be managed through the admin
+// API, rather than only listed in the configuration.
+const (
+	addCachedMapsListed = `ALTER TABLE cached_maps
+ADD COLUMN listed BOOL NOT NULL DEFAULT FALSE;`
+
+	addCachedMapsDisabled = `ALTER TABLE cached_maps
+ADD COLUMN disabled BOOL NOT NULL DEFAULT FALSE;`
+
+	addCachedMapsRenamed = `ALTER TABLE cached_maps
+ADD COLUMN renamed BOOL NOT NULL DEFAULT FALSE;`
+
+	addCachedMapsPubKey = `ALTER TABLE cached_maps
+ADD COLUMN pubkey VARCHAR(64) NOT NULL DEFAULT '';`
+
+	addCachedMapsPushKey = `ALTER TABLE cached_maps
+ADD COLUMN pushkey VARCHAR(255) NOT NULL DEFAULT '';`
+)
+
+// The following statements are shared between dialects by the
+// Migration which allows child maps to be fetched conditionally. The
+// Last-Modified header is kept as it was sent. The last_removal table
+// holds a single row, which records when rows were last removed, so
+// that removals advance the Last-Modified time of responses.
+const (
+	addCachedMapsETag = `ALTER TABLE cached_maps
+ADD COLUMN etag VARCHAR(255) NOT NULL DEFAULT '';`
+
+	addCachedMapsLastModified = `ALTER TABLE cached_maps
+ADD COLUMN lastmodified VARCHAR(64) NOT NULL DEFAULT '';`
+
+	insertLastRemoval = `INSERT INTO last_removal (removed) VALUES (0);`
+)
+
+// addCachedMapsFiltered is shared between dialects by the Migration
+// which counts the nodes filtered from each child map. The counts are
+// kept as a JSON object of sources to numbers, and are NULL until the
+// map is next fully synced.
+const addCachedMapsFiltered = `ALTER TABLE cached_maps
+ADD COLUMN filtered TEXT;`
+
+// addCachedMapsParent is shared between dialects by the Migration
+// which records the map through which each other map is relayed, by
+// its ID, so that the federation can be given as a tree.
+const addCachedMapsParent = `ALTER TABLE cached_maps
+ADD COLUMN parent INT NOT NULL DEFAULT 0;`
+
+// The following statements are shared between dialects by the
+// Migration which adds the peers and peers_history tables, so that
+// the links of a node, and their earlier appearances, can be found by
+// either address. The primary key of peers already covers a.
+const (
+	createPeersBIndex = `CREATE INDEX peers_b ON peers (b);`
+
+	createPeersHistoryAIndex = `CREATE INDEX peers_history_a
+ON peers_history (a);`
+
+	createPeersHistoryBIndex = `CREATE INDEX peers_history_b
+ON peers_history (b);`
+)
+
+// LatestSchemaVersion returns the version of the last known
+// Migration, which is the version that the database will be at once
+// all Migrations have been applied.
+func LatestSchemaVersion() int {
+	if len(Migrations) == 0 {
+		return 0
+	}
+	return Migrations[len(Migrations)-1].Version
+}
+
+// SchemaVersion returns the version of the most recent Migration
+// applied to the database, creating the schema_version table if it
+// does not yet exist. A database which has never been migrated is at
+// version 0.
+func (db DB) SchemaVersion() (version int, err error) {
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+version INT PRIMARY KEY,
+description VARCHAR(255) NOT NULL,
+applied BIGINT NOT NULL);`)
+	if err != nil {
+		return
+	}
+
+	// MAX() returns NULL on an empty table, so scan into a
+	// sql.NullInt64 rather than directly into the int.
+	var v sql.NullInt64
+	err = db.QueryRow(`SELECT MAX(version) FROM schema_version;`).Scan(&v)
+	return int(v.Int64), err
+}
+
+// PendingMigrations returns the Migrations which have not yet been
+// applied to the database, in the order in which they must be
+// applied. If the database is newer than the latest known Migration,
+// it returns a SchemaTooNewError.
+func (db DB) PendingMigrations() (pending []Migration, err error) {
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return
+	}
+	if latest := LatestSchemaVersion(); version > latest {
+		return nil, SchemaTooNewError{version, latest}
+	}
+
+	for _, m := range Migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return
+}
+
+// Migrate applies every pending Migration to the database, in
+// order. Each Migration is applied in its own transaction along with
+// its schema_version record, so if one fails, the database is left at
+// the version of the last successful Migration. It returns the
+// Migrations which were applied.
+func (db DB) Migrate() (applied []Migration, err error) {
+	pending, err := db.PendingMigrations()
+	if err != nil {
+		return
+	}
+
+	for _, m := range pending {
+		if err = db.applyMigration(m); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %s",
+				m.Version, m.Description, err)
+		}
+		applied = append(applied, m)
+	}
+	return
+}
+
+// applyMigration executes the statements of a single Migration for
+// the database's dialect and records it in the schema_version table,
+// all within one transaction. Note that some databases, such as
+// MySQL, implicitly commit data definition statements, so a failure
+// partway through a Migration may not be fully rolled back there.
+func (db DB) applyMigration(m Migration) (err error) {
+	statements, ok := m.Statements[db.DriverName]
+	if !ok {
+		return UnsupportedDriverError{db.DriverName, m.Version}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+
+	for _, statement := range statements {
+		if _, err = tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO schema_version
+(version, description, applied)
+VALUES(?, ?, ?);`, m.Version, m.Description, time.Now().Unix())
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	return tx.Commit()
+}
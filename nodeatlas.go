@@ -56,7 +56,21 @@ var (
 
 	fReadOnly = flag.Bool("readonly", false, "disallow database changes")
 
-	fImport = flag.String("import", "", "import a JSON array of nodes")
+	fImport     = flag.String("import", "", "import nodes from a file")
+	fImportMode = flag.String("import-mode", ImportInsert,
+		"treatment of existing nodes on import: insert, upsert, or replace")
+	fDryRun = flag.Bool("dry-run", false,
+		"report what an import would do without changing the database")
+	fExport    = flag.String("export", "", "export nodes to a file")
+	fExportAll = flag.Bool("export-all", false,
+		"include cached nodes in the export")
+	fFormat = flag.String("format", "",
+		"import or export format: json, geojson, or csv (default guessed)")
+
+	fMigrate = flag.Bool("migrate", false,
+		"apply pending database migrations and exit")
+	fDemo = flag.Bool("demo", false,
+		"keep all data in memory instead of the configured database")
 )
 
 func main() {
@@ -69,6 +83,14 @@ func main() {
 		fmt.Printf("Could not read conf: %s", err)
 		os.Exit(1)
 	}
+	if err = CheckConflictPolicy(Conf); err != nil {
+		fmt.Printf("Invalid conf: %s", err)
+		os.Exit(1)
+	}
+	if err = CheckNetworkAdmin(Conf); err != nil {
+		fmt.Printf("Invalid conf: %s", err)
+		os.Exit(1)
+	}
 
 	// Set logging parameters based on flags.
 	if *fDebug {
@@ -115,45 +137,120 @@ func main() {
 	}
 	l.Debugf("Compiled static files to %q\n", StaticDir)
 
-	// Connect to the database with configured parameters.
-	db, err := sql.Open(Conf.Database.DriverName,
-		Conf.Database.Resource)
-	if err != nil {
-		l.Fatalf("Could not connect to database: %s", err)
-	}
-	// Wrap the *sql.DB type.
-	Db = DB{
-		DB:         db,
-		DriverName: Conf.Database.DriverName,
-		ReadOnly:   (*fReadOnly || Conf.Database.ReadOnly),
-	}
-	l.Debug("Connected to database\n")
-	if Db.ReadOnly {
-		l.Warning("Database is read only\n")
-	}
+	if *fDemo {
+		// Keep everything in memory, so that nothing is read from or
+		// written to the configured database.
+		mem := NewMemStore()
+		mem.ReadOnly = *fReadOnly
+		Db = mem
+		l.Warning("Running in demo mode; nothing will be saved\n")
+	} else {
+		// Connect to the database with configured parameters.
+		sqldb, err := sql.Open(Conf.Database.DriverName,
+			Conf.Database.Resource)
+		if err != nil {
+			l.Fatalf("Could not connect to database: %s", err)
+		}
+		// Wrap the *sql.DB type.
+		db := DB{
+			DB:         sqldb,
+			DriverName: Conf.Database.DriverName,
+			ReadOnly:   (*fReadOnly || Conf.Database.ReadOnly),
+		}
+		l.Debug("Connected to database\n")
+		if db.ReadOnly {
+			l.Warning("Database is read only\n")
+		}
 
-	// Initialize the database with all of its tables.
-	err = Db.InitializeTables()
-	if err != nil {
-		l.Fatalf("Could not initialize database: %s", err)
+		// Check which migrations are needed to bring the database
+		// schema up to date. If the database has been migrated by a
+		// newer version of NodeAtlas, refuse to start, because we may
+		// not understand its tables.
+		pending, err := db.PendingMigrations()
+		if err != nil {
+			l.Fatalf("Could not check database schema: %s", err)
+		}
+
+		// If we were only asked to migrate, report the pending
+		// migrations before applying them, and exit afterward.
+		if *fMigrate {
+			version, _ := db.SchemaVersion()
+			if len(pending) == 0 {
+				l.Printf("Database schema is up to date (version %d)\n",
+					version)
+				return
+			}
+			l.Printf("Database schema is at version %d; %d migrations pending:\n",
+				version, len(pending))
+			for _, m := range pending {
+				l.Printf("  %d: %s\n", m.Version, m.Description)
+			}
+		}
+
+		// Apply any pending migrations. On a new database, this
+		// creates all of the tables.
+		applied, err := db.Migrate()
+		for _, m := range applied {
+			l.Infof("Applied database migration %d: %s\n",
+				m.Version, m.Description)
+		}
+		if err != nil {
+			l.Fatalf("Could not migrate database: %s", err)
+		}
+		if *fMigrate {
+			l.Printf("Database migrated to version %d\n",
+				LatestSchemaVersion())
+			return
+		}
+		Db = db
 	}
 	l.Debug("Initialized database\n")
 	l.Infof("Nodes: %d (%d local)\n", Db.LenNodes(true), Db.LenNodes(false))
 
 	// Check action flags and abandon normal startup if any are set.
 	if len(*fImport) != 0 {
-		err := ImportFile(*fImport)
+		results, err := ImportFile(*fImport, *fFormat, *fImportMode,
+			*fDryRun)
+
+		// Report what happened to every node on a dry run, but
+		// otherwise only report the nodes which failed.
+		for _, result := range results {
+			if *fDryRun || result.Err != nil {
+				fmt.Println(result)
+			}
+		}
+
 		if err != nil {
 			l.Fatalf("Import failed: %s", err)
+		} else if *fDryRun {
+			l.Printf("Dry run successful; no changes made")
 		} else {
 			l.Printf("Import successful!")
 		}
 		return
+	} else if len(*fExport) != 0 {
+		n, err := ExportFile(*fExport, *fFormat, *fExportAll)
+		if err != nil {
+			l.Fatalf("Export failed: %s", err)
+		}
+		l.Printf("Exported %d nodes to %q", n, *fExport)
+		return
 	}
 
-	// Refresh peering data. This is also done on heartbeat, but it
-	// should be done at startup until information is stored in the
-	// database.
+	// Load the key with which responses to parent maps are signed,
+	// or generate one if this is the first start.
+	if err = LoadIdentity(Conf.IdentityFile); err != nil {
+		l.Fatalf("Could not load identity key: %s", err)
+	}
+	l.Infof("Public key: %s\n", EncodePublicKey(IdentityPublic))
+
+	// Start pushing changes to parent maps, beginning with any which
+	// were left in the outbox when we last stopped.
+	StartPusher()
+	WakePusher()
+
+	// Refresh peering data. This is also done on heartbeat, but the
+	// links stored by the last run may be out of date.
 	go PopulatePeers(Db)
 
 	// Listen for OS signals.
@@ -189,7 +286,12 @@ func main() {
 //
 // Tasks:
 // - Db.DeleteExpiredFromQueue()
+// - Db.DeleteExpiredTombstones()
 // - UpdateMapCache()
+// - CrawlFederation(), if Conf.Aggregator.Enabled
+// - Db.DeleteExpiredCache()
+// - Db.DeleteExpiredOutbox()
+// - WakePusher()
 func Heartbeat() {
 	// If the timer was not nil, then the timer must restart.
 	if Pulse != nil {
@@ -220,7 +322,22 @@ func Heartbeat() {
 func doHeartbeatTasks() {
 	l.Debug("Heartbeat\n")
 	Db.DeleteExpiredFromQueue()
+	if err := Db.DeleteExpiredTombstones(); err != nil {
+		l.Errf("Error deleting expired tombstones: %s", err)
+	}
 	UpdateMapCache()
+	if Conf.Aggregator.Enabled {
+		if err := CrawlFederation(); err != nil {
+			l.Errf("Error crawling child maps: %s", err)
+		}
+	}
+	if err := Db.DeleteExpiredCache(); err != nil {
+		l.Errf("Error deleting expired cached nodes: %s", err)
+	}
+	if err := Db.DeleteExpiredOutbox(); err != nil {
+		l.Errf("Error deleting expired pushes: %s", err)
+	}
+	WakePusher()
 	PopulatePeers(Db)
 	ClearExpiredCAPTCHA()
 	ResendVerificationEmails()
@@ -248,12 +365,22 @@ func ListenSignal() {
 			// Reload the configuration, but keep the old one if
 			// there's an error.
 			conf, err := ReadConfig(*fConf)
+			if err == nil {
+				err = CheckConflictPolicy(conf)
+			}
+			if err == nil {
+				err = CheckNetworkAdmin(conf)
+			}
 			if err != nil {
 				l.Errf("Could not read conf; using old one: %s", err)
 				continue
 			}
 			Conf = conf
 
+			// Contact other maps with the new timeouts and
+			// concurrency from now on.
+			ResetFederation()
+
 			// Recompile the static directory, but be able to restore
 			// the previous one if there's an error.
 			oldStaticDir := StaticDir
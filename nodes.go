@@ -78,6 +78,11 @@ type Node struct {
 	// is not cached.
 	RetrieveTime int64 `json:",omitempty"`
 
+	// Stale is only used if the node is cached. It is true if the
+	// most recent attempt to sync the child map it was retrieved
+	// through failed, so that it may be out of date.
+	Stale bool `json:",omitempty"`
+
 	// OwnerName is the node's owner's real or screen name.
 	OwnerName string
 
@@ -209,6 +214,22 @@ func (pgpid *PGPID) UnmarshalJSON(b []byte) error {
 	return err
 }
 
+// Scan implements sql.Scanner, so that a PGPID can be read from a
+// nullable column. NULL is read as an empty PGPID.
+func (pgpid *PGPID) Scan(src interface{}) error {
+	switch b := src.(type) {
+	case nil:
+		*pgpid = nil
+	case []byte:
+		*pgpid = append(PGPID(nil), b...)
+	case string:
+		*pgpid = PGPID(b)
+	default:
+		return IncorrectlyFormattedPGPID
+	}
+	return nil
+}
+
 func (pgpid PGPID) String() string {
 	if len(pgpid) == 0 {
 		return ""
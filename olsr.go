@@ -0,0 +1,162 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+const (
+	// defaultOLSRJSONInfo is the default address of the jsoninfo
+	// plugin of olsrd.
+	defaultOLSRJSONInfo = "127.0.0.1:9090"
+
+	// olsrTimeout is the time allowed for a request to the jsoninfo
+	// plugin, including connecting.
+	olsrTimeout = 10 * time.Second
+
+	// olsrCostScale is the link cost of a perfect link, as given by
+	// jsoninfo, which is the ETX multiplied by 1024.
+	olsrCostScale = 1024
+)
+
+var (
+	OLSRAddressInvalidError = errors.New(
+		"olsr network admin \"address\" must be host:port")
+	OLSRResponseInvalidError = errors.New("olsrd jsoninfo response invalid")
+)
+
+func init() {
+	RegisterNetwork("olsr", func() Network { return &OLSRNetwork{} })
+}
+
+// OLSRNetwork is a Network whose links are read from the jsoninfo
+// plugin of olsrd, at the "host:port" given by the "address"
+// credential, which is defaultOLSRJSONInfo if it is not given. The
+// links are those of the node to its neighbours, and those of the
+// topology which olsrd has learned from the rest of the mesh.
+type OLSRNetwork struct {
+	linkTable
+}
+
+// olsrLink is a link as given by jsoninfo under "links", with the
+// addresses of the local and remote interfaces, or under "topology",
+// with the addresses of the last hop and the destination. Its quality
+// is given in both directions, and its cost is the ETX multiplied by
+// olsrCostScale.
+type olsrLink struct {
+	LocalIP             string  `json:"localIP"`
+	RemoteIP            string  `json:"remoteIP"`
+	LastHopIP           string  `json:"lastHopIP"`
+	DestinationIP       string  `json:"destinationIP"`
+	LinkQuality         float64 `json:"linkQuality"`
+	NeighborLinkQuality float64 `json:"neighborLinkQuality"`
+	LinkCost            float64 `json:"linkCost"`
+	TCEdgeCost          float64 `json:"tcEdgeCost"`
+}
+
+// olsrInfo is a response from jsoninfo. Older versions of the plugin
+// give each table in an object in a list under "data".
+type olsrInfo struct {
+	Links    []olsrLink `json:"links"`
+	Topology []olsrLink `json:"topology"`
+	Data     []olsrInfo `json:"data"`
+}
+
+func (n *OLSRNetwork) Connect(conf *NetworkAdminConfig) (err error) {
+	address, err := olsrJSONInfo(conf)
+	if err != nil {
+		return
+	}
+
+	info, err := requestOLSRInfo(address, "/links/topology")
+	if err != nil {
+		return
+	}
+
+	n.reset()
+	tables := append([]olsrInfo{*info}, info.Data...)
+	for _, table := range tables {
+		for _, link := range table.Links {
+			n.link(net.ParseIP(link.LocalIP), net.ParseIP(link.RemoteIP),
+				link.quality(link.LinkCost))
+		}
+		for _, link := range table.Topology {
+			n.link(net.ParseIP(link.LastHopIP),
+				net.ParseIP(link.DestinationIP),
+				link.quality(link.TCEdgeCost))
+		}
+	}
+	return
+}
+
+// Validate checks that the "address" credential, if given, is a host
+// and port.
+func (n *OLSRNetwork) Validate(conf *NetworkAdminConfig) (err error) {
+	_, err = olsrJSONInfo(conf)
+	return
+}
+
+// olsrJSONInfo returns the "address" credential of the given
+// configuration, or defaultOLSRJSONInfo if it is not given.
+func olsrJSONInfo(conf *NetworkAdminConfig) (address string, err error) {
+	address, _ = conf.Credentials["address"].(string)
+	if len(address) == 0 {
+		return defaultOLSRJSONInfo, nil
+	}
+	if _, _, err = net.SplitHostPort(address); err != nil {
+		return "", OLSRAddressInvalidError
+	}
+	return
+}
+
+// quality returns the quality of the link from 0 to 1, which is the
+// product of its qualities in each direction, or else the inverse of
+// the ETX given by the given cost.
+func (link olsrLink) quality(cost float64) float64 {
+	if link.LinkQuality > 0 && link.NeighborLinkQuality > 0 {
+		return link.LinkQuality * link.NeighborLinkQuality
+	}
+	if cost >= olsrCostScale {
+		return olsrCostScale / cost
+	}
+	return 0
+}
+
+// requestOLSRInfo sends the given request, such as "/links", to the
+// jsoninfo plugin at the given address, and returns its response.
+// Depending on its configuration, the plugin may send HTTP headers
+// before the JSON, which are skipped.
+func requestOLSRInfo(address, request string) (info *olsrInfo, err error) {
+	conn, err := net.DialTimeout("tcp", address, olsrTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(olsrTimeout))
+
+	if _, err = conn.Write([]byte(request + "\n")); err != nil {
+		return
+	}
+	// The plugin closes the connection once it has responded.
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return
+	}
+	start := bytes.IndexByte(b, '{')
+	if start < 0 {
+		return nil, OLSRResponseInvalidError
+	}
+
+	info = new(olsrInfo)
+	if err = json.Unmarshal(b[start:], info); err != nil {
+		return nil, err
+	}
+	return
+}
@@ -0,0 +1,149 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// olsrLinksTopology is the response of the jsoninfo plugin of olsrd
+// to "/links/topology", as captured from a node with two neighbours,
+// one of them over a poor link, in a mesh of five nodes. The plugin
+// sends HTTP headers before it unless it is configured not to.
+const olsrLinksTopology = "HTTP/1.1 200 OK\r\n" +
+	"Content-type: application/json; charset=utf-8\r\n" +
+	"\r\n" + `{
+  "pid": 1423,
+  "systemTime": 1394118600,
+  "timeSinceStartup": 7261823,
+  "links": [
+    {
+      "localIP": "10.0.0.1",
+      "remoteIP": "10.0.0.2",
+      "validityTime": 38836,
+      "linkQuality": 1.000,
+      "neighborLinkQuality": 0.500,
+      "linkCost": 2048
+    },
+    {
+      "localIP": "10.0.0.1",
+      "remoteIP": "10.0.0.5",
+      "validityTime": 35162,
+      "linkQuality": 0.000,
+      "neighborLinkQuality": 0.000,
+      "linkCost": 4096
+    }
+  ],
+  "topology": [
+    {
+      "lastHopIP": "10.0.0.2",
+      "destinationIP": "10.0.0.3",
+      "validityTime": 281302,
+      "refCount": 0,
+      "msgSeq": 41327,
+      "msgHops": 1,
+      "hopCount": 255,
+      "tcEdgeCost": 2048
+    },
+    {
+      "lastHopIP": "10.0.0.3",
+      "destinationIP": "10.0.0.2",
+      "validityTime": 281302,
+      "refCount": 0,
+      "msgSeq": 8127,
+      "msgHops": 2,
+      "hopCount": 255,
+      "tcEdgeCost": 4096
+    },
+    {
+      "lastHopIP": "10.0.0.3",
+      "destinationIP": "10.0.0.4",
+      "validityTime": 281302,
+      "refCount": 0,
+      "msgSeq": 8127,
+      "msgHops": 2,
+      "hopCount": 255,
+      "tcEdgeCost": 1024
+    }
+  ]
+}
+`
+
+// serveTCP listens on a new TCP port of the loopback interface, and
+// passes each connection to the given function, closing it once that
+// returns. It returns the address of the listener as host:port, and a
+// function which stops it.
+func serveTCP(t *testing.T, handle func(conn net.Conn)) (address string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			handle(conn)
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+// peerQualities returns the quality of the link to each peer of the
+// node with the given address, as found by the given Network, keyed
+// by the address of the peer.
+func peerQualities(t *testing.T, n Network, addr string) (qualities map[string]float64) {
+	p, err := n.PeersOf(IP(net.ParseIP(addr)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	qualities = make(map[string]float64, len(p.Destinations))
+	for i, dest := range p.Destinations {
+		qualities[net.IP(dest).String()] = p.Quality[i]
+	}
+	return
+}
+
+func TestOLSRPeersOf(t *testing.T) {
+	address, stop := serveTCP(t, func(conn net.Conn) {
+		request, _ := bufio.NewReader(conn).ReadString('\n')
+		if request != "/links/topology\n" {
+			t.Errorf("jsoninfo was sent %q", request)
+			return
+		}
+		conn.Write([]byte(olsrLinksTopology))
+	})
+	defer stop()
+
+	n := &OLSRNetwork{}
+	err := n.Connect(&NetworkAdminConfig{
+		Type:        "olsr",
+		Credentials: map[string]interface{}{"address": address},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The quality of each link is the product of its qualities in
+	// each direction, or else the inverse of its ETX, and the best of
+	// the two directions of the link between 10.0.0.2 and 10.0.0.3.
+	peers := map[string]map[string]float64{
+		"10.0.0.1": {"10.0.0.2": 0.5, "10.0.0.5": 0.25},
+		"10.0.0.2": {"10.0.0.1": 0.5, "10.0.0.3": 0.5},
+		"10.0.0.3": {"10.0.0.2": 0.5, "10.0.0.4": 1},
+		"10.0.0.4": {"10.0.0.3": 1},
+		"10.0.0.5": {"10.0.0.1": 0.25},
+		"10.0.0.6": {},
+	}
+	for addr, want := range peers {
+		if got := peerQualities(t, n, addr); !reflect.DeepEqual(got, want) {
+			t.Errorf("peers of %s are %v, not %v", addr, got, want)
+		}
+	}
+}
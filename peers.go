@@ -0,0 +1,186 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"time"
+)
+
+// peerKey returns a string which uniquely identifies the link between
+// the two nodes of the given Pair.
+func peerKey(pair Pair) string {
+	return string(pair.A) + string(pair.B)
+}
+
+// pairsByAddr implements sort.Interface to sort links by the addresses
+// of their nodes, and then by when they were first seen.
+type pairsByAddr []*Pair
+
+func (p pairsByAddr) Len() int      { return len(p) }
+func (p pairsByAddr) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p pairsByAddr) Less(i, j int) bool {
+	if ki, kj := peerKey(*p[i]), peerKey(*p[j]); ki != kj {
+		return ki < kj
+	}
+	return p[i].FirstSeen.Before(p[j].FirstSeen)
+}
+
+// UpdatePeers records that the given links were found at the given
+// time, with the given qualities, in a single transaction. Links which
+// were not known, or had dropped, are recorded as first seen then, and
+// links which were present but are not given are recorded as dropped
+// then. Links which have dropped are kept, so that their history can
+// be given, and if they are found again, their earlier appearance is
+// moved to the 'peers_history' table.
+func (db DB) UpdatePeers(pairs []Pair, seen time.Time) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+
+	if err = updatePeers(tx, pairs, seen.Unix()); err != nil {
+		tx.Rollback()
+		return
+	}
+	return tx.Commit()
+}
+
+func updatePeers(tx *Tx, pairs []Pair, seen int64) (err error) {
+	// Find every known link, and whether it has dropped.
+	rows, err := tx.Query(`SELECT a, b, dropped FROM peers;`)
+	if err != nil {
+		return
+	}
+	known := make(map[string]int64)
+	var existing []Pair
+	for rows.Next() {
+		var pair Pair
+		var dropped int64
+		if err = rows.Scan(&pair.A, &pair.B, &dropped); err != nil {
+			rows.Close()
+			return
+		}
+		known[peerKey(pair)] = dropped
+		existing = append(existing, pair)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	found := make(map[string]bool, len(pairs))
+	for _, pair := range pairs {
+		key := peerKey(pair)
+		if found[key] {
+			continue
+		}
+		found[key] = true
+
+		dropped, ok := known[key]
+		switch {
+		case !ok:
+			_, err = tx.Exec(`INSERT INTO peers
+(a, b, firstseen, lastseen, dropped, quality)
+VALUES(?, ?, ?, ?, 0, ?)`, []byte(pair.A), []byte(pair.B),
+				seen, seen, pair.Quality)
+		case dropped != 0:
+			_, err = tx.Exec(`INSERT INTO peers_history
+(a, b, firstseen, lastseen, dropped, quality)
+SELECT a, b, firstseen, lastseen, dropped, quality
+FROM peers
+WHERE a = ? AND b = ?;`, []byte(pair.A), []byte(pair.B))
+			if err != nil {
+				return
+			}
+			_, err = tx.Exec(`UPDATE peers
+SET firstseen = ?, lastseen = ?, dropped = 0, quality = ?
+WHERE a = ? AND b = ?;`, seen, seen, pair.Quality,
+				[]byte(pair.A), []byte(pair.B))
+		default:
+			_, err = tx.Exec(`UPDATE peers
+SET lastseen = ?, quality = ? WHERE a = ? AND b = ?;`,
+				seen, pair.Quality, []byte(pair.A), []byte(pair.B))
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	for _, pair := range existing {
+		key := peerKey(pair)
+		if found[key] || known[key] != 0 {
+			continue
+		}
+		_, err = tx.Exec(`UPDATE peers
+SET dropped = ? WHERE a = ? AND b = ?;`,
+			seen, []byte(pair.A), []byte(pair.B))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// peersWithHistory selects every appearance of every link, both from
+// the 'peers' table and from 'peers_history'.
+const peersWithHistory = `(SELECT a, b, firstseen, lastseen, dropped, quality
+FROM peers
+UNION ALL
+SELECT a, b, firstseen, lastseen, dropped, quality
+FROM peers_history) AS p`
+
+// DumpPeers returns every link which is currently present, ordered by
+// address.
+func (db DB) DumpPeers() (pairs []*Pair, err error) {
+	return db.selectPeers("peers", "dropped = 0")
+}
+
+// DumpPeerChanges returns every appearance of a link which was first
+// seen, or dropped, at or after the given time, ordered by address
+// and then by when it was first seen.
+func (db DB) DumpPeerChanges(since time.Time) (pairs []*Pair, err error) {
+	return db.selectPeers(peersWithHistory, "firstseen >= ? OR dropped >= ?",
+		since.Unix(), since.Unix())
+}
+
+// GetPeersOf returns every appearance of every link to or from the
+// node with the given address, including those which have dropped,
+// ordered by address and then by when it was first seen. If there are
+// none, it returns an empty slice.
+func (db DB) GetPeersOf(addr IP) (pairs []*Pair, err error) {
+	return db.selectPeers(peersWithHistory, "a = ? OR b = ?",
+		[]byte(addr), []byte(addr))
+}
+
+// selectPeers returns the links from the given table which match the
+// given WHERE clause, ordered by address and then by when they were
+// first seen.
+func (db DB) selectPeers(from, where string, args ...interface{}) (pairs []*Pair, err error) {
+	rows, err := db.Query(`SELECT a, b, firstseen, lastseen, dropped, quality
+FROM `+from+`
+WHERE `+where+`
+ORDER BY a, b, firstseen;`, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	pairs = make([]*Pair, 0)
+	for rows.Next() {
+		pair := new(Pair)
+		var firstseen, lastseen, dropped int64
+		err = rows.Scan(&pair.A, &pair.B, &firstseen, &lastseen, &dropped,
+			&pair.Quality)
+		if err != nil {
+			return
+		}
+		pair.FirstSeen = time.Unix(firstseen, 0)
+		pair.LastSeen = time.Unix(lastseen, 0)
+		if dropped != 0 {
+			pair.Dropped = time.Unix(dropped, 0)
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs, rows.Err()
+}
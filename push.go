@@ -0,0 +1,384 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pushBatchSize is the maximum number of events which are pushed
+	// to a parent map in a single request.
+	pushBatchSize = 100
+
+	// pushWindow is the amount by which the time of a push may differ
+	// from ours before it is rejected, so that captured pushes cannot
+	// be replayed long after they were made.
+	pushWindow = 15 * time.Minute
+)
+
+var (
+	PushUnauthorizedError = errors.New("push key does not match any child map")
+	PushExpiredError      = errors.New("push time is too far from the present")
+	PushReplayedError     = errors.New("push is not later than the last from its child map")
+)
+
+// PushEvent is a change to a local node, which is pushed to parent
+// maps as it happens, so that they need not wait for their next sync.
+// Only the fields of the Node which parent maps cache are included.
+type PushEvent struct {
+	// ID is the position of the event in the outbox.
+	ID int64 `json:"-"`
+
+	// Action is the kind of change, as recorded in the history of the
+	// node, such as ActionAdd or ActionDelete.
+	Action string
+
+	Time time.Time
+	Node *Node
+}
+
+// pushSignal wakes the goroutine started by StartPusher. It is
+// buffered, so that waking it never blocks, and a wake which arrives
+// during a push causes another once it finishes.
+var pushSignal = make(chan bool, 1)
+
+// queuePush records a change to a local node in the outbox of every
+// map in Conf.ParentMaps, and wakes the pusher. Errors are logged,
+// rather than returned, because a failure to push should not undo a
+// change which has already been made.
+func queuePush(action string, node *Node) {
+	if len(Conf.ParentMaps) == 0 {
+		return
+	}
+	parents := make([]string, len(Conf.ParentMaps))
+	for i, parent := range Conf.ParentMaps {
+		parents[i] = parent.Address
+	}
+
+	event := &PushEvent{
+		Action: action,
+		Time:   time.Unix(time.Now().Unix(), 0),
+		Node: &Node{
+			Addr:      node.Addr,
+			OwnerName: node.OwnerName,
+			Details:   node.Details,
+			Latitude:  node.Latitude,
+			Longitude: node.Longitude,
+			Status:    node.Status,
+		},
+	}
+	if err := Db.QueuePush(parents, event); err != nil {
+		l.Errf("Error queueing %s of %q for parent maps: %s",
+			action, node.Addr, err)
+		return
+	}
+	WakePusher()
+}
+
+// WakePusher causes the goroutine started by StartPusher to push the
+// outbox to every parent map, without waiting for it to do so.
+func WakePusher() {
+	select {
+	case pushSignal <- true:
+	default:
+	}
+}
+
+// StartPusher starts a goroutine which pushes the outbox to every map
+// in Conf.ParentMaps whenever it is woken by WakePusher, such as when
+// a change is queued, or at every heartbeat.
+func StartPusher() {
+	go func() {
+		for {
+			<-pushSignal
+			PushOutbox()
+		}
+	}()
+}
+
+// PushOutbox pushes the events in the outbox of every map in
+// Conf.ParentMaps, in the order in which they were queued. Events
+// which are accepted are removed from the outbox. If a push fails, it
+// is logged, and the remaining events for that map are kept to be
+// retried.
+func PushOutbox() {
+	for _, parent := range Conf.ParentMaps {
+		if err := pushToParent(parent); err != nil {
+			l.Errf("Pushing to %q produced: %s", parent.Address, err)
+		}
+	}
+}
+
+// pushToParent pushes the events in the outbox of a single parent map
+// in batches of up to pushBatchSize.
+func pushToParent(parent ParentMapConfig) error {
+	for {
+		events, err := Db.DumpOutbox(parent.Address, pushBatchSize)
+		if err != nil || len(events) == 0 {
+			return err
+		}
+		if err = sendPush(parent, events); err != nil {
+			return err
+		}
+		last := events[len(events)-1].ID
+		if err = Db.DeleteOutbox(parent.Address, last); err != nil {
+			return err
+		}
+		if len(events) < pushBatchSize {
+			return nil
+		}
+	}
+}
+
+// sendPush posts the given events to /api/push on the parent map,
+// authenticated with its PushKey.
+func sendPush(parent ParentMapConfig, events []*PushEvent) (err error) {
+	b, err := json.Marshal(events)
+	if err != nil {
+		return
+	}
+	t := strconv.FormatInt(nextPushTime(parent.Address), 10)
+
+	resp, err := FederationClient().PostForm(
+		strings.TrimRight(parent.Address, "/")+"/api/push",
+		url.Values{
+			"events": {string(b)},
+			"time":   {t},
+			"mac":    {pushMAC(parent.PushKey, t, b)},
+		})
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	var jresp struct {
+		Error interface{} `json:"error"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&jresp); err != nil {
+		return
+	} else if jresp.Error != nil {
+		return fmt.Errorf("remote error: %v", jresp.Error)
+	}
+	return
+}
+
+// lastPushTimes holds the time at which the last push to each parent
+// map was sent, by address.
+var lastPushTimes = struct {
+	sync.Mutex
+	times map[string]int64
+}{times: make(map[string]int64)}
+
+// nextPushTime returns the Unix time at which to send a push to the
+// parent map with the given address. It is the present, unless a push
+// has already been sent to the map at or after it, in which case it
+// is a second later than that one, because the parent map rejects any
+// push which is not later than the last.
+func nextPushTime(address string) int64 {
+	lastPushTimes.Lock()
+	defer lastPushTimes.Unlock()
+
+	t := time.Now().Unix()
+	if last := lastPushTimes.times[address]; t <= last {
+		t = last + 1
+	}
+	lastPushTimes.times[address] = t
+	return t
+}
+
+// pushMAC returns the hex-encoded HMAC-SHA256 of the time and events
+// of a push, made with the given key.
+func pushMAC(key, t string, events []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(t + "\n"))
+	mac.Write(events)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// AuthenticatePush finds the child map given by ChildMapConfigs whose
+// PushKey was used to make the given MAC of a push, and returns it
+// along with the time at which the push was sent. It returns
+// PushUnauthorizedError if there is none, and PushExpiredError if the
+// time of the push is more than pushWindow from the present. Pushes
+// which are replayed within pushWindow are rejected by ApplyPush.
+func AuthenticatePush(t string, events []byte, mac string) (config ChildMapConfig, sent time.Time, err error) {
+	expected, err := hex.DecodeString(mac)
+	if err != nil {
+		return config, sent, PushUnauthorizedError
+	}
+	configs, err := ChildMapConfigs()
+	if err != nil {
+		return
+	}
+
+	found := false
+	for _, c := range configs {
+		if len(c.PushKey) == 0 {
+			continue
+		}
+		actual, _ := hex.DecodeString(pushMAC(c.PushKey, t, events))
+		if hmac.Equal(actual, expected) {
+			config, found = c, true
+			break
+		}
+	}
+	if !found {
+		return config, sent, PushUnauthorizedError
+	}
+
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil {
+		return config, sent, PushExpiredError
+	}
+	sent = time.Unix(unix, 0)
+	if d := time.Since(sent); d > pushWindow || d < -pushWindow {
+		return config, sent, PushExpiredError
+	}
+	return
+}
+
+// ApplyPush applies the events pushed by the given child map at the
+// given time to the cache. If there are several events for the same
+// node, only the last is applied. The time at which the map was last
+// synced is left as it was, so that its next sync retrieves the same
+// changes, in case any pushes were missed. Nodes which do not pass the
+// map's filter are removed, rather than cached. If the push was not
+// sent later than the last which was applied from the map, it is a
+// replay, so nothing is changed, and PushReplayedError is returned.
+func ApplyPush(config ChildMapConfig, sent time.Time, events []*PushEvent) (err error) {
+	ids, err := Db.GetMapSourceToID()
+	if err != nil {
+		return
+	}
+	id, err := (&sourceIDs{ids: ids}).ID(config.Address, "")
+	if err != nil {
+		return
+	}
+
+	// Keep only the last event for each address, in the order in
+	// which they were first seen.
+	last := make(map[string]*PushEvent, len(events))
+	order := make([]string, 0, len(events))
+	for _, event := range events {
+		if event.Node == nil || event.Node.Addr == nil {
+			continue
+		}
+		addr := event.Node.Addr.String()
+		if last[addr] == nil {
+			order = append(order, addr)
+		}
+		last[addr] = event
+	}
+
+	// Events are only pushed for the child map's own local nodes, so
+	// only the copies whose source is that map are removed, and not
+	// those which it relays from its own child maps.
+	update := &CacheUpdate{
+		MapID:    id,
+		Nodes:    make([]*Node, 0),
+		PushTime: sent,
+	}
+	for _, addr := range order {
+		event := last[addr]
+		if event.Action == ActionDelete ||
+			!config.Filter.Allows(event.Node, config.Address) {
+			update.Deleted = append(update.Deleted,
+				&Tombstone{Addr: event.Node.Addr, SourceID: id})
+			continue
+		}
+		node := event.Node
+		node.SourceID = id
+		node.RetrieveTime = event.Time.Unix()
+		update.Nodes = append(update.Nodes, node)
+	}
+	return Db.UpdateCache(update)
+}
+
+// QueuePush adds the given event to the outbox of each of the given
+// parent maps.
+func (db DB) QueuePush(parents []string, event *PushEvent) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+
+	node := event.Node
+	for _, parent := range parents {
+		_, err = tx.Exec(`INSERT INTO outbox
+(parent, action, address, changed, owner, details, lat, lon, status)
+VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			parent, event.Action, []byte(node.Addr), event.Time.Unix(),
+			node.OwnerName, node.Details, node.Latitude,
+			node.Longitude, node.Status)
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+	return tx.Commit()
+}
+
+// DumpOutbox returns up to limit events from the outbox of the given
+// parent map, oldest first.
+func (db DB) DumpOutbox(parent string, limit int) (events []*PushEvent, err error) {
+	rows, err := db.Query(`
+SELECT id,action,address,changed,owner,details,lat,lon,status
+FROM outbox
+WHERE parent = ?
+ORDER BY id
+LIMIT ?;`, parent, limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	events = make([]*PushEvent, 0)
+	for rows.Next() {
+		event := &PushEvent{Node: new(Node)}
+		var changed int64
+		details := sql.NullString{}
+		if err = rows.Scan(&event.ID, &event.Action, &event.Node.Addr,
+			&changed, &event.Node.OwnerName, &details,
+			&event.Node.Latitude, &event.Node.Longitude,
+			&event.Node.Status); err != nil {
+			return
+		}
+		event.Time = time.Unix(changed, 0)
+		event.Node.Details = details.String
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// DeleteOutbox removes the events from the outbox of the given parent
+// map up to and including the one with the given ID, once they have
+// been pushed.
+func (db DB) DeleteOutbox(parent string, through int64) (err error) {
+	_, err = db.Exec(`DELETE FROM outbox
+WHERE parent = ? AND id <= ?;`, parent, through)
+	return
+}
+
+// DeleteExpiredOutbox removes events which were queued longer than
+// Conf.CacheExpiration ago. Parent maps fully sync their child maps at
+// least that often, so by then the events are no longer needed. This
+// also removes the events of maps which are no longer parents.
+func (db DB) DeleteExpiredOutbox() (err error) {
+	_, err = db.Exec(`DELETE FROM outbox
+WHERE changed < ?;`,
+		time.Now().Add(-time.Duration(Conf.CacheExpiration)).Unix())
+	return
+}
@@ -0,0 +1,204 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// searchFields are the fields of a node which are searched, and the
+// weight of a match in each. Addresses are only matched by prefix.
+var searchFields = []struct {
+	Name   string
+	Weight float64
+	Value  func(*Node) string
+}{
+	{"Addr", 4, func(n *Node) string { return n.Addr.String() }},
+	{"OwnerName", 3, func(n *Node) string { return n.OwnerName }},
+	{"Contact", 2, func(n *Node) string { return n.Contact }},
+	{"Details", 1, func(n *Node) string { return n.Details }},
+}
+
+// SearchResult is a node which matched a search, with information
+// about how well and where it matched.
+type SearchResult struct {
+	Node *Node
+
+	// Source is the hostname of the map the node came from, or
+	// "local".
+	Source string
+
+	// Relevance is between 0 and 1, with higher values indicating
+	// better matches.
+	Relevance float64
+
+	// Highlights maps the names of matched fields to the start and
+	// end of each match within them, counted in characters, with the
+	// end exclusive.
+	Highlights map[string][][2]int
+}
+
+// searchResults implements sort.Interface to sort results by
+// decreasing relevance, and by address where it is equal.
+type searchResults []*SearchResult
+
+func (r searchResults) Len() int      { return len(r) }
+func (r searchResults) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r searchResults) Less(i, j int) bool {
+	if r[i].Relevance != r[j].Relevance {
+		return r[i].Relevance > r[j].Relevance
+	}
+	return r[i].Node.Addr.LessThan(r[j].Node.Addr)
+}
+
+// SearchNodes returns the nodes which match every whitespace-separated
+// term in the query, ranked by relevance. Matching is case
+// insensitive. A term matches a node if its address begins with the
+// term, or its owner name, contact, or details contain it. Matches in
+// the address are worth the most, followed by the owner name,
+// contact, and details, and matches at the start of a word are worth
+// twice as much as those within one. The Source of each result is
+// filled in from idSources.
+func SearchNodes(nodes []*Node, query string, idSources map[int]string) []*SearchResult {
+	terms := strings.Fields(query)
+	if len(terms) == 0 {
+		return []*SearchResult{}
+	}
+
+	results := make(searchResults, 0)
+	for _, node := range nodes {
+		if result := searchNode(node, terms); result != nil {
+			result.Source = idSources[node.SourceID]
+			results = append(results, result)
+		}
+	}
+	sort.Sort(results)
+	return results
+}
+
+// searchNode matches a single node against the given terms, ignoring
+// case. If any term does not match, it returns nil.
+func searchNode(node *Node, terms []string) *SearchResult {
+	result := &SearchResult{
+		Node:       node,
+		Highlights: make(map[string][][2]int),
+	}
+
+	var total float64
+	for _, term := range terms {
+		// Each term is scored by its best match, but every match is
+		// highlighted.
+		var best float64
+		for _, field := range searchFields {
+			value := field.Value(node)
+			var matches [][2]int
+			var score float64
+			if field.Name == "Addr" {
+				if _, ok := prefixFold(value, term); ok {
+					matches = [][2]int{{0, utf8.RuneCountInString(term)}}
+					score = field.Weight
+				}
+			} else {
+				matches, score = findTerm(value, term)
+				score *= field.Weight
+			}
+
+			if len(matches) > 0 {
+				result.Highlights[field.Name] = append(
+					result.Highlights[field.Name], matches...)
+			}
+			if score > best {
+				best = score
+			}
+		}
+		if best == 0 {
+			return nil
+		}
+		total += best
+	}
+
+	// The best possible score for a term is a word-start match in the
+	// address, so the relevance is relative to that.
+	result.Relevance = total / float64(len(terms)) /
+		searchFields[0].Weight
+	return result
+}
+
+// findTerm returns the character offsets of every occurrence of the
+// term within the value, ignoring case, and a score of 1 if any
+// occurrence is at the start of a word, 0.5 if there are only
+// occurrences within words, or 0 if there are none. The offsets are
+// of the value as given, rather than of a lowercase copy, whose length
+// may differ.
+func findTerm(value, term string) (matches [][2]int, score float64) {
+	if len(term) == 0 {
+		return
+	}
+	termLen := utf8.RuneCountInString(term)
+
+	// Walk the value by character, keeping the byte offset i and the
+	// character offset start.
+	for i, start := 0, 0; i < len(value); {
+		n, ok := prefixFold(value[i:], term)
+		if !ok {
+			_, size := utf8.DecodeRuneInString(value[i:])
+			i += size
+			start++
+			continue
+		}
+
+		// A match is at the start of a word if it is at the start of
+		// the value, or follows something other than a letter or
+		// digit.
+		atWordStart := true
+		if i > 0 {
+			r, _ := utf8.DecodeLastRuneInString(value[:i])
+			atWordStart = !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}
+		if atWordStart {
+			score = 1
+		} else if score == 0 {
+			score = 0.5
+		}
+
+		matches = append(matches, [2]int{start, start + termLen})
+		i += n
+		start += termLen
+	}
+	return
+}
+
+// prefixFold reports whether s begins with prefix, ignoring case, by
+// comparing each character under Unicode simple case folding. If it
+// does, n is the length in bytes of the matching part of s.
+func prefixFold(s, prefix string) (n int, ok bool) {
+	for _, p := range prefix {
+		if n >= len(s) {
+			return 0, false
+		}
+		r, size := utf8.DecodeRuneInString(s[n:])
+		if !equalFoldRune(r, p) {
+			return 0, false
+		}
+		n += size
+	}
+	return n, true
+}
+
+// equalFoldRune reports whether the given characters are equal under
+// Unicode simple case folding.
+func equalFoldRune(a, b rune) bool {
+	if a == b {
+		return true
+	}
+	for r := unicode.SimpleFold(a); r != a; r = unicode.SimpleFold(r) {
+		if r == b {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+)
+
+var StaticNetworkPathMissingError = errors.New(
+	"static network admin requires a \"path\" credential")
+
+func init() {
+	RegisterNetwork("static", func() Network { return &StaticNetwork{} })
+}
+
+// StaticNetwork is a Network whose links are read from a local JSON
+// file, for networks without an administration interface which can
+// be queried. The file, given by the "path" credential, contains a
+// list of objects with the addresses of two linked nodes as "A" and
+// "B", and optionally its "Quality", in the same form as
+// /api/all_peers gives them. It is read again each time the Network
+// connects, so it may be changed at any time.
+type StaticNetwork struct {
+	linkTable
+}
+
+func (n *StaticNetwork) Connect(conf *NetworkAdminConfig) (err error) {
+	path, err := staticNetworkPath(conf)
+	if err != nil {
+		return
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var pairs []Pair
+	if err = json.Unmarshal(b, &pairs); err != nil {
+		return
+	}
+
+	n.reset()
+	for _, pair := range pairs {
+		n.link(net.IP(pair.A), net.IP(pair.B), pair.Quality)
+	}
+	return
+}
+
+// Validate checks that the "path" credential is given.
+func (n *StaticNetwork) Validate(conf *NetworkAdminConfig) (err error) {
+	_, err = staticNetworkPath(conf)
+	return
+}
+
+// staticNetworkPath returns the "path" credential of the given
+// configuration.
+func staticNetworkPath(conf *NetworkAdminConfig) (string, error) {
+	path, ok := conf.Credentials["path"].(string)
+	if !ok || len(path) == 0 {
+		return "", StaticNetworkPathMissingError
+	}
+	return path, nil
+}
@@ -0,0 +1,323 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Store is the interface to everything NodeAtlas keeps track of
+// between requests: local and cached nodes, their history and
+// tombstones, child maps, the links between nodes, the verification
+// queue, and CAPTCHAs. DB implements it with an SQL database, and
+// *MemStore implements it in memory.
+//
+// Where a single record is looked up or removed and does not exist,
+// implementations return sql.ErrNoRows, unless documented otherwise.
+type Store interface {
+	// Close releases any resources held by the Store.
+	Close() error
+
+	// IsReadOnly reports whether changes to the Store are disallowed.
+	IsReadOnly() bool
+
+	// Nodes
+	LenNodes(useCached bool) (n int)
+	DumpNodes() (nodes []*Node, err error)
+	QueryNodes(q *NodeQuery) (nodes []*Node, next *NodeCursor, err error)
+	DumpLocal() (nodes []*Node, err error)
+	DumpChanges(time time.Time) (nodes []*Node, err error)
+	DumpLocalUpdated(since time.Time) (nodes []*Node, updated []time.Time, err error)
+	LastModified() (t time.Time, err error)
+	CountSources() (counts map[int]int, err error)
+	GetNode(addr IP) (node *Node, err error)
+	GetLocalNode(addr IP) (node *Node, err error)
+	DumpDuplicates() (nodes []*Node, updated []time.Time, err error)
+	AddNode(node *Node) (err error)
+	AddNodes(nodes []*Node) (err error)
+	UpdateNode(node *Node) (err error)
+	DeleteNode(addr IP) (err error)
+	ImportNodes(added, updated, deleted []*Node) (err error)
+
+	// History
+	RecordChange(action, actor string, node *Node) (err error)
+	NodeHistory(addr IP) (changes []*NodeChange, err error)
+	DumpLocalAsOf(t time.Time) (nodes []*Node, err error)
+
+	// Tombstones
+	ClearTombstone(addr IP) (err error)
+	DumpDeleted(since time.Time) (tombstones []*Tombstone, err error)
+	DeleteExpiredTombstones() (err error)
+
+	// Cache
+	UpdateCache(u *CacheUpdate) (err error)
+	RecordSyncFailure(mapID int, attempt time.Time, message string) (err error)
+	DeleteExpiredCache() (err error)
+	ClearMapCache(mapID int) (err error)
+
+	// Child maps
+	AddNewMapSource(address, name string) (id int, err error)
+	UpdateMapSourceData(address, name string) (err error)
+	UpdateChildMap(childMap *ChildMap) (err error)
+	UpdateMapParent(id, parent int) (err error)
+	DumpChildMaps() (childMaps []*ChildMap, err error)
+	GetMapSourceToID() (sourceToID map[string]int, err error)
+	GetMapIDToSource() (IDToSource map[int]string, err error)
+	FindSourceMap(id int) (source string, err error)
+
+	// Peers
+	UpdatePeers(pairs []Pair, seen time.Time) (err error)
+	DumpPeers() (pairs []*Pair, err error)
+	DumpPeerChanges(since time.Time) (pairs []*Pair, err error)
+	GetPeersOf(addr IP) (pairs []*Pair, err error)
+
+	// Push outbox
+	QueuePush(parents []string, event *PushEvent) (err error)
+	DumpOutbox(parent string, limit int) (events []*PushEvent, err error)
+	DeleteOutbox(parent string, through int64) (err error)
+	DeleteExpiredOutbox() (err error)
+
+	// Verification queue
+	QueueNode(id int64, emailsent bool, grace Duration, node *Node) (err error)
+	GetQueuedNode(id int64) (node *Node, err error)
+	DeleteQueuedNode(id int64) (err error)
+	DeleteExpiredFromQueue() (err error)
+	DumpUnsentVerifications() (emails map[int64]string, err error)
+	SetVerificationSent(id int64) (err error)
+
+	// CAPTCHAs
+	SetCAPTCHA(id string, solution []byte, expiration time.Time) (err error)
+	GetCAPTCHA(id string) (solution []byte, err error)
+	DeleteCAPTCHA(id string) (err error)
+	DeleteExpiredCAPTCHAs() (err error)
+}
+
+// Sort orders which can be used in a NodeQuery. Ties are always
+// broken by address, and then by source ID.
+const (
+	SortAddress = "address"
+	SortOwner   = "owner"
+	SortUpdated = "updated" // last update, or retrieval if cached
+)
+
+var (
+	InvalidSortError   = errors.New("sort must be address, owner, or updated")
+	InvalidCursorError = errors.New("cursor is invalid for this sort order")
+	InvalidLimitError  = errors.New("limit must be a positive integer")
+)
+
+// NodeQuery restricts which nodes are returned by QueryNodes, and in
+// what order. The zero value matches every node, in no particular
+// order.
+type NodeQuery struct {
+	// Area, if not nil, matches only nodes within it.
+	Area *Area
+
+	// StatusAll and StatusAny, if nonzero, match only nodes which
+	// have all of, or any of, their bits set in their Status.
+	StatusAll, StatusAny uint32
+
+	// SourceIDs, if not nil, matches only nodes from the child maps
+	// with the given IDs, where 0 is the local map.
+	SourceIDs []int
+
+	// Sort is the order in which to return nodes. If it is empty but
+	// Limit or After is set, nodes are sorted by address, so that
+	// pages are stable.
+	Sort string
+
+	// After, if not nil, matches only nodes which come after it in
+	// the sort order. It must have been returned by a query with the
+	// same Sort.
+	After *NodeCursor
+
+	// Limit, if nonzero, is the greatest number of nodes to return.
+	// If more nodes match, QueryNodes also returns a cursor to be
+	// used as After in order to retrieve them.
+	Limit int
+}
+
+// NodeCursor marks the position of a node in a sorted list, so that
+// the nodes after it can be requested. It is given to clients in the
+// opaque form produced by String.
+type NodeCursor struct {
+	Sort     string
+	Owner    string `json:",omitempty"`
+	Updated  int64  `json:",omitempty"`
+	Addr     IP
+	SourceID int
+}
+
+// String encodes the cursor as URL-safe base64.
+func (c *NodeCursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+// ParseNodeCursor decodes a cursor produced by NodeCursor.String.
+func ParseNodeCursor(s string) (c *NodeCursor, err error) {
+	b, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, InvalidCursorError
+	}
+	c = new(NodeCursor)
+	if err = json.Unmarshal(b, c); err != nil || c.Addr == nil {
+		return nil, InvalidCursorError
+	}
+	return
+}
+
+// SortOrder returns the order in which nodes should be sorted, which
+// is Sort if it is set, SortAddress if the query is paginated, or
+// empty otherwise.
+func (q *NodeQuery) SortOrder() string {
+	if len(q.Sort) == 0 && (q.Limit > 0 || q.After != nil) {
+		return SortAddress
+	}
+	return q.Sort
+}
+
+// Validate checks that the sort order, cursor, and limit of the query
+// can be used together.
+func (q *NodeQuery) Validate() error {
+	sort := q.SortOrder()
+	switch sort {
+	case "", SortAddress, SortOwner, SortUpdated:
+	default:
+		return InvalidSortError
+	}
+	if q.After != nil && q.After.Sort != sort {
+		return InvalidCursorError
+	}
+	if q.Limit < 0 {
+		return InvalidLimitError
+	}
+	return nil
+}
+
+// cursor returns the position of the given node, which was last
+// updated or retrieved at the given Unix time, in the sort order of
+// the query.
+func (q *NodeQuery) cursor(node *Node, updated int64) *NodeCursor {
+	c := &NodeCursor{
+		Sort:     q.SortOrder(),
+		Addr:     node.Addr,
+		SourceID: node.SourceID,
+	}
+	switch c.Sort {
+	case SortOwner:
+		c.Owner = node.OwnerName
+	case SortUpdated:
+		c.Updated = updated
+	}
+	return c
+}
+
+// compareCursors orders two cursors with the same Sort, returning a
+// negative number if a comes first, a positive number if b does, and
+// zero if they are at the same position.
+func compareCursors(a, b *NodeCursor) int {
+	switch a.Sort {
+	case SortOwner:
+		if a.Owner != b.Owner {
+			if a.Owner < b.Owner {
+				return -1
+			}
+			return 1
+		}
+	case SortUpdated:
+		if a.Updated != b.Updated {
+			if a.Updated < b.Updated {
+				return -1
+			}
+			return 1
+		}
+	}
+	if c := bytes.Compare(a.Addr, b.Addr); c != 0 {
+		return c
+	}
+	return a.SourceID - b.SourceID
+}
+
+// nodePosition is a node and its position in the sort order of a
+// query.
+type nodePosition struct {
+	node   *Node
+	cursor *NodeCursor
+}
+
+// nodePositions implements sort.Interface to sort nodes by their
+// positions.
+type nodePositions []nodePosition
+
+func (p nodePositions) Len() int      { return len(p) }
+func (p nodePositions) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p nodePositions) Less(i, j int) bool {
+	return compareCursors(p[i].cursor, p[j].cursor) < 0
+}
+
+// page sorts the given nodes, which are matched by the query, into its
+// sort order, and returns those after its cursor, stopping when the
+// page is full. If more remain, next marks the last node returned.
+func (q *NodeQuery) page(matched nodePositions) (nodes []*Node, next *NodeCursor) {
+	sort.Sort(matched)
+
+	var last *NodeCursor
+	nodes = make([]*Node, 0)
+	for _, p := range matched {
+		if q.After != nil && compareCursors(p.cursor, q.After) <= 0 {
+			continue
+		}
+		if q.Limit > 0 && len(nodes) == q.Limit {
+			return nodes, last
+		}
+		nodes = append(nodes, p.node)
+		last = p.cursor
+	}
+	return
+}
+
+// Matches reports whether the given node is matched by the query.
+func (q *NodeQuery) Matches(node *Node) bool {
+	if q.Area != nil && !q.Area.Contains(node.Latitude, node.Longitude) {
+		return false
+	}
+	if node.Status&q.StatusAll != q.StatusAll {
+		return false
+	}
+	if q.StatusAny != 0 && node.Status&q.StatusAny == 0 {
+		return false
+	}
+	if q.SourceIDs != nil && !q.hasSource(node.SourceID) {
+		return false
+	}
+	return true
+}
+
+// hasSource reports whether the given source ID is in SourceIDs.
+func (q *NodeQuery) hasSource(id int) bool {
+	for _, sourceID := range q.SourceIDs {
+		if sourceID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterNodes returns the nodes which are matched by the query, in
+// the same order.
+func (q *NodeQuery) FilterNodes(nodes []*Node) []*Node {
+	filtered := make([]*Node, 0, len(nodes))
+	for _, node := range nodes {
+		if q.Matches(node) {
+			filtered = append(filtered, node)
+		}
+	}
+	return filtered
+}
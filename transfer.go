@@ -0,0 +1,352 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for the fields of Conf.Federation which are not given.
+const (
+	defaultConnectTimeout   = 10 * time.Second
+	defaultFetchTimeout     = time.Minute
+	defaultFetchConcurrency = 8
+	defaultMaxResponseSize  = 64 << 20
+)
+
+var ResponseTooLargeError = errors.New("response exceeds the maximum size")
+
+var (
+	// federationMutex guards federationClient and fetchSlots, which
+	// are replaced when the configuration is reloaded.
+	federationMutex  sync.Mutex
+	federationClient *http.Client
+
+	// fetchSlots holds a value for every request to a child map
+	// which is in progress, so that no more than
+	// Conf.Federation.Concurrency are made at once.
+	fetchSlots chan bool
+)
+
+// Validators are the values of the ETag and Last-Modified headers of
+// a response. They are sent back as If-None-Match and
+// If-Modified-Since, so that the server can respond that nothing has
+// changed, rather than sending the same data again.
+type Validators struct {
+	ETag, LastModified string
+}
+
+// FederationClient returns the http.Client with which other maps are
+// contacted, whose timeouts are those given by Conf.Federation. It is
+// created the first time it is needed, and again after
+// ResetFederation. Responses which are compressed with gzip are
+// decompressed transparently.
+func FederationClient() *http.Client {
+	client, _ := federation()
+	return client
+}
+
+// ResetFederation discards the http.Client returned by
+// FederationClient and the limit on concurrent fetches, so that both
+// are created again from Conf.Federation when next needed. It should
+// be called whenever Conf is reloaded. Fetches which are in progress
+// are unaffected.
+func ResetFederation() {
+	federationMutex.Lock()
+	defer federationMutex.Unlock()
+
+	if federationClient != nil {
+		if t, ok := federationClient.Transport.(*http.Transport); ok {
+			t.CloseIdleConnections()
+		}
+	}
+	federationClient = nil
+	fetchSlots = nil
+}
+
+// federation returns federationClient and fetchSlots, first creating
+// them from Conf.Federation if necessary.
+func federation() (client *http.Client, slots chan bool) {
+	federationMutex.Lock()
+	defer federationMutex.Unlock()
+
+	if federationClient == nil {
+		setupFederation()
+	}
+	return federationClient, fetchSlots
+}
+
+// setupFederation creates federationClient and fetchSlots from
+// Conf.Federation. federationMutex must be held.
+func setupFederation() {
+	connect := time.Duration(Conf.Federation.ConnectTimeout)
+	if connect <= 0 {
+		connect = defaultConnectTimeout
+	}
+	timeout := time.Duration(Conf.Federation.Timeout)
+	if timeout <= 0 {
+		timeout = defaultFetchTimeout
+	}
+	concurrency := Conf.Federation.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultFetchConcurrency
+	}
+
+	federationClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			Dial:                  (&net.Dialer{Timeout: connect}).Dial,
+			ResponseHeaderTimeout: timeout,
+		},
+		Timeout: timeout,
+	}
+	fetchSlots = make(chan bool, concurrency)
+}
+
+// maxResponseSize returns Conf.Federation.MaxResponseSize, or its
+// default if it is not given.
+func maxResponseSize() int64 {
+	if Conf.Federation.MaxResponseSize <= 0 {
+		return defaultMaxResponseSize
+	}
+	return Conf.Federation.MaxResponseSize
+}
+
+// fetched is a response from another map, as retrieved by fetch.
+type fetched struct {
+	Body       []byte
+	Header     http.Header
+	Validators Validators
+
+	// RequestURI is the path and query which were requested, with
+	// which a signed response is signed.
+	RequestURI string
+
+	// NotModified is true if the request was conditional, and the
+	// server responded that nothing has changed, in which case Body
+	// is empty.
+	NotModified bool
+
+	// Latency is the time which the server took to respond.
+	Latency time.Duration
+}
+
+// fetch retrieves the given URL with FederationClient, once fewer than
+// Conf.Federation.Concurrency other fetches are in progress. If any
+// validators are given, the request is conditional. The body may be
+// no larger than Conf.Federation.MaxResponseSize once decompressed,
+// or ResponseTooLargeError is returned.
+func fetch(url string, validators Validators) (f *fetched, err error) {
+	client, slots := federation()
+	slots <- true
+	defer func() { <-slots }()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return
+	}
+	if len(validators.ETag) > 0 {
+		req.Header.Set("If-None-Match", validators.ETag)
+	}
+	if len(validators.LastModified) > 0 {
+		req.Header.Set("If-Modified-Since", validators.LastModified)
+	}
+
+	requested := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	f = &fetched{
+		Header:     resp.Header,
+		RequestURI: req.URL.RequestURI(),
+		Validators: Validators{
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		},
+		Latency: time.Since(requested),
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		f.NotModified = true
+		f.Validators = validators
+		return
+	}
+
+	max := maxResponseSize()
+	if resp.ContentLength > max {
+		return nil, ResponseTooLargeError
+	}
+	f.Body, err = ioutil.ReadAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		return nil, err
+	} else if int64(len(f.Body)) > max {
+		return nil, ResponseTooLargeError
+	}
+	return
+}
+
+// conditionalHandler is an http.Handler which allows GET requests to
+// another for any of the given paths to be made conditional. Its
+// responses are given a weak ETag, which is a hash of their body, and
+// a Last-Modified time from Db.LastModified. If the request's
+// If-None-Match or If-Modified-Since shows that the client already
+// has the response, it is replaced by 304 Not Modified.
+type conditionalHandler struct {
+	http.Handler
+	paths map[string]bool
+}
+
+func (h conditionalHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" || !h.paths[strings.TrimRight(r.URL.Path, "/")] {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	// Find the time of the last change before building the response,
+	// so that any change made while it is built is not missed. If it
+	// can't be found, the response is only given an ETag.
+	modified, err := Db.LastModified()
+	if err != nil {
+		l.Errf("Error finding time of last change: %s", err)
+		modified = time.Time{}
+	}
+	if notModifiedSince(r, modified) {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	bw := &bufferedResponse{header: make(http.Header)}
+	h.Handler.ServeHTTP(bw, r)
+	for k, v := range bw.header {
+		w.Header()[k] = v
+	}
+	if bw.status != 0 && bw.status != http.StatusOK {
+		w.WriteHeader(bw.status)
+		w.Write(bw.body.Bytes())
+		return
+	}
+
+	sum := sha256.Sum256(bw.body.Bytes())
+	etag := fmt.Sprintf(`W/"%x"`, sum[:16])
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if matchesETag(r.Header.Get("If-None-Match"), etag) {
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(bw.body.Bytes())
+}
+
+// notModifiedSince reports whether the request's If-Modified-Since
+// is no earlier than the given time of the last change. It is ignored
+// if the request has an If-None-Match, or if it is more than
+// Conf.CacheExpiration ago, because deletions are only remembered for
+// that long.
+func notModifiedSince(r *http.Request, modified time.Time) bool {
+	since := r.Header.Get("If-Modified-Since")
+	if modified.IsZero() || len(since) == 0 ||
+		len(r.Header.Get("If-None-Match")) > 0 {
+		return false
+	}
+	t, err := http.ParseTime(since)
+	if err != nil ||
+		time.Since(t) > time.Duration(Conf.CacheExpiration) {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(t)
+}
+
+// matchesETag reports whether the given If-None-Match header, which
+// is a list of ETags or "*", includes the given one. ETags are
+// compared weakly, as they are all weak.
+func matchesETag(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") ==
+			strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipHandler is an http.Handler which compresses the responses of
+// another with gzip, if the client accepts it.
+type gzipHandler struct {
+	http.Handler
+}
+
+func (h gzipHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	gw := &gzipResponse{ResponseWriter: w}
+	defer gw.Close()
+	h.Handler.ServeHTTP(gw, r)
+}
+
+// gzipResponse is an http.ResponseWriter which compresses the body
+// written to it with gzip. Responses which may not have a body, such
+// as 304 Not Modified, are left as they are.
+type gzipResponse struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (g *gzipResponse) WriteHeader(status int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	if status != http.StatusNotModified && status != http.StatusNoContent {
+		g.Header().Del("Content-Length")
+		g.Header().Set("Content-Encoding", "gzip")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *gzipResponse) Write(p []byte) (int, error) {
+	if !g.wroteHeader {
+		// The content type must be found before the body is
+		// compressed, or it will be detected as gzip.
+		if len(g.Header().Get("Content-Type")) == 0 {
+			g.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz == nil {
+		return g.ResponseWriter.Write(p)
+	}
+	return g.gz.Write(p)
+}
+
+// Close flushes the compressed body, if there is one.
+func (g *gzipResponse) Close() error {
+	if g.gz == nil {
+		return nil
+	}
+	return g.gz.Close()
+}
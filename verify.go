@@ -11,6 +11,7 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -26,7 +27,7 @@ VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		id, []byte(node.Addr), node.OwnerName, node.OwnerEmail,
 		node.Contact, node.Details, []byte(node.PGP),
 		node.Latitude, node.Longitude, node.Status,
-		emailsent, time.Now().Add(time.Duration(grace)))
+		emailsent, time.Now().Add(time.Duration(grace)).Unix())
 	return
 }
 
@@ -34,17 +35,14 @@ VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 // by checking if their expiration stamp is past the current time.
 func (db DB) DeleteExpiredFromQueue() (err error) {
 	_, err = db.Exec(`DELETE FROM nodes_verify_queue
-WHERE expiration <= ?;`, time.Now())
+WHERE expiration <= ?;`, time.Now().Unix())
 	return
 }
 
-// VerifyQueuedNode removes a node (as identified by the id) from the
-// queue, performs VerifyRequest checks, and inserts it into the nodes
-// table. If it encounters an error, the node remains in the verify
-// queue.
-func (db DB) VerifyQueuedNode(id int64, r *http.Request) (addr IP, verifyerr error, err error) {
-	// Get the node via the id.
-	var node = new(Node)
+// GetQueuedNode retrieves the node with the given ID from the verify
+// queue. If there is no such node, it returns sql.ErrNoRows.
+func (db DB) GetQueuedNode(id int64) (node *Node, err error) {
+	node = new(Node)
 	contact := sql.NullString{}
 	details := sql.NullString{}
 
@@ -55,10 +53,66 @@ FROM nodes_verify_queue WHERE id = ?;`, id).Scan(
 		&contact, &details, &node.PGP,
 		&node.Latitude, &node.Longitude, &node.Status)
 	if err != nil {
-		return
+		return nil, err
 	}
 	node.Contact = contact.String
 	node.Details = details.String
+	return
+}
+
+// DeleteQueuedNode removes the node with the given ID from the verify
+// queue.
+func (db DB) DeleteQueuedNode(id int64) (err error) {
+	_, err = db.Exec(`DELETE FROM nodes_verify_queue
+WHERE id = ?;`, id)
+	return
+}
+
+// DumpUnsentVerifications returns the email addresses of every node
+// in the verify queue which has not yet been sent a verification
+// email, keyed by their IDs.
+func (db DB) DumpUnsentVerifications() (emails map[int64]string, err error) {
+	rows, err := db.Query(`SELECT id,email
+FROM nodes_verify_queue
+WHERE verifysent = ?;`, false)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	emails = make(map[int64]string)
+	for rows.Next() {
+		var (
+			id    int64
+			email string
+		)
+		if err = rows.Scan(&id, &email); err != nil {
+			return
+		}
+		emails[id] = email
+	}
+	return emails, rows.Err()
+}
+
+// SetVerificationSent marks the node with the given ID in the verify
+// queue as having been sent a verification email.
+func (db DB) SetVerificationSent(id int64) (err error) {
+	_, err = db.Exec(`UPDATE nodes_verify_queue
+SET verifysent = ?
+WHERE id = ?;`, true, id)
+	return
+}
+
+// VerifyQueuedNode removes a node (as identified by the id) from the
+// queue in Db, performs VerifyRequest checks, and inserts it into the
+// local nodes. If it encounters an error, the node remains in the
+// verify queue.
+func VerifyQueuedNode(id int64, r *http.Request) (addr IP, verifyerr error, err error) {
+	// Get the node via the id.
+	node, err := Db.GetQueuedNode(id)
+	if err != nil {
+		return
+	}
 
 	// Perform VerifyRequest checks.
 	verifyerr = VerifyRequest(node, r)
@@ -66,17 +120,22 @@ FROM nodes_verify_queue WHERE id = ?;`, id).Scan(
 		return
 	}
 
-	err = db.AddNode(node)
+	err = Db.AddNode(node)
 	if err != nil {
 		return
 	}
 
-	_, err = db.Exec(`DELETE FROM nodes_verify_queue
-WHERE id = ?;`, id)
+	err = Db.DeleteQueuedNode(id)
 	if err != nil {
 		l.Errf("Could not clear verified node %d: %s", id, err)
 	}
 
+	// Record the verification in the node's history and push it to
+	// parent maps, but don't fail if either can't be done, because
+	// the node has been added.
+	recordChange(ActionVerify, r.RemoteAddr, node)
+	queuePush(ActionVerify, node)
+
 	// Add it to the RSS feed. The feed will be refreshed at the next
 	// heartbeat.
 	AddNodeToRSS(node, time.Now())
@@ -86,23 +145,27 @@ WHERE id = ?;`, id)
 
 var (
 	NodeAddrNotContainedByNetmaskError = "verify: Node address not within configured netmask: %s"
+	NodeAddrNotInNetworkRangeError     = "verify: Node address not within range of network: %s"
+	NodeFieldTooLongError              = "verify: %s is longer than 255 characters"
+
+	NodeAddrInvalidError        = errors.New("verify: Node address missing or invalid")
+	NodeCoordinatesInvalidError = errors.New("verify: Node latitude or longitude out of range")
+	NodeOwnerMissingError       = errors.New("verify: Node owner name missing")
+	NodeEmailInvalidError       = errors.New("verify: Node email address invalid")
 )
 
 // VerifyRegistrant performs appropriate registration-time checks to
 // ensure that a Node is fit to be placed in the verification
 // queue. If the given Node is acceptable, then no error will be
 // returned.
-func (db DB) VerifyRegistrant(node *Node) error {
+func VerifyRegistrant(node *Node) error {
 	// Ensure that the node's address is contained by the netmask.
-	if Conf.Verify.Netmask != nil {
-		if !(*net.IPNet)(Conf.Verify.Netmask).Contains(net.IP(node.Addr)) {
-			return fmt.Errorf(NodeAddrNotContainedByNetmaskError,
-				Conf.Verify.Netmask)
-		}
+	if err := VerifyNetmask(node); err != nil {
+		return err
 	}
 
 	// Ensure IPs are unique
-	nodeList, err := db.DumpLocal()
+	nodeList, err := Db.DumpLocal()
 	if err != nil {
 		return err
 	}
@@ -115,6 +178,73 @@ func (db DB) VerifyRegistrant(node *Node) error {
 	return nil
 }
 
+// VerifyNetmask ensures that the node's address is contained by
+// Conf.Verify.Netmask, if it is set, and by the address range of one
+// of the network backends, if every one of them has one, as given by
+// NetworkRanges.
+func VerifyNetmask(node *Node) error {
+	if Conf.Verify.Netmask != nil {
+		if !(*net.IPNet)(Conf.Verify.Netmask).Contains(net.IP(node.Addr)) {
+			return fmt.Errorf(NodeAddrNotContainedByNetmaskError,
+				Conf.Verify.Netmask)
+		}
+	}
+
+	ranges := NetworkRanges(Conf)
+	if len(ranges) == 0 {
+		return nil
+	}
+	names := make([]string, len(ranges))
+	for i, r := range ranges {
+		if r.Contains(net.IP(node.Addr)) {
+			return nil
+		}
+		names[i] = r.String()
+	}
+	return fmt.Errorf(NodeAddrNotInNetworkRangeError,
+		strings.Join(names, ", "))
+}
+
+// ValidateNode checks that all of a Node's fields are sane and will
+// fit in the database, and that its address passes the same netmask
+// check as VerifyRegistrant. It does not check that the address is
+// unique. It is intended for nodes which do not come through the API,
+// such as those being imported.
+func ValidateNode(node *Node) error {
+	if len(node.Addr) != net.IPv4len && len(node.Addr) != net.IPv6len {
+		return NodeAddrInvalidError
+	}
+	if err := VerifyNetmask(node); err != nil {
+		return err
+	}
+
+	if node.Latitude < -90 || node.Latitude > 90 ||
+		node.Longitude < -180 || node.Longitude > 180 {
+		return NodeCoordinatesInvalidError
+	}
+
+	if len(node.OwnerName) == 0 {
+		return NodeOwnerMissingError
+	}
+	if len(node.OwnerEmail) != 0 &&
+		!EmailRegexp.MatchString(node.OwnerEmail) {
+		return NodeEmailInvalidError
+	}
+
+	// These must fit in VARCHAR(255) columns.
+	switch {
+	case len(node.OwnerName) > 255:
+		return fmt.Errorf(NodeFieldTooLongError, "owner name")
+	case len(node.OwnerEmail) > 255:
+		return fmt.Errorf(NodeFieldTooLongError, "email")
+	case len(node.Contact) > 255:
+		return fmt.Errorf(NodeFieldTooLongError, "contact")
+	case len(node.Details) > 255:
+		return fmt.Errorf(NodeFieldTooLongError, "details")
+	}
+	return nil
+}
+
 var (
 	RemoteAddressDoesNotMatchError = errors.New(
 		"verify: remote address does not match Node address")
@@ -172,45 +302,19 @@ func SendVerificationEmail(id int64, recipientEmail string) (err error) {
 // every node in the verification queue that is marked as not yet
 // notified. It logs errors.
 func ResendVerificationEmails() {
-	rows, err := Db.Query(`SELECT id,email
-FROM nodes_verify_queue
-WHERE verifysent = 0;`)
+	emails, err := Db.DumpUnsentVerifications()
 	if err != nil {
 		l.Errf("Error resending verification emails: %s", err)
 		return
 	}
 
-	// Allocate slice so that rows can be updated later.
-	verifysent := make([]int64, 0)
-
-	for rows.Next() {
-		var (
-			id    int64
-			email string
-		)
-
-		if err = rows.Scan(&id, &email); err != nil {
-			l.Errf("Error resending verification email: %s", err)
-			continue
-		}
-
+	for id, email := range emails {
 		if err = SendVerificationEmail(id, email); err != nil {
 			l.Warningf("Could not send verification email to %q: %s", email, err)
-		} else {
-			verifysent = append(verifysent, id)
+			continue
 		}
-	}
-
-	setVerifysent, err := Db.Prepare(`UPDATE nodes_verify_queue
-SET verifysent = 1
-WHERE id = ?;`)
-	if err != nil {
-		l.Errf("Error preparing verifysent statement: %s", err)
-		return
-	}
 
-	for _, id := range verifysent {
-		if _, err = setVerifysent.Exec(id); err != nil {
+		if err = Db.SetVerificationSent(id); err != nil {
 			l.Warningf("Could not set verifysent for %d: %s", id, err)
 		}
 	}
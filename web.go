@@ -179,33 +179,19 @@ func CleanNodeRSS() {
 		Local: "nodes",
 	}
 
-	// We use a separate query here so that we can retrieve only the
-	// fields we need, and only nodes newer than RSS.MaxAge ago.
-	rows, err := Db.Query(`
-SELECT updated,address,owner
-FROM nodes
-WHERE updated >= ?;`, time.Now().Add(time.Duration(-Conf.Web.RSS.MaxAge)))
+	// Retrieve only the nodes newer than RSS.MaxAge ago, along with
+	// the times at which they were updated.
+	nodes, updated, err := Db.DumpLocalUpdated(
+		time.Now().Add(time.Duration(-Conf.Web.RSS.MaxAge)))
 	if err != nil {
 		l.Errf("Error getting nodes from database: %s", err)
 		return
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		// Initialize the variables.
-		var updated int64
-		node := new(Node)
-
-		// Scan all of the values into them.
-		err = rows.Scan(&updated, &node.Addr, &node.OwnerName)
-		if err != nil {
-			l.Errf("Error getting nodes from database: %s", err)
-			return
-		}
 
+	for i, node := range nodes {
 		// Add the Node to the RSS feed.
 		in := node.Item()
-		in.SetPubDate(time.Unix(updated, 0))
+		in.SetPubDate(updated[i])
 		NodeRSS.AddItem(in)
 	}
 
@@ -0,0 +1,269 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultYggdrasilAdmin is the default AdminListen of Yggdrasil.
+	defaultYggdrasilAdmin = "unix:///var/run/yggdrasil.sock"
+
+	// yggdrasilTimeout is the time allowed for each request to the
+	// admin socket, including connecting.
+	yggdrasilTimeout = 10 * time.Second
+)
+
+var YggdrasilAddressInvalidError = errors.New(
+	"yggdrasil network admin \"address\" must be unix:// or tcp://")
+
+// YggdrasilRange is the range of the addresses and subnets of nodes
+// on Yggdrasil, 200::/7.
+var YggdrasilRange = &net.IPNet{
+	IP:   net.ParseIP("200::"),
+	Mask: net.CIDRMask(7, 8*net.IPv6len),
+}
+
+func init() {
+	RegisterNetwork("yggdrasil", func() Network { return &YggdrasilNetwork{} })
+}
+
+// YggdrasilNetwork is a Network whose links are read from the admin
+// socket of a Yggdrasil node, given by the "address" credential as
+// "unix:///path" or "tcp://host:port". The links are those between
+// the node and its peers, and those of the spanning tree, as given by
+// "gettree", or on versions before 0.5 as derived from the
+// coordinates given by "getdht".
+type YggdrasilNetwork struct {
+	linkTable
+	network, address string
+}
+
+// yggdrasilEntry is a node as given in the responses of the admin
+// socket. Versions before 0.5 give nodes in objects keyed by their
+// addresses, with their coordinates, and later versions give them in
+// lists, with their keys and the keys of their parents in the tree.
+type yggdrasilEntry struct {
+	Address string          `json:"address"`
+	Key     string          `json:"key"`
+	Parent  string          `json:"parent"`
+	Coords  json.RawMessage `json:"coords"`
+}
+
+// yggdrasilResponse is a response from the admin socket.
+type yggdrasilResponse struct {
+	Status   string          `json:"status"`
+	Error    string          `json:"error"`
+	Response json.RawMessage `json:"response"`
+}
+
+func (n *YggdrasilNetwork) Connect(conf *NetworkAdminConfig) (err error) {
+	n.network, n.address, err = yggdrasilAdmin(conf)
+	if err != nil {
+		return
+	}
+
+	self, err := n.getSelf()
+	if err != nil {
+		return
+	}
+	peers, err := n.getEntries("getpeers", "peers")
+	if err != nil {
+		return
+	}
+	tree, err := n.getEntries("gettree", "tree")
+	if err != nil {
+		// Versions before 0.5 have no "gettree", but give the
+		// coordinates of nodes in the DHT instead.
+		if tree, err = n.getEntries("getdht", "dht"); err != nil {
+			return
+		}
+	}
+
+	// Versions before 0.5 list the node itself among its peers, which
+	// is ignored by link.
+	n.reset()
+	for _, peer := range peers {
+		n.link(net.ParseIP(self.Address), net.ParseIP(peer.Address), 0)
+	}
+
+	// Link each node in the tree to its parent, which is found by its
+	// key, or else by its coordinates, which are those of its parent
+	// with one more port.
+	all := append([]yggdrasilEntry{self}, append(peers, tree...)...)
+	byKey := make(map[string]string, len(all))
+	byCoords := make(map[string]string, len(all))
+	for _, entry := range all {
+		if len(entry.Key) > 0 {
+			byKey[entry.Key] = entry.Address
+		}
+		if coords, ok := parseYggdrasilCoords(entry.Coords); ok {
+			byCoords[strings.Join(coords, " ")] = entry.Address
+		}
+	}
+	for _, entry := range all {
+		if len(entry.Parent) > 0 && entry.Parent != entry.Key {
+			n.link(net.ParseIP(entry.Address),
+				net.ParseIP(byKey[entry.Parent]), 0)
+		} else if coords, ok := parseYggdrasilCoords(entry.Coords); ok &&
+			len(coords) > 0 {
+			parent := strings.Join(coords[:len(coords)-1], " ")
+			n.link(net.ParseIP(entry.Address),
+				net.ParseIP(byCoords[parent]), 0)
+		}
+	}
+	return
+}
+
+// Validate checks that the "address" credential, if given, is of a
+// known form.
+func (n *YggdrasilNetwork) Validate(conf *NetworkAdminConfig) (err error) {
+	_, _, err = yggdrasilAdmin(conf)
+	return
+}
+
+// AddressRange returns YggdrasilRange.
+func (n *YggdrasilNetwork) AddressRange() *net.IPNet {
+	return YggdrasilRange
+}
+
+// yggdrasilAdmin returns the network and address of the admin socket
+// given by the "address" credential of the given configuration, or
+// those of defaultYggdrasilAdmin if it is not given.
+func yggdrasilAdmin(conf *NetworkAdminConfig) (network, address string, err error) {
+	admin, _ := conf.Credentials["address"].(string)
+	if len(admin) == 0 {
+		admin = defaultYggdrasilAdmin
+	}
+	network, address, ok := socketAddress(admin)
+	if !ok {
+		return "", "", YggdrasilAddressInvalidError
+	}
+	return
+}
+
+// request sends a request with the given name to the admin socket,
+// and returns its response. Each request is made on its own
+// connection.
+func (n *YggdrasilNetwork) request(name string) (response json.RawMessage, err error) {
+	conn, err := net.DialTimeout(n.network, n.address, yggdrasilTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(yggdrasilTimeout))
+
+	err = json.NewEncoder(conn).Encode(map[string]interface{}{
+		"request":   name,
+		"keepalive": false,
+	})
+	if err != nil {
+		return
+	}
+	var resp yggdrasilResponse
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		return
+	}
+	if resp.Status != "success" {
+		return nil, fmt.Errorf("yggdrasil %s: %s", name, resp.Error)
+	}
+	return resp.Response, nil
+}
+
+// getSelf returns the node whose admin socket is connected to. Versions
+// before 0.5 give it in an object keyed by its address, under "self".
+func (n *YggdrasilNetwork) getSelf() (self yggdrasilEntry, err error) {
+	response, err := n.request("getself")
+	if err != nil {
+		return
+	}
+	var wrapper struct {
+		yggdrasilEntry
+		Self json.RawMessage `json:"self"`
+	}
+	if err = json.Unmarshal(response, &wrapper); err != nil {
+		return
+	}
+	self = wrapper.yggdrasilEntry
+	if len(wrapper.Self) > 0 {
+		var entries []yggdrasilEntry
+		if entries, err = parseYggdrasilEntries(wrapper.Self); err != nil {
+			return
+		} else if len(entries) > 0 {
+			self = entries[0]
+		}
+	}
+	if net.ParseIP(self.Address) == nil {
+		err = fmt.Errorf("yggdrasil getself: invalid address %q",
+			self.Address)
+	}
+	return
+}
+
+// getEntries sends the request with the given name to the admin
+// socket, and returns the nodes given under the given field of the
+// response.
+func (n *YggdrasilNetwork) getEntries(name, field string) (entries []yggdrasilEntry, err error) {
+	response, err := n.request(name)
+	if err != nil {
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(response, &fields); err != nil {
+		return
+	}
+	return parseYggdrasilEntries(fields[field])
+}
+
+// parseYggdrasilEntries parses a list of nodes, or an object of nodes
+// keyed by their addresses.
+func parseYggdrasilEntries(raw json.RawMessage) (entries []yggdrasilEntry, err error) {
+	if len(raw) == 0 || raw[0] != '{' {
+		err = json.Unmarshal(raw, &entries)
+		return
+	}
+
+	var byAddress map[string]yggdrasilEntry
+	if err = json.Unmarshal(raw, &byAddress); err != nil {
+		return
+	}
+	entries = make([]yggdrasilEntry, 0, len(byAddress))
+	for address, entry := range byAddress {
+		entry.Address = address
+		entries = append(entries, entry)
+	}
+	return
+}
+
+// parseYggdrasilCoords parses the coordinates of a node, which are
+// given as a list of ports, or as a string such as "[1 3 2]". It
+// returns false if there are none.
+func parseYggdrasilCoords(raw json.RawMessage) (coords []string, ok bool) {
+	if len(raw) == 0 {
+		return nil, false
+	}
+	var s string
+	if raw[0] == '"' {
+		if json.Unmarshal(raw, &s) != nil {
+			return nil, false
+		}
+		s = strings.Trim(s, "[]")
+	} else {
+		var ports []uint64
+		if json.Unmarshal(raw, &ports) != nil {
+			return nil, false
+		}
+		for _, port := range ports {
+			s += strconv.FormatUint(port, 10) + " "
+		}
+	}
+	return strings.Fields(s), true
+}
@@ -0,0 +1,138 @@
+package main
+
+// Copyright (C) 2013 Alexander Bauer, Luke Evers, Dylan Whichard,
+// and contributors; (GPLv3) see LICENSE or doc.go
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// serveYggdrasil stands in for the admin socket of a Yggdrasil node
+// on a new UNIX socket, answering each request with the response
+// given for its name. It returns the address of the socket, as given
+// in the "address" credential, and a function which stops it.
+func serveYggdrasil(t *testing.T, responses map[string]string) (address string, stop func()) {
+	dir, err := ioutil.TempDir("", "nodeatlas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "yggdrasil.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var req struct {
+				Request string `json:"request"`
+			}
+			json.NewDecoder(conn).Decode(&req)
+			if response, ok := responses[req.Request]; ok {
+				conn.Write([]byte(`{"status":"success","response":` +
+					response + `}`))
+			} else {
+				conn.Write([]byte(`{"status":"error","error":"unknown request"}`))
+			}
+			conn.Close()
+		}
+	}()
+	return "unix://" + path, func() {
+		ln.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// peerAddresses returns the addresses of the peers of the node with
+// the given address, as found by the given Network, in order.
+func peerAddresses(t *testing.T, n Network, addr string) (peers []string) {
+	p, err := n.PeersOf(IP(net.ParseIP(addr)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers = make([]string, 0, len(p.Destinations))
+	for _, dest := range p.Destinations {
+		peers = append(peers, net.IP(dest).String())
+	}
+	sort.Strings(peers)
+	return
+}
+
+func TestYggdrasilPeersOf(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses map[string]string
+		peers     map[string][]string
+	}{
+		{
+			name: "gettree",
+			responses: map[string]string{
+				"getself": `{"address":"200::1","key":"k1"}`,
+				"getpeers": `{"peers":[{"address":"200::2","key":"k2"},
+{"address":"200::3","key":"k3"}]}`,
+				"gettree": `{"tree":[
+{"address":"200::1","key":"k1","parent":"k1"},
+{"address":"200::2","key":"k2","parent":"k1"},
+{"address":"200::4","key":"k4","parent":"k2"},
+{"address":"200::5","key":"k5","parent":"unknown"}]}`,
+			},
+			peers: map[string][]string{
+				"200::1": {"200::2", "200::3"},
+				"200::2": {"200::1", "200::4"},
+				"200::3": {"200::1"},
+				"200::4": {"200::2"},
+				"200::5": {},
+			},
+		},
+		{
+			name: "getdht",
+			responses: map[string]string{
+				"getself": `{"self":{"200::1":{"coords":"[1]"}}}`,
+				"getpeers": `{"peers":{"200::1":{"coords":"[1]"},
+"200::2":{"coords":"[]"}}}`,
+				"getdht": `{"dht":{"200::3":{"coords":"[1 4]"},
+"200::4":{"coords":"[2]"},
+"200::5":{"coords":"[9 9]"}}}`,
+			},
+			peers: map[string][]string{
+				"200::1": {"200::2", "200::3"},
+				"200::2": {"200::1", "200::4"},
+				"200::3": {"200::1"},
+				"200::4": {"200::2"},
+				"200::5": {},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		address, stop := serveYggdrasil(t, test.responses)
+		n := &YggdrasilNetwork{}
+		err := n.Connect(&NetworkAdminConfig{
+			Type:        "yggdrasil",
+			Credentials: map[string]interface{}{"address": address},
+		})
+		if err != nil {
+			stop()
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		for addr, want := range test.peers {
+			if got := peerAddresses(t, n, addr); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: peers of %s are %v, not %v",
+					test.name, addr, got, want)
+			}
+		}
+		stop()
+	}
+}